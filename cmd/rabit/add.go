@@ -1,18 +1,27 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
-
 	"github.com/burke/rabit/pkg/repo"
 )
 
 func init() {
 	register("add", cmdAdd, true, false, `
-usage: %s add <path> <name>
+usage: %s add [-m <message>] [--meta=<key=value>]... <path> <name>
+
+Add a file to the rabit repository. Its mode and modification time are
+recorded along with it. Adding to a name already in use makes a new
+version of that file; see 'rabit log'.
 
-Add a file to the rabit repository
+Options:
+  -m, --message=<message>  Describe this version of the file
+  --meta=<key=value>       Record a piece of metadata with the file; may be
+                           given more than once
 
 Environment Variables:
   RABIT_DIR  Path on disk to the rabit repository
@@ -20,15 +29,40 @@ Environment Variables:
 }
 
 func cmdAdd(args *docopt.Args, rabitDir, rabitRemote string) error {
-	repo := repo.New(rabitDir)
+	r, err := openRepo(rabitDir)
+	if err != nil {
+		return err
+	}
 
 	path := args.String["<path>"]
 	name := args.String["<name>"]
 
+	var meta map[string]string
+	for _, kv := range args.All["--meta"].([]string) {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return fmt.Errorf("--meta %q isn't key=value", kv)
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[kv[:i]] = kv[i+1:]
+	}
+
 	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
 
-	return repo.Add(f, name)
+	return r.AddWithOptions(f, name, &repo.AddOptions{
+		Mode:    fi.Mode(),
+		ModTime: fi.ModTime().UTC().Truncate(time.Second),
+		Meta:    meta,
+		Message: args.String["--message"],
+	})
 }
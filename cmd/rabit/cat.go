@@ -1,18 +1,32 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"os"
+	"strconv"
 
 	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
-
 	"github.com/burke/rabit/pkg/repo"
 )
 
 func init() {
 	register("cat", cmdCat, true, false, `
-usage: %s cat <name>
+usage: %s cat [options] <name>[@<version>]
+
+Write the contents of a file in the repository to stdout: its latest
+version, or the one numbered in 'rabit log'. A manifest ID may be given
+instead of a name. With --offset or
+--length, only the blocks covering that range are read.
+
+Every block is checked against its hash, and the whole file against the
+hash recorded when it was added, unless --no-verify is given. Output stops
+at the first corrupt block, and the command fails.
 
-Write the contents of a file in the repository to stdout.
+Options:
+  --no-verify   Don't check the file's contents
+  --offset=<n>  Start this many bytes into the file
+  --length=<n>  Write at most this many bytes
 
 Environment Variables:
   RABIT_DIR  Path on disk to the rabit repository
@@ -20,9 +34,39 @@ Environment Variables:
 }
 
 func cmdCat(args *docopt.Args, rabitDir, rabitRemote string) error {
-	repo := repo.New(rabitDir)
+	r, err := openRepo(rabitDir)
+	if err != nil {
+		return err
+	}
 
 	name := args.String["<name>"]
+	offset, length := args.String["--offset"], args.String["--length"]
+	if offset == "" && length == "" {
+		return r.CatFileWithOptions(name, os.Stdout, &repo.CatOptions{NoVerify: args.Bool["--no-verify"]})
+	}
 
-	return repo.CatFile(name, os.Stdout)
+	f, err := r.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var src io.Reader = f
+	if offset != "" {
+		n, err := strconv.ParseInt(offset, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad --offset %q", offset)
+		}
+		if _, err := f.Seek(n, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if length != "" {
+		n, err := strconv.ParseInt(length, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad --length %q", length)
+		}
+		src = io.LimitReader(f, n)
+	}
+	_, err = io.Copy(os.Stdout, src)
+	return err
 }
@@ -1,9 +1,9 @@
 package main
 
 import (
-	"fmt"
-
 	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
+
+	"github.com/burke/rabit/pkg/remote"
 )
 
 func init() {
@@ -11,6 +11,9 @@ func init() {
 usage: %s fetch <name>
 
 Copy a file from a remote rabit server to the local repository.
+Only chunks not already present locally are downloaded. If a root.json
+has been pinned with 'rabit trust', the file must be covered by valid
+signed metadata from the server.
 
 Environment Variables:
   RABIT_DIR     Path on disk to the rabit repository
@@ -19,7 +22,13 @@ Environment Variables:
 }
 
 func cmdFetch(args *docopt.Args, rabitDir, rabitRemote string) error {
-	fmt.Println("done fetch")
+	repo, err := openRepo(rabitDir)
+	if err != nil {
+		return err
+	}
+	client := remote.New(rabitRemote, "")
+
+	name := args.String["<name>"]
 
-	return nil
+	return remote.Fetch(repo, client, name)
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
+)
+
+func init() {
+	register("fsck", cmdFsck, true, false, `
+usage: %s fsck [--quarantine]
+
+Check the integrity of the repository. Every chunk is read back and
+rehashed, and every file is checked for chunks that are missing or
+corrupt. Chunks that no file refers to are listed too; 'rabit gc' removes
+them.
+
+Options:
+  --quarantine  Move corrupt chunks aside, under metadata/quarantine, so a
+                later fetch can replace them
+
+Environment Variables:
+  RABIT_DIR  Path on disk to the rabit repository
+`)
+}
+
+func cmdFsck(args *docopt.Args, rabitDir, rabitRemote string) error {
+	repo, err := openRepo(rabitDir)
+	if err != nil {
+		return err
+	}
+	report, err := repo.Verify(args.Bool["--quarantine"])
+	if err != nil {
+		return err
+	}
+
+	for _, m := range report.Manifests {
+		switch {
+		case m.Err != nil:
+			fmt.Printf("%s: unreadable: %s\n", m.Name, m.Err)
+		case m.OK():
+			fmt.Printf("%s: ok\n", m.Name)
+		default:
+			for _, line := range m.BadLines {
+				fmt.Printf("%s: malformed line %q\n", m.Name, line)
+			}
+			for _, h := range m.Missing {
+				fmt.Printf("%s: missing chunk %s\n", m.Name, h)
+			}
+			for _, h := range m.Corrupt {
+				fmt.Printf("%s: corrupt chunk %s\n", m.Name, h)
+			}
+		}
+	}
+	corrupt := make(map[string]bool)
+	for _, h := range report.Corrupt {
+		corrupt[h] = true
+	}
+	for _, h := range report.Orphans {
+		if corrupt[h] {
+			fmt.Printf("orphan chunk %s (corrupt)\n", h)
+		} else {
+			fmt.Printf("orphan chunk %s\n", h)
+		}
+	}
+	for _, h := range report.Quarantined {
+		fmt.Printf("quarantined chunk %s\n", h)
+	}
+	fmt.Printf("checked %d chunks in %d files\n", report.Chunks, len(report.Manifests))
+
+	if !report.OK() {
+		return fmt.Errorf("repository is damaged")
+	}
+	return nil
+}
@@ -1,16 +1,35 @@
 package main
 
 import (
-	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"fmt"
+	"time"
 
+	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
 	"github.com/burke/rabit/pkg/repo"
 )
 
 func init() {
 	register("gc", cmdGC, true, false, `
-usage: %s gc
+usage: %s gc [options]
+
+Remove any blocks belonging only to removed manifests. Blocks written
+within the grace period are kept, since an add or push still in progress
+may be about to refer to them. On S3, where locks only cover one process,
+only run gc while nothing else is writing to the bucket.
 
-Remove any blocks belonging only to removed manifests
+If the repository has a retention policy (see 'rabit retention'), versions
+of files it doesn't keep are dropped first.
+
+The blocks to remove are found in the repository's reference index. A
+full collection instead reads every file, finding blocks the index never
+knew about, such as those left by an interrupted add, and rebuilds the
+index. Collections on S3, which keeps no index, are always full.
+
+Options:
+  -n, --dry-run    List the blocks that would be removed, without removing
+                   them
+  --grace=<dur>    Keep unreferenced blocks younger than this [default: 1h]
+  --full           Read every file, rather than trusting the index
 
 Environment Variables:
   RABIT_DIR  Path on disk to the rabit repository
@@ -18,6 +37,39 @@ Environment Variables:
 }
 
 func cmdGC(args *docopt.Args, rabitDir, rabitRemote string) error {
-	repo := repo.New(rabitDir)
-	return repo.GC(true)
+	grace, err := time.ParseDuration(args.String["--grace"])
+	if err != nil {
+		return fmt.Errorf("--grace: %s", err)
+	}
+	r, err := openRepo(rabitDir)
+	if err != nil {
+		return err
+	}
+	dryRun := args.Bool["--dry-run"]
+	report, err := r.GC(repo.GCOptions{
+		DryRun: dryRun,
+		Grace:  grace,
+		Full:   args.Bool["--full"],
+		Progress: func(hash string, size int64) {
+			fmt.Println(hash)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	verb := "removed"
+	if dryRun {
+		verb = "would remove"
+	}
+	fmt.Print(verb)
+	if report.Versions > 0 {
+		fmt.Printf(" %d old versions and", report.Versions)
+	}
+	fmt.Printf(" %d blocks, %d bytes", report.Chunks, report.Bytes)
+	if report.Spared > 0 {
+		fmt.Printf("; kept %d written within %s", report.Spared, grace)
+	}
+	fmt.Println()
+	return nil
 }
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
 
@@ -11,12 +13,55 @@ import (
 
 func init() {
 	register("init", cmdInit, false, false, `
-usage: %s init
+usage: %s init [options]
 
 Initialize a new rabit repository.
 
+Files are cut into chunks at content-defined boundaries, ignoring
+boundaries before --min-chunk bytes and always cutting at --max-chunk
+bytes. The algorithm and sizes are stored in the repository and used for
+every file added to it. Sizes take an optional K, M or G suffix.
+
+Chunks come out at around --avg-chunk bytes on average. The rollsum
+chunker (bup's rolling checksum) needs --avg-chunk to be --min-chunk plus
+a power of two, and defaults to 64K/72K/1M. The fastcdc chunker is faster
+and needs --avg-chunk to be a power of two; it defaults to 16K/64K/512K.
+
+Chunks are named by their --hash. blake2b is faster than sha256 on most
+machines without SHA instructions; sha1 is only for compatibility with
+older repositories.
+
+With --compression=gzip, each chunk is compressed on its way into the
+repository unless that saves next to nothing, as for already-compressed
+data. Chunks keep the names of their uncompressed contents, and are always
+transferred to and from remotes uncompressed.
+
+With --packs, chunks are appended to large pack files rather than each
+kept in a file of its own, which suits repositories with many chunks.
+Space taken by removed chunks is reclaimed by 'rabit repack'.
+
+With --encrypt, chunks and manifests are encrypted with AES-256-GCM under
+a key unlocked by RABIT_PASSPHRASE, or the contents of RABIT_KEY_FILE,
+which must then be set for every command using the repository. Chunks are
+named by a hash keyed with the repository's own random key, so an encrypted
+repository can only push to or fetch from a server for itself, or for a
+copy of it; push and fetch refuse any other remote. They exchange chunks
+and manifests still encrypted, so 'rabit serve' needs no key.
+
+Options:
+  --hash=<algorithm>     Chunk hash function, sha256, blake2b or sha1 [default: sha256]
+  --compression=<codec>  Chunk compression, gzip or none [default: none]
+  --encrypt              Encrypt the repository
+  --packs                Keep chunks in pack files
+  --chunker=<algorithm>  Chunking algorithm, rollsum or fastcdc [default: rollsum]
+  --min-chunk=<size>     Minimum chunk size
+  --avg-chunk=<size>     Average chunk size
+  --max-chunk=<size>     Maximum chunk size
+
 Environment Variables:
-  RABIT_DIR  the pre-existing empty directory at which to create the repo
+  RABIT_DIR         the pre-existing empty directory at which to create the repo
+  RABIT_PASSPHRASE  passphrase to encrypt the repository with
+  RABIT_KEY_FILE    file holding a key to encrypt the repository with
 `)
 }
 
@@ -24,10 +69,70 @@ func cmdInit(args *docopt.Args, rabitDir, rabitRemote string) error {
 	if rabitDir == "" {
 		return fmt.Errorf("RABIT_DIR must specify a path to an existing directory")
 	}
-	stat, err := os.Stat(rabitDir)
-	if err != nil || !stat.IsDir() {
-		return fmt.Errorf("RABIT_DIR must specify a path to an existing directory")
+	if !isS3(rabitDir) {
+		stat, err := os.Stat(rabitDir)
+		if err != nil || !stat.IsDir() {
+			return fmt.Errorf("RABIT_DIR must specify a path to an existing directory")
+		}
+	}
+
+	cfg := repo.DefaultConfigFor(args.String["--chunker"])
+	cfg.Hash = args.String["--hash"]
+	if cfg.Compression = args.String["--compression"]; cfg.Compression == "none" {
+		cfg.Compression = repo.CompressionNone
 	}
+	for _, opt := range []struct {
+		flag string
+		size *int
+	}{
+		{"--min-chunk", &cfg.MinChunkSize},
+		{"--avg-chunk", &cfg.AvgChunkSize},
+		{"--max-chunk", &cfg.MaxChunkSize},
+	} {
+		if args.String[opt.flag] == "" {
+			continue
+		}
+		n, err := parseSize(args.String[opt.flag])
+		if err != nil {
+			return err
+		}
+		*opt.size = n
+	}
+
+	store, err := newStore(rabitDir, args.Bool["--packs"])
+	if err != nil {
+		return err
+	}
+	if !args.Bool["--encrypt"] {
+		return repo.NewWithStore(store).Init(cfg)
+	}
+	secret, err := repoSecret()
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return fmt.Errorf("--encrypt needs RABIT_PASSPHRASE or RABIT_KEY_FILE to be set")
+	}
+	return repo.NewWithKey(store, secret).Init(cfg)
+}
 
-	return repo.New(rabitDir).Init()
+// parseSize parses a byte count with an optional binary K, M or G suffix.
+func parseSize(s string) (int, error) {
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "K"), strings.HasSuffix(s, "k"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"), strings.HasSuffix(s, "m"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"), strings.HasSuffix(s, "g"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
+
+	"github.com/burke/rabit/pkg/tuf"
+)
+
+func init() {
+	register("keygen", cmdKeygen, true, false, `
+usage: %s keygen [<role>...]
+
+Generate ed25519 signing keys and add them to the repository's root.json.
+Roles are root, targets, snapshot and timestamp; with no roles given, a key
+is generated for each of them. A root key must exist before keys for the
+other roles can be trusted.
+
+Environment Variables:
+  RABIT_DIR   Path on disk to the rabit repository
+  RABIT_KEYS  Directory holding private keys (default: $RABIT_DIR/keys)
+`)
+}
+
+func cmdKeygen(args *docopt.Args, rabitDir, rabitRemote string) error {
+	repo, err := openRepo(rabitDir)
+	if err != nil {
+		return err
+	}
+
+	roles := args.All["<role>"].([]string)
+	if len(roles) == 0 {
+		roles = tuf.Roles
+	}
+
+	keys, err := keyDir(rabitDir)
+	if err != nil {
+		return err
+	}
+
+	return tuf.GenKeys(repo, keys, roles)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
+)
+
+func init() {
+	register("log", cmdLog, true, false, `
+usage: %s log <name>
+
+List the versions kept of a file, newest first: each one's number, when it
+was added, the ID of its manifest, its size and its message. A version can
+be read with 'rabit cat <name>@<version>', or 'rabit cat <id>'.
+
+Environment Variables:
+  RABIT_DIR  Path on disk to the rabit repository
+`)
+}
+
+func cmdLog(args *docopt.Args, rabitDir, rabitRemote string) error {
+	r, err := openRepo(rabitDir)
+	if err != nil {
+		return err
+	}
+	versions, err := r.Log(args.String["<name>"])
+	if err != nil {
+		return err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		when := "-"
+		if !v.Time.IsZero() {
+			when = v.Time.Local().Format(time.RFC3339)
+		}
+		size := "-"
+		if v.Manifest.Version >= 2 {
+			size = fmt.Sprint(v.Manifest.Size)
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\t%s\n", v.Number, when, v.ID, size, v.Message)
+	}
+	return nil
+}
@@ -2,23 +2,62 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"text/tabwriter"
 
 	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
+
+	"github.com/burke/rabit/pkg/remote"
+	"github.com/burke/rabit/pkg/repo"
 )
 
 func init() {
 	register("ls-remote", cmdLsRemote, false, true, `
-usage: %s ls-remote
+usage: %s ls-remote [-l]
 
 List files in a remote rabit repository.
 
+Options:
+  -l, --long  Also show each file's size, its number of chunks, and how
+              many of those chunks are already in RABIT_DIR
+
 Environment Variables:
+  RABIT_DIR     Path on disk to the rabit repository (optional)
   RABIT_REMOTE  URL of remote rabit repository
 `)
 }
 
 func cmdLsRemote(args *docopt.Args, rabitDir, rabitRemote string) error {
-	fmt.Println("done ls-remote")
+	client := remote.New(rabitRemote, "")
+
+	names, err := client.ListManifests()
+	if err != nil {
+		return err
+	}
+
+	if !args.Bool["--long"] {
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	}
+
+	var local repo.Repo
+	if rabitDir != "" {
+		local, err = openRepo(rabitDir)
+		if err != nil {
+			return err
+		}
+	}
 
-	return nil
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tCHUNKS\tLOCAL")
+	for _, name := range names {
+		info, err := remote.Describe(client, local, name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", info.Name, info.Size, info.Chunks, info.Local)
+	}
+	return w.Flush()
 }
@@ -2,17 +2,27 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
-
-	"github.com/burke/rabit/pkg/repo"
 )
 
 func init() {
 	register("ls", cmdLs, true, false, `
-usage: %s ls
+usage: %s ls [-l] [-r] [<dir>]
+
+List files in a rabit repository, or in one of its directories. Names are
+slash-separated paths; each directory inside the one listed is shown once,
+ending in a slash, unless -r is given.
 
-List files in a rabit repository
+Options:
+  -l, --long       Also show the ID of the manifest each name points at,
+                   and each file's size and when it was added, for files
+                   whose manifests record them
+  -r, --recursive  List every file under the directory
 
 Environment Variables:
   RABIT_DIR  Path on disk to the rabit repository
@@ -20,13 +30,41 @@ Environment Variables:
 }
 
 func cmdLs(args *docopt.Args, rabitDir, rabitRemote string) error {
-	repo := repo.New(rabitDir)
-	names, err := repo.LsFiles()
+	repo, err := openRepo(rabitDir)
 	if err != nil {
 		return err
 	}
+	names, err := repo.LsFiles(args.String["<dir>"], args.Bool["--recursive"])
+	if err != nil {
+		return err
+	}
+	if !args.Bool["--long"] {
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tID\tSIZE\tADDED")
 	for _, name := range names {
-		fmt.Println(name)
+		if strings.HasSuffix(name, "/") {
+			fmt.Fprintf(w, "%s\t-\t-\t-\n", name)
+			continue
+		}
+		m, err := repo.LoadManifest(name)
+		if err != nil {
+			return err
+		}
+		id, err := repo.Resolve(name)
+		if err != nil {
+			return err
+		}
+		if m.Sizes == nil {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\n", name, id)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", name, id, m.Size, m.Created.Local().Format(time.RFC3339))
 	}
-	return nil
+	return w.Flush()
 }
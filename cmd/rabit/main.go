@@ -5,15 +5,25 @@ import (
 	"io"
 	"log"
 	"os"
+	"time"
 
 	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/burke/rabit/pkg/repo"
 )
 
 const usageTpl = `usage: %s [-h|--help] <command> [<args>...]
 
 Environment Variables:
-  RABIT_DIR     Path on disk to the rabit repository
+  RABIT_DIR     Path on disk to the rabit repository, or an s3://bucket/prefix
+                URL (configured by the usual AWS_* environment variables)
   RABIT_REMOTE  URL of remote rabit repository
+  RABIT_TOKEN   Token authorizing uploads to a rabit server
+  RABIT_KEYS    Directory holding private signing keys
+  RABIT_PASSPHRASE, RABIT_KEY_FILE
+                Passphrase, or file holding a key, for an encrypted repository
+  RABIT_LOCK_WAIT
+                How long to wait for another command's lock on the repository,
+                e.g. 30s (default 5m; 0 fails at once)
 
 Options:
   -h, --help
@@ -24,11 +34,22 @@ Commands:
   add        Add a file to the rabit repository
   ls         List files in a rabit repository
   cat        Print the contents of a file in the repository
+  log        List the versions kept of a file
+  ref        Point a name at a manifest already in the repository
   rm         Remove a file from the rabit repository
   gc         Remove any blocks belonging only to removed manifests
+  repack     Collect garbage and consolidate pack files
+  fsck       Check that every chunk and file in the repository is intact
+  stats      Show how much space the repository's files take up
+  retention  Show or set how many old versions of files gc keeps
   push       Upload to the rabit server
   fetch      Download from the rabit server
   ls-remote  List files available for download from the rabit server
+  serve      Serve the rabit repository over HTTP
+  keygen     Generate signing keys for the repository's files
+  sign       Sign metadata covering every file in the repository
+  trust      Pin the root metadata that fetched files must be signed under
+  migrate    Copy the repository into a new one using a different hash
 
 See "%s help <command>" for more information on a specific command.
 `
@@ -96,10 +117,18 @@ func runCommand(name string, args []string) error {
 		return err
 	}
 
+	if wait := os.Getenv("RABIT_LOCK_WAIT"); wait != "" {
+		d, err := time.ParseDuration(wait)
+		if err != nil {
+			return fmt.Errorf("RABIT_LOCK_WAIT: %s", err)
+		}
+		repo.LockWait = d
+	}
+
 	rabitDir := os.Getenv("RABIT_DIR")
 	rabitRemote := os.Getenv("RABIT_REMOTE")
 
-	if cmd.verifyDir {
+	if cmd.verifyDir && !isS3(rabitDir) {
 		if rabitDir == "" {
 			return fmt.Errorf("RABIT_DIR must specify a path to a valid rabit repository")
 		}
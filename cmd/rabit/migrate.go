@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+
+	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
+
+	"github.com/burke/rabit/pkg/repo"
+	"github.com/burke/rabit/pkg/tuf"
+)
+
+func init() {
+	register("migrate", cmdMigrate, true, false, `
+usage: %s migrate [--hash=<algorithm>] [--compression=<codec>] [--packs] <dest>
+
+Copy every file in the repository into a new repository at <dest>, an
+existing empty directory or an s3://bucket/prefix URL, naming chunks with
+a different hash function or compressing them differently. The new
+repository keeps the chunking settings of the old one, and its compression
+unless --compression is given. If RABIT_PASSPHRASE or RABIT_KEY_FILE is
+set, the new repository is encrypted with it. With --packs, the new
+repository keeps its chunks in pack files. Repositories created before the hash function was
+configurable use sha1.
+
+The trusted root metadata is copied across, but files must be signed again
+in the new repository: run 'rabit sign' there with RABIT_KEYS pointing at
+the existing keys.
+
+Options:
+  --hash=<algorithm>     sha256, blake2b or sha1 [default: sha256]
+  --compression=<codec>  gzip or none
+  --packs                Keep chunks in pack files
+
+Environment Variables:
+  RABIT_DIR  Path on disk to the rabit repository to migrate
+`)
+}
+
+func cmdMigrate(args *docopt.Args, rabitDir, rabitRemote string) error {
+	src, err := openRepo(rabitDir)
+	if err != nil {
+		return err
+	}
+	store, err := newStore(args.String["<dest>"], args.Bool["--packs"])
+	if err != nil {
+		return err
+	}
+	dst, err := repoWithSecret(store)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := src.Config()
+	if err != nil {
+		return err
+	}
+	newCfg := *cfg
+	newCfg.Hash = args.String["--hash"]
+	switch compression := args.String["--compression"]; compression {
+	case "":
+	case "none":
+		newCfg.Compression = repo.CompressionNone
+	default:
+		newCfg.Compression = compression
+	}
+	if err := dst.Init(&newCfg); err != nil {
+		return err
+	}
+
+	root, err := src.LoadMetadata(tuf.Filename(tuf.RoleRoot))
+	switch {
+	case err == nil:
+		if err := dst.WriteMetadata(tuf.Filename(tuf.RoleRoot), root); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	return repo.Migrate(src, dst)
+}
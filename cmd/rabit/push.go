@@ -1,25 +1,35 @@
 package main
 
 import (
-	"fmt"
+	"os"
 
 	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
+
+	"github.com/burke/rabit/pkg/remote"
 )
 
 func init() {
-	register("fetch", cmdPush, true, true, `
+	register("push", cmdPush, true, true, `
 usage: %s push <name>
 
 Copy a file from the local rabit repository to the rabit server.
+Only chunks the server does not already have are uploaded.
 
 Environment Variables:
   RABIT_DIR     Path on disk to the rabit repository
   RABIT_REMOTE  URL of remote rabit repository
+  RABIT_TOKEN   Token authorizing uploads to the rabit server
 `)
 }
 
 func cmdPush(args *docopt.Args, rabitDir, rabitRemote string) error {
-	fmt.Println("done push")
+	repo, err := openRepo(rabitDir)
+	if err != nil {
+		return err
+	}
+	client := remote.New(rabitRemote, os.Getenv("RABIT_TOKEN"))
+
+	name := args.String["<name>"]
 
-	return nil
+	return remote.Push(repo, client, name)
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/burke/rabit/pkg/repo"
+)
+
+func init() {
+	register("ref", cmdRef, true, false, `
+usage: %s ref [options] <name> <target>
+
+Point a name at a manifest already in the repository, as the name's latest
+version, without adding the file again. <target> is another name,
+optionally with @<version>, or a manifest ID as shown by 'rabit ls -l' and
+'rabit log'. The ID of the manifest the name now points at is printed.
+
+With --expect or --create, the update only happens if the name still
+points where it was expected to, so that concurrent updates can't
+overwrite each other.
+
+Options:
+  --expect=<id>            Fail unless the name points at this manifest
+  --create                 Fail if the name exists already
+  -m, --message=<message>  Describe this version of the name
+
+Environment Variables:
+  RABIT_DIR  Path on disk to the rabit repository
+`)
+}
+
+func cmdRef(args *docopt.Args, rabitDir, rabitRemote string) error {
+	r, err := openRepo(rabitDir)
+	if err != nil {
+		return err
+	}
+	opts := &repo.RefOptions{
+		Expect:  args.String["--expect"],
+		Create:  args.Bool["--create"],
+		Message: args.String["--message"],
+	}
+	if opts.Expect != "" && opts.Create {
+		return fmt.Errorf("--expect and --create can't both be given")
+	}
+
+	name := args.String["<name>"]
+	if err := r.UpdateRef(name, args.String["<target>"], opts); err != nil {
+		return err
+	}
+	id, err := r.Resolve(name)
+	if err != nil {
+		return err
+	}
+	fmt.Println(id)
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
+)
+
+func init() {
+	register("repack", cmdRepack, true, false, `
+usage: %s repack
+
+Remove any blocks belonging only to removed manifests and, in a repository
+created with 'rabit init --packs', consolidate the pack files, reclaiming
+the space removed blocks took up.
+
+Environment Variables:
+  RABIT_DIR  Path on disk to the rabit repository
+`)
+}
+
+func cmdRepack(args *docopt.Args, rabitDir, rabitRemote string) error {
+	repo, err := openRepo(rabitDir)
+	if err != nil {
+		return err
+	}
+	return repo.Repack()
+}
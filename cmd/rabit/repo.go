@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/burke/rabit/pkg/repo"
+	"github.com/burke/rabit/pkg/s3store"
+)
+
+func isS3(rabitDir string) bool {
+	return strings.HasPrefix(rabitDir, "s3://")
+}
+
+// openStore returns the store at rabitDir, which is either a path on disk
+// or an s3://bucket/prefix URL. Repositories on disk with a packs directory
+// keep their chunks in pack files.
+func openStore(rabitDir string) (repo.Store, error) {
+	if isS3(rabitDir) {
+		cfg, err := s3store.ParseURL(rabitDir)
+		if err != nil {
+			return nil, err
+		}
+		return s3store.New(cfg), nil
+	}
+	if fi, err := os.Stat(filepath.Join(rabitDir, "packs")); err == nil && fi.IsDir() {
+		return repo.NewPackStore(rabitDir), nil
+	}
+	return repo.NewDiskStore(rabitDir), nil
+}
+
+// newStore returns a store for a repository about to be created at
+// rabitDir, packed if packed is set.
+func newStore(rabitDir string, packed bool) (repo.Store, error) {
+	if !packed {
+		return openStore(rabitDir)
+	}
+	if isS3(rabitDir) {
+		return nil, fmt.Errorf("--packs is only supported for repositories on disk")
+	}
+	return repo.NewPackStore(rabitDir), nil
+}
+
+// openRepo returns the repository at rabitDir, unlocked with the secret
+// from the environment if there is one.
+func openRepo(rabitDir string) (repo.Repo, error) {
+	store, err := openStore(rabitDir)
+	if err != nil {
+		return nil, err
+	}
+	return repoWithSecret(store)
+}
+
+// repoWithSecret returns a Repo on store, unlocked with the secret from the
+// environment if there is one.
+func repoWithSecret(store repo.Store) (repo.Repo, error) {
+	secret, err := repoSecret()
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return repo.NewWithStore(store), nil
+	}
+	return repo.NewWithKey(store, secret), nil
+}
+
+// repoSecret returns the passphrase or key file contents that encrypted
+// repositories are unlocked with, or nil if neither is set.
+func repoSecret() ([]byte, error) {
+	if pass := os.Getenv("RABIT_PASSPHRASE"); pass != "" {
+		return []byte(pass), nil
+	}
+	if path := os.Getenv("RABIT_KEY_FILE"); path != "" {
+		secret, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("RABIT_KEY_FILE %s is empty", path)
+		}
+		return secret, nil
+	}
+	return nil, nil
+}
+
+// keyDir is where private signing keys live. Repositories in object
+// storage have nowhere local to default to, so RABIT_KEYS is required.
+func keyDir(rabitDir string) (string, error) {
+	if dir := os.Getenv("RABIT_KEYS"); dir != "" {
+		return dir, nil
+	}
+	if isS3(rabitDir) {
+		return "", fmt.Errorf("RABIT_KEYS must be set when RABIT_DIR is an s3:// URL")
+	}
+	return filepath.Join(rabitDir, "keys"), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/burke/rabit/pkg/repo"
+)
+
+func init() {
+	register("retention", cmdRetention, true, false, `
+usage: %s retention [--keep-last=<n>] [--keep-days=<n>] [--keep-all]
+
+Show or set the retention policy, which limits the old versions of each
+file that 'rabit gc' keeps. A version is kept if it is one of the last
+--keep-last versions, or was added in the last --keep-days days. The
+latest version of a file is always kept. With no policy, every version is.
+
+Options:
+  --keep-last=<n>  Keep the last n versions of each file
+  --keep-days=<n>  Keep every version added in the last n days
+  --keep-all       Remove the policy, keeping every version
+
+Environment Variables:
+  RABIT_DIR  Path on disk to the rabit repository
+`)
+}
+
+func cmdRetention(args *docopt.Args, rabitDir, rabitRemote string) error {
+	r, err := openRepo(rabitDir)
+	if err != nil {
+		return err
+	}
+
+	last, days := args.String["--keep-last"], args.String["--keep-days"]
+	if args.Bool["--keep-all"] {
+		if last != "" || days != "" {
+			return fmt.Errorf("--keep-all can't be given with --keep-last or --keep-days")
+		}
+		return r.SetRetention(nil)
+	}
+	if last != "" || days != "" {
+		ret := &repo.Retention{}
+		if last != "" {
+			if ret.KeepLast, err = strconv.Atoi(last); err != nil || ret.KeepLast < 1 {
+				return fmt.Errorf("--keep-last must be a positive number")
+			}
+		}
+		if days != "" {
+			if ret.KeepDays, err = strconv.Atoi(days); err != nil || ret.KeepDays < 1 {
+				return fmt.Errorf("--keep-days must be a positive number")
+			}
+		}
+		return r.SetRetention(ret)
+	}
+
+	cfg, err := r.Config()
+	if err != nil {
+		return err
+	}
+	ret := cfg.Retention
+	if ret == nil {
+		fmt.Println("keep every version")
+		return nil
+	}
+	if ret.KeepLast > 0 {
+		fmt.Printf("keep the last %d versions\n", ret.KeepLast)
+	}
+	if ret.KeepDays > 0 {
+		fmt.Printf("keep versions added in the last %d days\n", ret.KeepDays)
+	}
+	return nil
+}
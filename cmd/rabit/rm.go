@@ -1,17 +1,22 @@
 package main
 
 import (
-	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"fmt"
 
+	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
 	"github.com/burke/rabit/pkg/repo"
 )
 
 func init() {
 	register("rm", cmdRm, true, false, `
-usage: %s rm <name>
+usage: %s rm [--gc] <name>...
+
+Remove files, with every version of them, from the rabit repository.
+Their blocks stay behind until 'rabit gc' is run, or --gc is given.
 
-Remove a file from the rabit repository.
-You may want to run 'rabit gc' afterward.
+Options:
+  --gc  Remove the blocks no remaining file refers to afterward, as
+        'rabit gc' does, sparing those written in the last hour
 
 Environment Variables:
   RABIT_DIR  Path on disk to the rabit repository
@@ -19,7 +24,20 @@ Environment Variables:
 }
 
 func cmdRm(args *docopt.Args, rabitDir, rabitRemote string) error {
-	repo := repo.New(rabitDir)
-	name := args.String["<name>"]
-	return repo.Rm(name)
+	r, err := openRepo(rabitDir)
+	if err != nil {
+		return err
+	}
+	if err := r.Rm(args.All["<name>"].([]string)...); err != nil {
+		return err
+	}
+	if !args.Bool["--gc"] {
+		return nil
+	}
+	report, err := r.GC(repo.GCOptions{Grace: repo.DefaultGCGrace})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("removed %d blocks, %d bytes\n", report.Chunks, report.Bytes)
+	return nil
 }
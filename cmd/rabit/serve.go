@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
+
+	"github.com/burke/rabit/pkg/server"
+)
+
+func init() {
+	register("serve", cmdServe, true, false, `
+usage: %s serve [--listen=<addr>]
+
+Serve the rabit repository over HTTP so it can be used as a remote.
+Uploads are only accepted if RABIT_TOKEN is set, and must present it.
+
+Options:
+  --listen=<addr>  Address to listen on [default: :8080]
+
+Environment Variables:
+  RABIT_DIR    Path on disk to the rabit repository
+  RABIT_TOKEN  Token clients must present to upload
+`)
+}
+
+func cmdServe(args *docopt.Args, rabitDir, rabitRemote string) error {
+	repo, err := openRepo(rabitDir)
+	if err != nil {
+		return err
+	}
+	srv := server.New(repo, os.Getenv("RABIT_TOKEN"))
+
+	addr := args.String["--listen"]
+	log.Println("serving", rabitDir, "on", addr)
+	return http.ListenAndServe(addr, srv)
+}
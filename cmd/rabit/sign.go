@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
+
+	"github.com/burke/rabit/pkg/tuf"
+)
+
+func init() {
+	register("sign", cmdSign, true, false, `
+usage: %s sign
+
+Sign targets metadata covering every file in the repository, along with
+fresh snapshot and timestamp metadata. The timestamp expires after a day,
+so this must be re-run regularly. 'rabit push' publishes the result.
+
+Environment Variables:
+  RABIT_DIR   Path on disk to the rabit repository
+  RABIT_KEYS  Directory holding private keys (default: $RABIT_DIR/keys)
+`)
+}
+
+func cmdSign(args *docopt.Args, rabitDir, rabitRemote string) error {
+	repo, err := openRepo(rabitDir)
+	if err != nil {
+		return err
+	}
+	keys, err := keyDir(rabitDir)
+	if err != nil {
+		return err
+	}
+
+	return tuf.SignTargets(repo, keys)
+}
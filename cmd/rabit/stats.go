@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
+)
+
+func init() {
+	register("stats", cmdStats, true, false, `
+usage: %s stats [<hash>...]
+
+Show how many files the repository holds, how many distinct blocks they
+are made of and the space those take up, counting blocks shared between
+files once. Blocks no file uses any more, which 'rabit gc' would remove,
+are counted separately.
+
+Given block hashes, show how many versions of files use each of them
+instead. That counts every version of a file that uses a block, and a
+version two names share once for each name.
+
+Environment Variables:
+  RABIT_DIR  Path on disk to the rabit repository
+`)
+}
+
+func cmdStats(args *docopt.Args, rabitDir, rabitRemote string) error {
+	repo, err := openRepo(rabitDir)
+	if err != nil {
+		return err
+	}
+
+	if hashes := args.All["<hash>"].([]string); len(hashes) > 0 {
+		for _, h := range hashes {
+			refs, err := repo.ChunkRefs(h)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s %d\n", h, refs)
+		}
+		return nil
+	}
+
+	u, err := repo.Usage()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("files:        %d\n", u.Files)
+	fmt.Printf("blocks:       %d\n", u.Chunks)
+	fmt.Printf("bytes:        %d\n", u.Bytes)
+	fmt.Printf("dead blocks:  %d\n", u.DeadChunks)
+	fmt.Printf("dead bytes:   %d\n", u.DeadBytes)
+	return nil
+}
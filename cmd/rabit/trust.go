@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+
+	"github.com/burke/rabit/Godeps/_workspace/src/github.com/flynn/go-docopt"
+
+	"github.com/burke/rabit/pkg/tuf"
+)
+
+func init() {
+	register("trust", cmdTrust, true, false, `
+usage: %s trust <root.json>
+
+Pin a root.json obtained out of band from the publisher. From then on,
+'rabit fetch' refuses any file that isn't covered by valid signed metadata
+from the keys it lists.
+
+Environment Variables:
+  RABIT_DIR  Path on disk to the rabit repository
+`)
+}
+
+func cmdTrust(args *docopt.Args, rabitDir, rabitRemote string) error {
+	repo, err := openRepo(rabitDir)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(args.String["<root.json>"])
+	if err != nil {
+		return err
+	}
+
+	return tuf.Trust(repo, data)
+}
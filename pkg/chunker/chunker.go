@@ -0,0 +1,80 @@
+// Package chunker finds content-defined chunk boundaries, so that an insert
+// or delete in the middle of a file only changes the chunks around it.
+package chunker
+
+import (
+	"fmt"
+
+	"github.com/burke/rabit/pkg/rollsum"
+)
+
+// Algorithm names, as recorded in a repository's configuration.
+const (
+	Rollsum = "rollsum"
+	FastCDC = "fastcdc"
+)
+
+// Params bound the size of the chunks a Chunker produces, and set the
+// average size it aims for. The rollsum chunker needs Avg-Min to be a power
+// of two, and FastCDC needs Avg to be.
+type Params struct {
+	Min, Avg, Max int
+}
+
+// A Chunker splits a stream into chunks one at a time.
+type Chunker interface {
+	// Next returns the length of the chunk at the start of data. Unless
+	// data runs to the end of the input, it must hold at least Max bytes.
+	// A chunker may keep state from one chunk to the next, so the chunks
+	// must be passed in order.
+	Next(data []byte) int
+}
+
+// New returns a Chunker for the named algorithm.
+func New(algorithm string, p Params) (Chunker, error) {
+	switch algorithm {
+	case Rollsum:
+		return NewRollsum(p), nil
+	case FastCDC:
+		return NewFastCDC(p), nil
+	default:
+		return nil, fmt.Errorf("unknown chunking algorithm %q", algorithm)
+	}
+}
+
+// log2 returns the number of bits needed to count to n.
+func log2(n int) uint {
+	var bits uint
+	for 1<<bits < n {
+		bits++
+	}
+	return bits
+}
+
+type rollsumChunker struct {
+	p  Params
+	rs *rollsum.RollSum
+}
+
+// NewRollsum returns a Chunker using bup's rolling checksum. A chunk is cut
+// at the first checksum boundary after Min bytes, or at Max bytes.
+// Boundaries fall every Avg-Min bytes on average, so chunks come out at
+// around Avg bytes.
+//
+// The checksum keeps rolling across chunk boundaries, exactly as it did
+// when this was the only algorithm, so existing repositories keep cutting
+// identical chunks.
+func NewRollsum(p Params) Chunker {
+	return &rollsumChunker{p: p, rs: rollsum.NewWithBits(log2(p.Avg - p.Min))}
+}
+
+func (c *rollsumChunker) Next(data []byte) int {
+	for i, b := range data {
+		size := i + 1
+		onRollSplit := c.rs.Roll(b)
+		if size == c.p.Max || onRollSplit && size > c.p.Min {
+			return size
+		}
+	}
+	return len(data)
+}
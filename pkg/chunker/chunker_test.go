@@ -0,0 +1,130 @@
+package chunker
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func randomData(seed int64, n int) []byte {
+	buf := make([]byte, n)
+	rnd := rand.New(rand.NewSource(seed))
+	rnd.Read(buf)
+	return buf
+}
+
+// split chunks data the way the repository does, handing the chunker at
+// most 2*Max bytes at a time.
+func split(c Chunker, max int, data []byte) []int {
+	var sizes []int
+	for len(data) > 0 {
+		window := data
+		if len(window) > 2*max {
+			window = window[:2*max]
+		}
+		n := c.Next(window)
+		sizes = append(sizes, n)
+		data = data[n:]
+	}
+	return sizes
+}
+
+func TestBounds(t *testing.T) {
+	data := randomData(1, 4<<20)
+	for _, algorithm := range []string{Rollsum, FastCDC} {
+		p := Params{Min: 4 << 10, Avg: 8 << 10, Max: 64 << 10}
+		c, err := New(algorithm, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes := split(c, p.Max, data)
+		total := 0
+		for i, n := range sizes {
+			total += n
+			if n > p.Max || n <= p.Min && i != len(sizes)-1 {
+				t.Errorf("%s: chunk %d is %d bytes, outside (%d, %d]", algorithm, i, n, p.Min, p.Max)
+			}
+		}
+		if total != len(data) {
+			t.Errorf("%s: chunks add up to %d bytes, not %d", algorithm, total, len(data))
+		}
+		if mean := total / len(sizes); mean < p.Avg/2 || mean > 2*p.Avg {
+			t.Errorf("%s: chunks are %d bytes on average, aiming for %d", algorithm, mean, p.Avg)
+		}
+	}
+}
+
+func TestFastCDCResyncs(t *testing.T) {
+	p := Params{Min: 2 << 10, Avg: 8 << 10, Max: 32 << 10}
+	data := randomData(2, 1<<20)
+	edited := append(append(append([]byte{}, data[:300<<10]...), "an insertion"...), data[300<<10:]...)
+
+	chunks := func(data []byte) map[string]bool {
+		seen := make(map[string]bool)
+		for _, n := range split(NewFastCDC(p), p.Max, data) {
+			seen[string(data[:n])] = true
+			data = data[n:]
+		}
+		return seen
+	}
+	before, after := chunks(data), chunks(edited)
+	changed := 0
+	for c := range after {
+		if !before[c] {
+			changed++
+		}
+	}
+	if changed == 0 || changed > 3 {
+		t.Errorf("a small insertion changed %d chunks", changed)
+	}
+}
+
+// The rollsum chunker must cut exactly where the byte-at-a-time loop it
+// replaced did, or existing repositories would stop deduplicating.
+func TestRollsumMatchesStream(t *testing.T) {
+	p := Params{Min: 1 << 10, Avg: 2 << 10, Max: 16 << 10}
+	data := randomData(3, 1<<20)
+
+	var want []int
+	rs := NewRollsum(p).(*rollsumChunker).rs
+	size := 0
+	for _, b := range data {
+		size++
+		if rs.Roll(b) && size > p.Min || size == p.Max {
+			want = append(want, size)
+			size = 0
+		}
+	}
+	if size > 0 {
+		want = append(want, size)
+	}
+
+	got := split(NewRollsum(p), p.Max, data)
+	if len(got) != len(want) {
+		t.Fatalf("got %d chunks, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("chunk %d is %d bytes, want %d", i, got[i], want[i])
+		}
+	}
+}
+
+func TestUnknownAlgorithm(t *testing.T) {
+	if _, err := New("nope", Params{Min: 1, Avg: 64, Max: 128}); err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+}
+
+func benchmark(b *testing.B, algorithm string) {
+	p := Params{Min: 16 << 10, Avg: 64 << 10, Max: 512 << 10}
+	data := randomData(4, 8<<20)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c, _ := New(algorithm, p)
+		split(c, p.Max, data)
+	}
+}
+
+func BenchmarkRollsum(b *testing.B) { benchmark(b, Rollsum) }
+func BenchmarkFastCDC(b *testing.B) { benchmark(b, FastCDC) }
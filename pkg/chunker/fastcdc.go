@@ -0,0 +1,78 @@
+package chunker
+
+// fastCDC implements FastCDC (Xia et al., USENIX ATC '16): a gear hash,
+// which needs one shift, one add and one table lookup per byte, with
+// normalized chunking to pull chunk sizes in towards Avg.
+type fastCDC struct {
+	p            Params
+	maskS, maskL uint64
+}
+
+// NewFastCDC returns a Chunker using FastCDC. Boundaries before Min bytes
+// are skipped entirely. Up to Avg bytes, a boundary needs two more hash
+// bits to match than it would on average; after that, two fewer. Chunks
+// therefore cluster around Avg bytes, and are always cut at Max.
+func NewFastCDC(p Params) Chunker {
+	bits := log2(p.Avg)
+	return &fastCDC{
+		p:     p,
+		maskS: topBits(bits + 2),
+		maskL: topBits(bits - 2),
+	}
+}
+
+// topBits returns a mask of the n most significant bits. The gear hash
+// shifts left, so its top bits depend on the most bytes: the last 64.
+func topBits(n uint) uint64 {
+	if n == 0 {
+		return 0
+	}
+	return ^uint64(0) << (64 - n)
+}
+
+func (c *fastCDC) Next(data []byte) int {
+	n := len(data)
+	if n <= c.p.Min {
+		return n
+	}
+	if n > c.p.Max {
+		n = c.p.Max
+	}
+	normal := c.p.Avg
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.p.Min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// gear maps each byte to a random 64-bit value. It is generated from a
+// fixed seed: changing it would change every chunk boundary, and with them
+// every chunk hash in existing repositories.
+var gear [256]uint64
+
+func init() {
+	// splitmix64
+	x := uint64(0x7261626974676561) // "rabitgea"
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
@@ -0,0 +1,65 @@
+// Package digest names the hash functions a repository can address its
+// chunks by.
+//
+// Chunk and manifest names are always the lowercase hex digest, with no
+// indication of the function that produced them; which one applies is a
+// property of the whole repository, recorded in its configuration.
+package digest
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+
+	"github.com/burke/rabit/Godeps/_workspace/src/golang.org/x/crypto/blake2b"
+)
+
+// Algorithm names, as recorded in a repository's configuration.
+const (
+	// SHA1 is what every repository used before the choice was offered.
+	SHA1    = "sha1"
+	SHA256  = "sha256"
+	BLAKE2b = "blake2b"
+)
+
+// Algorithms lists the supported algorithms, preferred first.
+var Algorithms = []string{SHA256, BLAKE2b, SHA1}
+
+// New returns a constructor for the named hash function.
+func New(algorithm string) (func() hash.Hash, error) {
+	switch algorithm {
+	case SHA1:
+		return sha1.New, nil
+	case SHA256:
+		return sha256.New, nil
+	case BLAKE2b:
+		return newBLAKE2b256, nil
+	default:
+		return nil, fmt.Errorf("unknown hash algorithm %q", algorithm)
+	}
+}
+
+// newBLAKE2b256 returns an unkeyed BLAKE2b hash with a 256-bit digest. It
+// is considerably faster than SHA-256 on 64-bit machines without SHA
+// extensions.
+func newBLAKE2b256() hash.Hash {
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		panic(err) // only a key that is too long can fail
+	}
+	return h
+}
+
+// Sum returns the hex digest of data under the named algorithm, which must
+// be one New accepts.
+func Sum(algorithm string, data []byte) string {
+	newHash, err := New(algorithm)
+	if err != nil {
+		panic(err)
+	}
+	h := newHash()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
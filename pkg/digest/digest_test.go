@@ -0,0 +1,71 @@
+package digest
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestSum(t *testing.T) {
+	var long []byte
+	for i := 0; i < 5; i++ {
+		for b := 0; b < 256; b++ {
+			long = append(long, byte(b))
+		}
+	}
+
+	for _, tc := range []struct {
+		algorithm string
+		data      []byte
+		want      string
+	}{
+		{SHA1, []byte("abc"), "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{SHA256, []byte("abc"), "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{BLAKE2b, []byte("abc"), "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"},
+		{BLAKE2b, nil, "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"},
+		{BLAKE2b, long, "82628cbfc9689e234b0923a531f4578fe2e7138a03e2f81ed6cde97517336650"},
+	} {
+		if got := Sum(tc.algorithm, tc.data); got != tc.want {
+			t.Errorf("%s(%d bytes) = %s, want %s", tc.algorithm, len(tc.data), got, tc.want)
+		}
+	}
+}
+
+// Writing in pieces, including a piece ending exactly on a block boundary,
+// must give the same digest as writing everything at once.
+func TestBLAKE2bIncremental(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	want := Sum(BLAKE2b, data)
+	newHash, _ := New(BLAKE2b)
+	for _, pieces := range [][]int{{128, 872}, {1, 127, 128, 744}, {500, 0, 500}} {
+		h := newHash()
+		off := 0
+		for _, n := range pieces {
+			h.Write(data[off : off+n])
+			off += n
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != want {
+			t.Errorf("pieces %v: got %s, want %s", pieces, got, want)
+		}
+	}
+}
+
+func TestUnknown(t *testing.T) {
+	if _, err := New("md5"); err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+}
+
+func benchmark(b *testing.B, algorithm string) {
+	data := make([]byte, 64<<10)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		Sum(algorithm, data)
+	}
+}
+
+func BenchmarkSHA1(b *testing.B)    { benchmark(b, SHA1) }
+func BenchmarkSHA256(b *testing.B)  { benchmark(b, SHA256) }
+func BenchmarkBLAKE2b(b *testing.B) { benchmark(b, BLAKE2b) }
@@ -0,0 +1,238 @@
+// Package remote implements the client side of the rabit HTTP protocol.
+//
+// A rabit remote exposes a repository over plain HTTP:
+//
+//	GET  /manifests         newline-separated list of manifest names
+//	GET  /manifests/<name>  the manifest for <name>
+//	PUT  /manifests/<name>  publish a manifest
+//	HEAD /chunks/<hash>     200 if the chunk is present, 404 otherwise
+//	GET  /chunks/<hash>     the contents of a chunk
+//	PUT  /chunks/<hash>     upload a chunk
+//	GET  /metadata/<file>   signed TUF metadata (see package tuf)
+//	PUT  /metadata/<file>   publish signed metadata
+//	POST /chunks/have       newline-separated hashes in; for each one the
+//	                        server already has, a "<hash> <size>" line out
+//	GET  /naming            how the repository names chunks; see
+//	                        repo.Config.ChunkNaming
+//
+// An encrypted repository is served sealed, so that the server needs no
+// key: chunks are exchanged as they are stored, and a name's manifest is
+// its whole history, sealed by the client that last pushed to it.
+//
+// Uploads (the PUT requests) carry the client's token as a bearer token in
+// the Authorization header.
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/burke/rabit/pkg/repo"
+)
+
+// Client talks to a single rabit remote.
+type Client struct {
+	url   string
+	token string
+	http  *http.Client
+}
+
+// New returns a Client for the remote rooted at url. token authorizes
+// uploads and may be empty for read-only use.
+func New(url, token string) *Client {
+	return &Client{
+		url:   strings.TrimRight(url, "/"),
+		token: token,
+		http:  http.DefaultClient,
+	}
+}
+
+func (c *Client) manifestURL(name string) string {
+	return c.url + "/manifests/" + url.PathEscape(name)
+}
+
+func (c *Client) chunkURL(hash string) string {
+	return c.url + "/chunks/" + hash
+}
+
+func (c *Client) do(method, u string, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, u, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// GetChunk downloads the contents of a single chunk.
+func (c *Client) GetChunk(hash string) ([]byte, error) {
+	return c.get(c.chunkURL(hash))
+}
+
+// PutChunk uploads the contents of a single chunk.
+func (c *Client) PutChunk(hash string, data []byte) error {
+	resp, err := c.do("PUT", c.chunkURL(hash), data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// GetManifest downloads the manifest published under name.
+func (c *Client) GetManifest(name string) (*repo.Manifest, error) {
+	data, err := c.get(c.manifestURL(name))
+	if err != nil {
+		return nil, err
+	}
+	return repo.ParseManifest(data)
+}
+
+// GetMetadata downloads a signed metadata file.
+func (c *Client) GetMetadata(name string) ([]byte, error) {
+	return c.get(c.url + "/metadata/" + url.PathEscape(name))
+}
+
+// PutMetadata publishes a signed metadata file.
+func (c *Client) PutMetadata(name string, data []byte) error {
+	resp, err := c.do("PUT", c.url+"/metadata/"+url.PathEscape(name), data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) get(u string) ([]byte, error) {
+	resp, err := c.do("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// ChunkNaming asks the remote how it names chunks.
+func (c *Client) ChunkNaming() (string, error) {
+	resp, err := c.http.Get(c.url + "/naming")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s/naming: %s", c.url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return strings.TrimSpace(string(data)), err
+}
+
+// GetSealedManifest downloads the history of name from an encrypted
+// remote, sealed as it is stored. It returns nil if there is none.
+func (c *Client) GetSealedManifest(name string) ([]byte, error) {
+	resp, err := c.http.Get(c.manifestURL(name))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", c.manifestURL(name), resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// PutSealedManifest replaces the history of name on an encrypted remote
+// with data, sealed; see repo.Repo.SealVersion.
+func (c *Client) PutSealedManifest(name string, data []byte) error {
+	resp, err := c.do("PUT", c.manifestURL(name), data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// PutManifest publishes m under name. It should only be called once every
+// chunk m refers to has been uploaded.
+func (c *Client) PutManifest(name string, m *repo.Manifest) error {
+	resp, err := c.do("PUT", c.manifestURL(name), []byte(m.String()))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ListManifests returns the names of every manifest the remote publishes.
+func (c *Client) ListManifests() ([]string, error) {
+	resp, err := c.do("GET", c.url+"/manifests", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var names []string
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			names = append(names, line)
+		}
+	}
+	return names, s.Err()
+}
+
+// HaveChunks asks the remote which of hashes it already stores. The result
+// maps each hash the remote has to the size of that chunk.
+func (c *Client) HaveChunks(hashes []string) (map[string]int64, error) {
+	body := []byte(strings.Join(hashes, "\n") + "\n")
+	resp, err := c.do("POST", c.url+"/chunks/have", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return readSizes(resp.Body)
+}
+
+func readSizes(r io.Reader) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed chunk list line %q", s.Text())
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed chunk list line %q", s.Text())
+		}
+		sizes[fields[0]] = size
+	}
+	return sizes, s.Err()
+}
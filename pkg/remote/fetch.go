@@ -0,0 +1,99 @@
+package remote
+
+import (
+	"github.com/burke/rabit/pkg/repo"
+	"github.com/burke/rabit/pkg/tuf"
+)
+
+// Fetch downloads the file called name from the remote into r. Chunks
+// already present in r are not transferred. Each chunk is checked against
+// its hash as it is stored, and the manifest is written only once every
+// chunk has arrived, so an interrupted fetch never leaves a name pointing
+// at missing data.
+//
+// If r has a pinned TUF root, the manifest must also be a target in the
+// remote's signed metadata; see tuf.Update.
+func Fetch(r repo.Repo, c *Client, name string) error {
+	unlock, err := r.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	sealed, err := checkNaming(r, c)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if sealed {
+		data, err = sealedManifest(r, c, name)
+	} else {
+		data, err = c.get(c.manifestURL(name))
+	}
+	if err != nil {
+		return err
+	}
+
+	targets, err := tuf.Update(r, c.GetMetadata)
+	switch err {
+	case nil:
+		if err := targets.VerifyTarget(name, data); err != nil {
+			return err
+		}
+	case tuf.ErrNoRoot:
+		// Unsigned fetch.
+	default:
+		return err
+	}
+
+	manifest, err := repo.ParseManifest(data)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, h := range uniq(manifest.Chunks) {
+		ok, err := r.HasChunk(h)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			missing = append(missing, h)
+		}
+	}
+
+	err = parallel(missing, func(hash string) error {
+		data, err := c.GetChunk(hash)
+		if err != nil {
+			return err
+		}
+		if sealed {
+			return r.WriteStoredChunk(hash, data)
+		}
+		return r.WriteChunk(hash, data)
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.WriteManifest(name, manifest)
+}
+
+// sealedManifest returns the latest manifest of name on an encrypted
+// remote, which only r can open.
+func sealedManifest(r repo.Repo, c *Client, name string) ([]byte, error) {
+	stored, err := c.get(c.manifestURL(name))
+	if err != nil {
+		return nil, err
+	}
+	versions, err := r.OpenHistory(name, stored)
+	if err != nil {
+		return nil, err
+	}
+	id := versions[len(versions)-1].ID
+	sealed, err := c.GetChunk(id)
+	if err != nil {
+		return nil, err
+	}
+	return r.OpenChunk(id, sealed)
+}
@@ -0,0 +1,127 @@
+package remote
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestFetchDownloadsOnlyMissingChunks(t *testing.T) {
+	src, cleanupSrc := newTestRepo(t)
+	defer cleanupSrc()
+	dst, cleanupDst := newTestRepo(t)
+	defer cleanupDst()
+
+	addFile(t, src, "../repo/testfiles/blob1", "blob1")
+	addFile(t, src, "../repo/testfiles/blob2", "blob2")
+
+	fake := newFakeRemote()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	client := New(srv.URL, "")
+
+	for _, name := range []string{"blob1", "blob2"} {
+		if err := Push(src, client, name); err != nil {
+			t.Fatal("push", err)
+		}
+	}
+
+	if err := Fetch(dst, client, "blob1"); err != nil {
+		t.Fatal("fetch blob1", err)
+	}
+	if len(fake.gets) != 3 {
+		t.Fatalf("expected 3 chunk downloads, got %d", len(fake.gets))
+	}
+
+	fake.gets = nil
+	if err := Fetch(dst, client, "blob2"); err != nil {
+		t.Fatal("fetch blob2", err)
+	}
+	if len(fake.gets) != 2 {
+		t.Fatalf("expected 2 chunk downloads, got %d", len(fake.gets))
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := dst.CatFile("blob2", buf); err != nil {
+		t.Fatal("cat", err)
+	}
+	expected, _ := ioutil.ReadFile("../repo/testfiles/blob2")
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Error("fetched file doesn't match")
+	}
+}
+
+func TestFetchRejectsCorruptChunk(t *testing.T) {
+	src, cleanupSrc := newTestRepo(t)
+	defer cleanupSrc()
+	dst, cleanupDst := newTestRepo(t)
+	defer cleanupDst()
+
+	addFile(t, src, "../repo/testfiles/blob1", "blob1")
+
+	fake := newFakeRemote()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	client := New(srv.URL, "")
+
+	if err := Push(src, client, "blob1"); err != nil {
+		t.Fatal("push", err)
+	}
+	m, _ := src.LoadManifest("blob1")
+	fake.chunks[m.Chunks[1]] = []byte("not what you asked for")
+
+	if err := Fetch(dst, client, "blob1"); err == nil {
+		t.Fatal("expected fetch of corrupt chunk to fail")
+	}
+	if names, _ := dst.LsFiles("", true); len(names) != 0 {
+		t.Error("manifest written despite failed fetch")
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	src, cleanupSrc := newTestRepo(t)
+	defer cleanupSrc()
+	dst, cleanupDst := newTestRepo(t)
+	defer cleanupDst()
+
+	addFile(t, src, "../repo/testfiles/blob1", "blob1")
+	addFile(t, src, "../repo/testfiles/blob2", "blob2")
+
+	fake := newFakeRemote()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	client := New(srv.URL, "")
+
+	for _, name := range []string{"blob1", "blob2"} {
+		if err := Push(src, client, name); err != nil {
+			t.Fatal("push", err)
+		}
+	}
+	if err := Fetch(dst, client, "blob1"); err != nil {
+		t.Fatal("fetch", err)
+	}
+
+	names, err := client.ListManifests()
+	if err != nil {
+		t.Fatal("list", err)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"blob1", "blob2"}) {
+		t.Fatalf("unexpected listing %v", names)
+	}
+
+	info, err := Describe(client, dst, "blob2")
+	if err != nil {
+		t.Fatal("describe", err)
+	}
+	expected, _ := ioutil.ReadFile("../repo/testfiles/blob2")
+	if info.Size != int64(len(expected)) {
+		t.Errorf("expected size %d, got %d", len(expected), info.Size)
+	}
+	if info.Chunks != 3 || info.Local != 1 {
+		t.Errorf("expected 3 chunks with 1 local, got %d with %d", info.Chunks, info.Local)
+	}
+}
@@ -0,0 +1,75 @@
+package remote
+
+import (
+	"fmt"
+
+	"github.com/burke/rabit/pkg/repo"
+)
+
+// FileInfo summarizes a file published by a remote.
+type FileInfo struct {
+	Name   string
+	Size   int64 // total size of the file
+	Chunks int   // number of distinct chunks in the file
+	Local  int   // how many of those chunks are already in the local repo
+}
+
+// Describe fetches the manifest for name and reports its size and chunk
+// count. If r is non-nil, it also counts how many of the chunks r already
+// has, which is how many a Fetch would skip. An encrypted remote's
+// manifests can only be read with r, a copy of it.
+func Describe(c *Client, r repo.Repo, name string) (*FileInfo, error) {
+	sealed := false
+	if r != nil {
+		var err error
+		if sealed, err = checkNaming(r, c); err != nil {
+			return nil, err
+		}
+	}
+	var manifest *repo.Manifest
+	if sealed {
+		data, err := sealedManifest(r, c, name)
+		if err != nil {
+			return nil, err
+		}
+		if manifest, err = repo.ParseManifest(data); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if manifest, err = c.GetManifest(name); err != nil {
+			return nil, err
+		}
+	}
+
+	hashes := uniq(manifest.Chunks)
+	info := &FileInfo{Name: name, Chunks: len(hashes), Size: manifest.Size}
+	if manifest.Sizes == nil {
+		// An old manifest, without chunk sizes; ask the remote for them.
+		sizes, err := c.HaveChunks(hashes)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range manifest.Chunks {
+			size, ok := sizes[h]
+			if !ok {
+				return nil, fmt.Errorf("%s: remote is missing chunk %s", name, h)
+			}
+			info.Size += size
+		}
+	}
+
+	if r != nil {
+		for _, h := range hashes {
+			ok, err := r.HasChunk(h)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				info.Local++
+			}
+		}
+	}
+
+	return info, nil
+}
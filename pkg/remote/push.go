@@ -0,0 +1,186 @@
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/burke/rabit/pkg/repo"
+	"github.com/burke/rabit/pkg/tuf"
+)
+
+// chunksInFlight bounds the number of concurrent chunk transfers.
+const chunksInFlight = 16
+
+// Push uploads the file called name from r to the remote. Only chunks the
+// remote does not already have are sent, and the manifest is published
+// after them so the remote never refers to a chunk it doesn't have. If r
+// has signed TUF metadata, it is published last.
+//
+// An encrypted repository pushes sealed: see repo.Repo.SealVersion. Two
+// pushes of the same name at once may then lose one of the versions.
+func Push(r repo.Repo, c *Client, name string) error {
+	sealed, err := checkNaming(r, c)
+	if err != nil {
+		return err
+	}
+	id, err := r.Resolve(name)
+	if err != nil {
+		return err
+	}
+	manifest, err := r.LoadManifest(id)
+	if err != nil {
+		return err
+	}
+
+	hashes := uniq(manifest.Chunks)
+	if sealed {
+		// The remote can't read the manifest, so the history points at it
+		// as a chunk.
+		hashes = uniq(append(hashes, id))
+	}
+	have, err := c.HaveChunks(hashes)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, h := range hashes {
+		if _, ok := have[h]; !ok {
+			missing = append(missing, h)
+		}
+	}
+
+	err = parallel(missing, func(hash string) error {
+		var data []byte
+		var err error
+		if sealed {
+			data, err = r.ReadStoredChunk(hash)
+		} else {
+			data, err = r.ReadChunk(hash)
+		}
+		if err != nil {
+			return err
+		}
+		return c.PutChunk(hash, data)
+	})
+	if err != nil {
+		return err
+	}
+
+	if sealed {
+		err = pushSealedManifest(r, c, name, id)
+	} else {
+		err = c.PutManifest(name, manifest)
+	}
+	if err != nil {
+		return err
+	}
+
+	return pushMetadata(r, c)
+}
+
+// pushSealedManifest adds the manifest id to the history of name on an
+// encrypted remote, which only r can open.
+func pushSealedManifest(r repo.Repo, c *Client, name, id string) error {
+	remote, err := c.GetSealedManifest(name)
+	if err != nil {
+		return err
+	}
+	stored, err := r.SealVersion(name, remote, id)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(stored, remote) {
+		return nil
+	}
+	return c.PutSealedManifest(name, stored)
+}
+
+// checkNaming refuses a remote that names chunks differently from r: none
+// of its chunks could be matched with r's, or checked against their names.
+// An encrypted repository names chunks by a key of its own, which the
+// naming fingerprints along with the rest of its encryption config, so it
+// can only exchange files with a server for the same repository, or a copy
+// of it. It reports whether the exchange is sealed, as an encrypted
+// repository's is.
+func checkNaming(r repo.Repo, c *Client) (bool, error) {
+	cfg, err := r.Config()
+	if err != nil {
+		return false, err
+	}
+	naming, err := c.ChunkNaming()
+	if err != nil {
+		return false, err
+	}
+	if naming != cfg.ChunkNaming() {
+		return false, fmt.Errorf("remote names chunks by %s, and this repository by %s; an encrypted repository can only push to or fetch from a server for itself or a copy of it", naming, cfg.ChunkNaming())
+	}
+	return cfg.Encryption != nil, nil
+}
+
+// pushMetadata publishes r's TUF metadata in role order, so that the
+// timestamp, which clients read first, is replaced last.
+func pushMetadata(r repo.Repo, c *Client) error {
+	for _, role := range tuf.Roles {
+		data, err := r.LoadMetadata(tuf.Filename(role))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := c.PutMetadata(tuf.Filename(role), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parallel calls f for every hash, at most chunksInFlight at a time, and
+// returns the first error encountered. After an error it starts no more
+// calls, but waits for those running to finish before returning.
+func parallel(hashes []string, f func(string) error) error {
+	gate := make(chan struct{}, chunksInFlight)
+	firsterrc := make(chan error, 1)
+
+	for _, h := range hashes {
+		if len(firsterrc) > 0 {
+			break
+		}
+		gate <- struct{}{}
+		go func(h string) {
+			defer func() { <-gate }()
+			if err := f(h); err != nil {
+				select {
+				case firsterrc <- err:
+				default:
+				}
+			}
+		}(h)
+	}
+
+	// Once we own every token, nothing is left running.
+	for i := 0; i < chunksInFlight; i++ {
+		gate <- struct{}{}
+	}
+	select {
+	case err := <-firsterrc:
+		return err
+	default:
+	}
+	return nil
+}
+
+func uniq(hashes []string) []string {
+	seen := make(map[string]struct{}, len(hashes))
+	var out []string
+	for _, h := range hashes {
+		if _, ok := seen[h]; ok {
+			continue
+		}
+		seen[h] = struct{}{}
+		out = append(out, h)
+	}
+	return out
+}
@@ -0,0 +1,162 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/burke/rabit/pkg/repo"
+)
+
+// fakeRemote is just enough of a rabit server to exercise the client.
+type fakeRemote struct {
+	mu        sync.Mutex
+	chunks    map[string][]byte
+	manifests map[string][]byte
+	puts      []string
+	gets      []string
+}
+
+func newFakeRemote() *fakeRemote {
+	return &fakeRemote{chunks: map[string][]byte{}, manifests: map[string][]byte{}}
+}
+
+func (f *fakeRemote) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/chunks/have":
+		for _, h := range strings.Fields(string(body)) {
+			if data, ok := f.chunks[h]; ok {
+				fmt.Fprintf(w, "%s %d\n", h, len(data))
+			}
+		}
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/chunks/"):
+		h := strings.TrimPrefix(r.URL.Path, "/chunks/")
+		f.chunks[h] = body
+		f.puts = append(f.puts, h)
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/chunks/"):
+		h := strings.TrimPrefix(r.URL.Path, "/chunks/")
+		data, ok := f.chunks[h]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		f.gets = append(f.gets, h)
+		w.Write(data)
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/manifests/"):
+		f.manifests[strings.TrimPrefix(r.URL.Path, "/manifests/")] = body
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/manifests/"):
+		data, ok := f.manifests[strings.TrimPrefix(r.URL.Path, "/manifests/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	case r.Method == "GET" && r.URL.Path == "/naming":
+		fmt.Fprintln(w, repo.DefaultConfig().ChunkNaming())
+	case r.Method == "GET" && r.URL.Path == "/manifests":
+		for name := range f.manifests {
+			fmt.Fprintln(w, name)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestRepo(t *testing.T) (repo.Repo, func()) {
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	r := repo.New(dir)
+	if err := r.Init(nil); err != nil {
+		t.Fatal("init")
+	}
+	return r, func() { os.RemoveAll(dir) }
+}
+
+func addFile(t *testing.T, r repo.Repo, path, name string) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal("open", path)
+	}
+	defer f.Close()
+	if err := r.Add(f, name); err != nil {
+		t.Fatal("repo add", err)
+	}
+}
+
+func TestPushSkipsChunksRemoteHas(t *testing.T) {
+	r, cleanup := newTestRepo(t)
+	defer cleanup()
+
+	addFile(t, r, "../repo/testfiles/blob1", "blob1")
+	addFile(t, r, "../repo/testfiles/blob2", "blob2")
+
+	fake := newFakeRemote()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	client := New(srv.URL, "")
+
+	if err := Push(r, client, "blob1"); err != nil {
+		t.Fatal("push blob1", err)
+	}
+	if len(fake.puts) != 3 {
+		t.Fatalf("expected 3 chunk uploads, got %d", len(fake.puts))
+	}
+
+	fake.puts = nil
+	if err := Push(r, client, "blob2"); err != nil {
+		t.Fatal("push blob2", err)
+	}
+	// blob2 shares its first chunk with blob1.
+	if len(fake.puts) != 2 {
+		t.Fatalf("expected 2 chunk uploads, got %d", len(fake.puts))
+	}
+
+	m, err := r.LoadManifest("blob2")
+	if err != nil {
+		t.Fatal("load manifest")
+	}
+	if string(fake.manifests["blob2"]) != m.String() {
+		t.Error("remote manifest doesn't match local")
+	}
+	for _, h := range m.Chunks {
+		data, err := r.ReadChunk(h)
+		if err != nil {
+			t.Fatal("read chunk")
+		}
+		if string(fake.chunks[h]) != string(data) {
+			t.Errorf("remote chunk %s doesn't match local", h)
+		}
+	}
+}
+
+func TestParallelWaits(t *testing.T) {
+	var running int32
+	failed := errors.New("failed")
+	hashes := make([]string, 100)
+	err := parallel(hashes, func(string) error {
+		atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		time.Sleep(time.Millisecond)
+		return failed
+	})
+	if err != failed {
+		t.Errorf("parallel returned %v", err)
+	}
+	if n := atomic.LoadInt32(&running); n != 0 {
+		t.Errorf("%d calls still running after parallel returned", n)
+	}
+}
@@ -2,8 +2,12 @@ package repo
 
 import (
 	"bufio"
+	"fmt"
+	"hash"
 	"io"
-	"io/ioutil"
+	"strings"
+
+	"github.com/burke/rabit/pkg/digest"
 )
 
 type fileContentsOptionPromise struct {
@@ -12,26 +16,66 @@ type fileContentsOptionPromise struct {
 	resolved chan struct{}
 }
 
+// CatOptions controls CatFileWithOptions.
+type CatOptions struct {
+	// NoVerify skips checking each chunk against its hash, and the file
+	// against the digest its manifest records.
+	NoVerify bool
+}
+
+// CatFile writes the contents of the named file to w, checking each chunk
+// against its hash and, if the manifest records one, the whole file
+// against its digest. Since chunks are written as they are checked, w may
+// already have been given corrupt data when an error is returned.
 func (c *repo) CatFile(name string, w io.Writer) error {
-	manifest, err := c.loadManifest(name)
+	return c.CatFileWithOptions(name, w, nil)
+}
+
+// CatFileWithOptions is CatFile, as modified by opts if it isn't nil.
+func (c *repo) CatFileWithOptions(name string, w io.Writer, opts *CatOptions) error {
+	unlock, err := c.readLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cfg, err := c.Config()
+	if err != nil {
+		return err
+	}
+	manifest, err := c.LoadManifest(name)
 	if err != nil {
 		return err
 	}
+	verify := opts == nil || !opts.NoVerify
+
+	var whole hash.Hash
+	var wantDigest string
+	if verify && manifest.Digest != "" {
+		if whole, wantDigest, err = digestHash(manifest.Digest); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
 
 	// read up to 32 files in parallel.
 	// This brings cat time for a 5GB file from 32s to 9s on my machine.
 	files := make(chan *fileContentsOptionPromise, 32)
+	done := make(chan struct{})
+	defer close(done)
 
 	go func() {
 		defer close(files)
 
-		for _, ch := range manifest.chunks {
-			cpath := c.ChunkPath(ch)
+		for i, ch := range manifest.Chunks {
+			i, ch := i, ch
 
 			// when we have either data or an error, we resolve the promise
 			of := fileContentsOptionPromise{resolved: make(chan struct{})}
 			go func(of *fileContentsOptionPromise) {
-				f, err := ioutil.ReadFile(cpath)
+				f, err := c.ReadChunk(ch)
+				if err == nil && verify {
+					err = checkChunk(cfg, manifest, i, f)
+				}
 				if err != nil {
 					of.err = err
 				} else {
@@ -40,7 +84,11 @@ func (c *repo) CatFile(name string, w io.Writer) error {
 				close(of.resolved)
 			}(&of)
 
-			files <- &of
+			select {
+			case files <- &of:
+			case <-done:
+				return
+			}
 		}
 	}()
 
@@ -49,12 +97,49 @@ func (c *repo) CatFile(name string, w io.Writer) error {
 	for file := range files {
 		<-file.resolved // wait until the promise has resolved to a value.
 		if file.err != nil {
+			return file.err
+		}
+		if _, err := wb.Write(file.data); err != nil {
 			return err
 		}
-		wb.Write(file.data)
+		if whole != nil {
+			whole.Write(file.data)
+		}
 	}
 
-	wb.Flush()
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+	if whole != nil {
+		if got := fmt.Sprintf("%x", whole.Sum(nil)); got != wantDigest {
+			return fmt.Errorf("%s is corrupt: its contents hash to %s, not %s", name, got, wantDigest)
+		}
+	}
+	return nil
+}
 
+// checkChunk checks that data, read as chunk i of m, is what m says.
+func checkChunk(cfg *Config, m *Manifest, i int, data []byte) error {
+	h := m.Chunks[i]
+	if actual := cfg.sum(data); actual != h {
+		return fmt.Errorf("chunk %s is corrupt: its contents hash to %s", h, actual)
+	}
+	if m.Sizes != nil && int64(len(data)) != m.Sizes[i] {
+		return fmt.Errorf("chunk %s is %d bytes, not the %d its manifest says", h, len(data), m.Sizes[i])
+	}
 	return nil
 }
+
+// digestHash returns a hash to check a file against a manifest's
+// "<hash>:<hex>" digest, and the hex it should come to.
+func digestHash(d string) (hash.Hash, string, error) {
+	i := strings.Index(d, ":")
+	if i < 0 {
+		return nil, "", fmt.Errorf("malformed digest %q", d)
+	}
+	newHash, err := digest.New(d[:i])
+	if err != nil {
+		return nil, "", err
+	}
+	return newHash(), d[i+1:], nil
+}
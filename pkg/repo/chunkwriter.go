@@ -18,97 +18,85 @@ limitations under the License.
 */
 
 import (
-	"bufio"
-	"bytes"
-	"crypto/sha1"
 	"encoding/hex"
+	"hash"
 	"io"
-	"io/ioutil"
-	"os"
-	"path"
 
-	"github.com/burke/rabit/pkg/rollsum"
+	"github.com/burke/rabit/pkg/digest"
 )
 
-const (
-	// maxBlobSize is the largest blob we ever make when cutting up
-	// a file.
-	maxBlobSize = 1 << 20
-
-	// bufioReaderSize is an explicit size for our bufio.Reader,
-	// so we don't rely on NewReader's implicit size.
-	// We care about the buffer size because it affects how far
-	// in advance we can detect EOF from an io.Reader that doesn't
-	// know its size.  Detecting an EOF bufioReaderSize bytes early
-	// means we can plan for the final chunk.
-	bufioReaderSize = 32 << 10
-
-	// tooSmallThreshold is the threshold at which rolling checksum
-	// boundaries are ignored if the current chunk being built is
-	// smaller than this.
-	tooSmallThreshold = 64 << 10
-)
-
-// noteEOFReader keeps track of when it's seen EOF, but otherwise
-// delegates entirely to r.
-type noteEOFReader struct {
-	r      io.Reader
-	sawEOF bool
-}
-
-func (r *noteEOFReader) Read(p []byte) (n int, err error) {
-	n, err = r.r.Read(p)
-	if err == io.EOF {
-		r.sawEOF = true
-	}
-	return
-}
-
 type span struct {
-	br string
-}
-
-func sha1FromString(s string) string {
-	s1 := sha1.New()
-	s1.Write([]byte(s))
-	return hex.EncodeToString(s1.Sum(nil))
+	br   string
+	size int64
 }
 
-func uploadString(repo Repo, br, chunk string) error {
-	pth := repo.ChunkPath(br)
-	_ = os.Mkdir(path.Dir(pth), 0755)
-	return ioutil.WriteFile(pth, []byte(chunk), 0660)
+func uploadChunk(put func(hash string, stored []byte) error, cfg *Config, br string, chunk []byte) error {
+	stored, err := cfg.encodeChunk(br, chunk)
+	if err != nil {
+		return err
+	}
+	return put(br, stored)
 }
 
 type chunkWriter struct {
-	path  string
 	r     io.Reader
-	spans []span
+	cfg   *Config
+	spans []*span
+
+	whole hash.Hash // of the whole file
 }
 
-func newChunkWriter(cspath string, r io.Reader) *chunkWriter {
-	return &chunkWriter{path: cspath, r: r}
+func newChunkWriter(r io.Reader, cfg *Config) *chunkWriter {
+	return &chunkWriter{r: r, cfg: cfg}
 }
 
-func (w *chunkWriter) writeChunks(repo Repo) ([]span, error) {
+// writeChunks chunks everything w reads, and uploads the chunks with put.
+// Chunks are hashed and uploaded in parallel, each by a goroutine filling in
+// its own span, so the spans are held by pointer: appending to w.spans
+// moves only the pointers.
+func (w *chunkWriter) writeChunks(put func(hash string, stored []byte) error) ([]*span, error) {
 	var outerr error
-	src := &noteEOFReader{r: w.r}
-	bufr := bufio.NewReaderSize(src, bufioReaderSize)
-	w.spans = []span{} // the tree of spans, cut on interesting rollsum boundaries
-	rs := rollsum.New()
-	var buf bytes.Buffer
-	blobSize := 0 // of the next blob being built, should be same as buf.Len()
+	w.spans = []*span{} // the tree of spans, cut on interesting chunker boundaries
+	ch, err := w.cfg.newChunker()
+	if err != nil {
+		return nil, err
+	}
+	newHash, err := digest.New(w.cfg.Hash)
+	if err != nil {
+		return nil, err
+	}
+	w.whole = newHash()
+
+	// The chunker needs to see a whole maximum-sized chunk at a time, so
+	// we keep up to two in buf and top it up whenever less than one is left.
+	max := w.cfg.MaxChunkSize
+	buf := make([]byte, 2*max)
+	start, end := 0, 0
+	sawEOF := false
 
 	const chunksInFlight = 32 // at ~64 KB chunks, this is ~2MB memory per file
 	gate := make(chan struct{}, chunksInFlight)
 	firsterrc := make(chan error, 1)
 
+	// wait waits for all uploads to finish, one way or another, and then
+	// returns the first error any of them had. Once it has filled gate, we
+	// own all the tokens, so nobody else can have one outstanding.
+	wait := func() error {
+		for i := 0; i < chunksInFlight; i++ {
+			gate <- struct{}{}
+		}
+		select {
+		case err := <-firsterrc:
+			return err
+		default:
+			return nil
+		}
+	}
+
 	// uploadLastSpan runs in the same goroutine as the loop below and is responsible for
-	// starting uploading the contents of the buf.  It returns false if there's been
+	// starting uploading chunk.  It returns false if there's been
 	// an error and the loop below should be stopped.
-	uploadLastSpan := func() bool {
-		chunk := buf.String()
-		buf.Reset()
+	uploadLastSpan := func(chunk []byte) bool {
 		select {
 		case outerr = <-firsterrc:
 			return false
@@ -116,12 +104,12 @@ func (w *chunkWriter) writeChunks(repo Repo) ([]span, error) {
 			// No error seen so far, continue.
 		}
 		gate <- struct{}{}
-		idx := len(w.spans) - 1
+		s := w.spans[len(w.spans)-1]
 		go func() {
 			defer func() { <-gate }()
-			br := sha1FromString(chunk)
-			w.spans[idx].br = br
-			if err := uploadString(repo, br, chunk); err != nil {
+			br := w.cfg.sum(chunk)
+			s.br = br
+			if err := uploadChunk(put, w.cfg, br, chunk); err != nil {
 				select {
 				case firsterrc <- err:
 				default:
@@ -132,60 +120,46 @@ func (w *chunkWriter) writeChunks(repo Repo) ([]span, error) {
 	}
 
 	for {
-		c, err := bufr.ReadByte()
-		if err != nil {
-			if err == io.EOF {
-				if blobSize > 0 {
-					w.spans = append(w.spans, span{})
-					if !uploadLastSpan() {
-						return nil, outerr
-					}
-				}
-				break
-			} else {
+		if end-start < max && !sawEOF {
+			copy(buf, buf[start:end])
+			end -= start
+			start = 0
+			n, err := io.ReadAtLeast(w.r, buf[end:], max-end)
+			end += n
+			switch err {
+			case nil:
+			case io.EOF, io.ErrUnexpectedEOF:
+				sawEOF = true
+			default:
+				wait()
 				return nil, err
 			}
 		}
-
-		buf.WriteByte(c)
-		blobSize++
-		onRollSplit := rs.Roll(c)
-		switch {
-		case blobSize == maxBlobSize || onRollSplit && blobSize > tooSmallThreshold:
-			// split
-		case src.sawEOF:
-			// Don't split. End is coming soon enough.
-			continue
-		default:
-			// Don't split.
-			continue
+		if start == end {
+			break
 		}
-		blobSize = 0
 
-		w.spans = append(w.spans, span{})
+		n := ch.Next(buf[start:end])
+		chunk := append([]byte(nil), buf[start:start+n]...)
+		start += n
+		w.whole.Write(chunk)
 
-		if !uploadLastSpan() {
+		w.spans = append(w.spans, &span{size: int64(n)})
+
+		if !uploadLastSpan(chunk) {
+			wait()
 			return nil, outerr
 		}
 	}
 
-	// Loop was already hit earlier.
-	if outerr != nil {
-		return nil, outerr
-	}
-
-	// Wait for all uploads to finish, one way or another, and then
-	// see if any generated errors.
-	// Once this loop is done, we own all the tokens in gate, so nobody
-	// else can have one outstanding.
-	for i := 0; i < chunksInFlight; i++ {
-		gate <- struct{}{}
-	}
-	select {
-	case err := <-firsterrc:
+	if err := wait(); err != nil {
 		return nil, err
-	default:
 	}
-
 	return w.spans, nil
 }
+
+// digest returns the hash of everything written, in a manifest's
+// "<hash>:<hex>" form.
+func (w *chunkWriter) digest() string {
+	return w.cfg.Hash + ":" + hex.EncodeToString(w.whole.Sum(nil))
+}
@@ -0,0 +1,84 @@
+package repo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+// Compression settings for Config.Compression.
+const (
+	// CompressionNone stores chunks exactly as they were added, with no
+	// header. Every repository created before compression was offered
+	// stores chunks this way.
+	CompressionNone = ""
+	// CompressionGzip stores each chunk with a header giving its size and
+	// codec, and compresses it with gzip unless that doesn't pay off.
+	CompressionGzip = "gzip"
+)
+
+// Codec header bytes, one of which starts every chunk compress returns.
+const (
+	codecRaw  byte = 0
+	codecGzip byte = 1
+)
+
+// A chunk is only stored compressed if that saves at least 1/minSavings of
+// its size; otherwise decompressing it on every read isn't worth it.
+const minSavings = 32
+
+func validCompression(compression string) error {
+	switch compression {
+	case CompressionNone, CompressionGzip:
+		return nil
+	default:
+		return fmt.Errorf("unknown compression %q", compression)
+	}
+}
+
+// compress returns data as it should be stored. Chunks are still named by
+// the hash of data itself, so compression doesn't affect dedup.
+func (cfg *Config) compress(data []byte) []byte {
+	if cfg.Compression == CompressionNone {
+		return data
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(codecGzip)
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	if buf.Len() < len(data)-len(data)/minSavings {
+		return buf.Bytes()
+	}
+
+	// Incompressible, as most already-compressed assets are.
+	raw := make([]byte, 1+len(data))
+	raw[0] = codecRaw
+	copy(raw[1:], data)
+	return raw
+}
+
+// decompress reverses compress.
+func (cfg *Config) decompress(stored []byte) ([]byte, error) {
+	if cfg.Compression == CompressionNone {
+		return stored, nil
+	}
+	if len(stored) == 0 {
+		return nil, fmt.Errorf("chunk has no codec header")
+	}
+
+	switch stored[0] {
+	case codecRaw:
+		return stored[1:], nil
+	case codecGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(stored[1:]))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(zr)
+	default:
+		return nil, fmt.Errorf("chunk has unknown codec %d", stored[0])
+	}
+}
@@ -0,0 +1,193 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/burke/rabit/pkg/chunker"
+	"github.com/burke/rabit/pkg/digest"
+)
+
+// configName is the metadata file holding a repository's Config.
+const configName = "config.json"
+
+// maxChunkLimit caps MaxChunkSize. Chunks are held in memory whole, and
+// servers refuse uploads much larger than this.
+const maxChunkLimit = 32 << 20
+
+// Config holds the parameters a repository was created with. Every file
+// added to a repository is chunked the same way, so that identical content
+// always dedups, and every chunk is named by the same hash function.
+type Config struct {
+	// Hash names the function chunks are addressed by; see package digest.
+	Hash string `json:"hash"`
+
+	// Chunker names the chunking algorithm; see package chunker.
+	Chunker string `json:"chunker"`
+
+	// A chunk is never cut before MinChunkSize bytes, and always cut at
+	// MaxChunkSize bytes. Chunks come out at around AvgChunkSize bytes on
+	// average. The rollsum chunker needs AvgChunkSize-MinChunkSize to be a
+	// power of two, and FastCDC needs AvgChunkSize to be.
+	MinChunkSize int `json:"min_chunk_size"`
+	AvgChunkSize int `json:"average_chunk_size"`
+	MaxChunkSize int `json:"max_chunk_size"`
+
+	// Compression is how chunks are stored: CompressionNone or
+	// CompressionGzip.
+	Compression string `json:"compression,omitempty"`
+
+	// Encryption is set for encrypted repositories. Init fills it in when
+	// the repository is given a passphrase or key file.
+	Encryption *Encryption `json:"encryption,omitempty"`
+
+	// Retention is how much of each file's history GC keeps. nil keeps
+	// all of it; see SetRetention.
+	Retention *Retention `json:"retention,omitempty"`
+
+	keys *cipherKeys // set once an encrypted repository is unlocked
+}
+
+// DefaultConfig is used by Init when no Config is given.
+func DefaultConfig() *Config {
+	return &Config{
+		Hash:         digest.SHA256,
+		Chunker:      chunker.Rollsum,
+		MinChunkSize: 64 << 10,
+		AvgChunkSize: 72 << 10,
+		MaxChunkSize: 1 << 20,
+	}
+}
+
+// DefaultConfigFor returns sensible chunk sizes for the named algorithm.
+func DefaultConfigFor(algorithm string) *Config {
+	if algorithm == chunker.FastCDC {
+		return &Config{
+			Hash:         digest.SHA256,
+			Chunker:      chunker.FastCDC,
+			MinChunkSize: 16 << 10,
+			AvgChunkSize: 64 << 10,
+			MaxChunkSize: 512 << 10,
+		}
+	}
+	cfg := DefaultConfig()
+	cfg.Chunker = algorithm
+	return cfg
+}
+
+// legacyConfig describes repositories created before configuration was
+// stored, and fills in settings missing from older configuration files.
+func legacyConfig() *Config {
+	cfg := DefaultConfig()
+	cfg.Hash = digest.SHA1
+	return cfg
+}
+
+// Validate checks that the algorithms are known and the chunk sizes are
+// usable together.
+func (cfg *Config) Validate() error {
+	if _, err := digest.New(cfg.Hash); err != nil {
+		return err
+	}
+	if _, err := cfg.newChunker(); err != nil {
+		return err
+	}
+	if err := validCompression(cfg.Compression); err != nil {
+		return err
+	}
+	if cfg.Encryption != nil {
+		if err := cfg.Encryption.validate(); err != nil {
+			return err
+		}
+	}
+	if cfg.MinChunkSize < 0 || cfg.MinChunkSize >= cfg.AvgChunkSize || cfg.AvgChunkSize >= cfg.MaxChunkSize {
+		return fmt.Errorf("average chunk size %d must lie between the minimum %d and maximum %d", cfg.AvgChunkSize, cfg.MinChunkSize, cfg.MaxChunkSize)
+	}
+	if cfg.Chunker == chunker.FastCDC && !powerOfTwo(cfg.AvgChunkSize) {
+		return fmt.Errorf("fastcdc average chunk size must be a power of two of at least 64 bytes, not %d", cfg.AvgChunkSize)
+	}
+	if cfg.Chunker == chunker.Rollsum && !powerOfTwo(cfg.AvgChunkSize-cfg.MinChunkSize) {
+		return fmt.Errorf("rollsum average chunk size %d must be the minimum %d plus a power of two of at least 64 bytes", cfg.AvgChunkSize, cfg.MinChunkSize)
+	}
+	if cfg.MaxChunkSize > maxChunkLimit {
+		return fmt.Errorf("maximum chunk size %d is over the limit of %d", cfg.MaxChunkSize, maxChunkLimit)
+	}
+	return nil
+}
+
+func powerOfTwo(n int) bool {
+	return n >= 64 && n&(n-1) == 0
+}
+
+func (cfg *Config) newChunker() (chunker.Chunker, error) {
+	return chunker.New(cfg.Chunker, chunker.Params{
+		Min: cfg.MinChunkSize,
+		Avg: cfg.AvgChunkSize,
+		Max: cfg.MaxChunkSize,
+	})
+}
+
+// Config returns the parameters the repository was created with. An
+// encrypted repository's can only be had with its key; see StoredConfig.
+func (c *repo) Config() (*Config, error) {
+	c.loadConfig()
+	return c.config, c.configErr
+}
+
+// StoredConfig returns the repository's config without unlocking it. An
+// encrypted repository's comes back with its Encryption but no keys, which
+// is enough for ChunkNaming, but not to read or write anything.
+func (c *repo) StoredConfig() (*Config, error) {
+	c.loadConfig()
+	if c.stored == nil {
+		return nil, c.configErr
+	}
+	return c.stored, nil
+}
+
+func (c *repo) loadConfig() {
+	c.configOnce.Do(func() {
+		data, err := c.store.GetMetadata(configName)
+		if os.IsNotExist(err) {
+			c.config, c.stored = legacyConfig(), legacyConfig()
+			return
+		}
+		if err != nil {
+			c.configErr = err
+			return
+		}
+		cfg := legacyConfig()
+		if err := json.Unmarshal(data, cfg); err != nil {
+			c.configErr = fmt.Errorf("%s: %s", configName, err)
+			return
+		}
+		if err := cfg.Validate(); err != nil {
+			c.configErr = fmt.Errorf("%s: %s", configName, err)
+			return
+		}
+		c.stored = cfg
+		if cfg.Encryption == nil {
+			c.config = cfg
+			return
+		}
+		if c.secret == nil {
+			c.configErr = ErrLocked
+			return
+		}
+		unlocked := *cfg
+		if unlocked.keys, err = cfg.Encryption.unlock(c.secret); err != nil {
+			c.configErr = err
+			return
+		}
+		c.config = &unlocked
+	})
+}
+
+func (c *repo) writeConfig(cfg *Config) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return c.store.PutMetadata(configName, append(data, '\n'))
+}
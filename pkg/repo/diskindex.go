@@ -0,0 +1,212 @@
+package repo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "github.com/burke/rabit/Godeps/_workspace/src/go.etcd.io/bbolt"
+)
+
+// indexFile is the metadata file a diskStore keeps its reference index in,
+// a bolt database. Bolt locks the file for as long as it is open, so it is
+// opened for each transaction, and the processes using it take turns.
+const indexFile = "refcounts.db"
+
+// An index keeps the entries with references apart from those without, so
+// that GC can go straight to the latter.
+var (
+	liveBucket = []byte("live")
+	deadBucket = []byte("dead")
+)
+
+func (s *diskStore) openIndex(readOnly bool) (*bolt.DB, error) {
+	wait := LockWait
+	if wait <= 0 {
+		wait = time.Nanosecond // bolt waits forever on zero
+	}
+	db, err := bolt.Open(s.metadataPath(indexFile), 0660, &bolt.Options{Timeout: wait, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout {
+		return nil, &LockTimeoutError{Holder: "reference index in use by another process"}
+	}
+	return db, err
+}
+
+func (s *diskStore) UpdateIndex(create bool, f func(IndexTx) error) (err error) {
+	path := s.metadataPath(indexFile)
+	found, err := exists(path)
+	if err != nil {
+		return err
+	}
+	if !found {
+		if !create {
+			return f(nil)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+	}
+	db, err := s.openIndex(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	if !found {
+		if err := syncDir(filepath.Dir(path)); err != nil {
+			return err
+		}
+	}
+
+	return db.Update(func(btx *bolt.Tx) error {
+		tx := &boltIndex{tx: btx, live: btx.Bucket(liveBucket), dead: btx.Bucket(deadBucket)}
+		if tx.live == nil {
+			if !create {
+				return f(nil)
+			}
+			if err := tx.Clear(); err != nil {
+				return err
+			}
+		}
+		return f(tx)
+	})
+}
+
+func (s *diskStore) DropIndex() error {
+	path := s.metadataPath(indexFile)
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func (s *diskStore) ViewIndex(f func(IndexTx) error) error {
+	found, err := exists(s.metadataPath(indexFile))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return f(nil)
+	}
+	db, err := s.openIndex(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(btx *bolt.Tx) error {
+		tx := &boltIndex{tx: btx, live: btx.Bucket(liveBucket), dead: btx.Bucket(deadBucket)}
+		if tx.live == nil {
+			return f(nil)
+		}
+		return f(tx)
+	})
+}
+
+// boltIndex is an IndexTx on a bolt transaction. Each entry is stored under
+// its chunk's hash as three uvarints: its references, its size, and when it
+// was written in Unix seconds, or zero if that isn't known.
+type boltIndex struct {
+	tx         *bolt.Tx
+	live, dead *bolt.Bucket
+}
+
+func (x *boltIndex) Get(hash string) (IndexEntry, bool, error) {
+	v := x.live.Get([]byte(hash))
+	if v == nil {
+		v = x.dead.Get([]byte(hash))
+	}
+	if v == nil {
+		return IndexEntry{}, false, nil
+	}
+	e, err := decodeIndexEntry(hash, v)
+	return e, err == nil, err
+}
+
+func (x *boltIndex) Put(hash string, e IndexEntry) error {
+	from, to := x.live, x.dead
+	if e.Refs > 0 {
+		from, to = x.dead, x.live
+	}
+	if err := from.Delete([]byte(hash)); err != nil {
+		return err
+	}
+	var written int64
+	if !e.Written.IsZero() {
+		written = e.Written.Unix()
+	}
+	v := make([]byte, 3*binary.MaxVarintLen64)
+	n := binary.PutUvarint(v, uint64(e.Refs))
+	n += binary.PutUvarint(v[n:], uint64(e.Size))
+	n += binary.PutUvarint(v[n:], uint64(written))
+	return to.Put([]byte(hash), v[:n])
+}
+
+func (x *boltIndex) Delete(hash string) error {
+	if err := x.live.Delete([]byte(hash)); err != nil {
+		return err
+	}
+	return x.dead.Delete([]byte(hash))
+}
+
+func (x *boltIndex) ForEach(f func(string, IndexEntry) error) error {
+	if err := forEachEntry(x.live, f); err != nil {
+		return err
+	}
+	return forEachEntry(x.dead, f)
+}
+
+func (x *boltIndex) ForEachDead(f func(string, IndexEntry) error) error {
+	return forEachEntry(x.dead, f)
+}
+
+func (x *boltIndex) Clear() error {
+	for _, name := range [][]byte{liveBucket, deadBucket} {
+		if err := x.tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+	}
+	var err error
+	if x.live, err = x.tx.CreateBucket(liveBucket); err != nil {
+		return err
+	}
+	x.dead, err = x.tx.CreateBucket(deadBucket)
+	return err
+}
+
+func forEachEntry(b *bolt.Bucket, f func(string, IndexEntry) error) error {
+	return b.ForEach(func(k, v []byte) error {
+		e, err := decodeIndexEntry(string(k), v)
+		if err != nil {
+			return err
+		}
+		return f(string(k), e)
+	})
+}
+
+func decodeIndexEntry(hash string, v []byte) (IndexEntry, error) {
+	refs, n := binary.Uvarint(v)
+	if n <= 0 {
+		return IndexEntry{}, fmt.Errorf("bad reference index entry for %s", hash)
+	}
+	size, m := binary.Uvarint(v[n:])
+	if m <= 0 {
+		return IndexEntry{}, fmt.Errorf("bad reference index entry for %s", hash)
+	}
+	written, l := binary.Uvarint(v[n+m:])
+	if l <= 0 || n+m+l != len(v) {
+		return IndexEntry{}, fmt.Errorf("bad reference index entry for %s", hash)
+	}
+	e := IndexEntry{Refs: int(refs), Size: int64(size)}
+	if written != 0 {
+		e.Written = time.Unix(int64(written), 0)
+	}
+	return e, nil
+}
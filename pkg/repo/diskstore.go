@@ -0,0 +1,240 @@
+package repo
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// diskStore keeps each chunk in its own file under chunks/xx/<hash>, each
+// manifest under manifests/<name> and metadata under metadata/<name>. The
+// elements of a slash-separated name are nested directories.
+// Every file is written to a temporary name, synced and then renamed into
+// place, so a crash never leaves a truncated file under a real name.
+type diskStore struct {
+	path string
+}
+
+// NewDiskStore returns a Store using the directory at path.
+func NewDiskStore(path string) Store {
+	return &diskStore{path: path}
+}
+
+func (s *diskStore) Init() error {
+	if err := os.Mkdir(filepath.Join(s.path, "chunks"), 0755); err != nil {
+		return err
+	}
+
+	return os.Mkdir(filepath.Join(s.path, "manifests"), 0755)
+}
+
+func (s *diskStore) chunkPath(hash string) string {
+	prefix := hash[0:2]
+	return filepath.Join(s.path, "chunks", prefix, hash)
+}
+
+func (s *diskStore) manifestPath(name string) string {
+	return filepath.Join(s.path, "manifests", filepath.FromSlash(name))
+}
+
+func (s *diskStore) metadataPath(name string) string {
+	return filepath.Join(s.path, "metadata", name)
+}
+
+func (s *diskStore) GetChunk(hash string) ([]byte, error) {
+	return ioutil.ReadFile(s.chunkPath(hash))
+}
+
+func (s *diskStore) ChunkHeader(hash string, n int) ([]byte, error) {
+	f, err := os.Open(s.chunkPath(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, n)
+	n, err = io.ReadFull(f, header)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return header[:n], err
+}
+
+func (s *diskStore) PutChunk(hash string, data []byte) error {
+	pth := s.chunkPath(hash)
+	if err := s.mkdir(filepath.Dir(pth)); err != nil {
+		return err
+	}
+	return writeFileAtomic(pth, data, 0660)
+}
+
+// mkdir makes a chunk prefix directory unless it is there already, and
+// syncs chunks/ after making it, so that the directory survives a crash
+// along with the chunks put in it.
+func (s *diskStore) mkdir(dir string) error {
+	err := os.Mkdir(dir, 0755)
+	if os.IsExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dir))
+}
+
+func (s *diskStore) HasChunk(hash string) (bool, error) {
+	return exists(s.chunkPath(hash))
+}
+
+func (s *diskStore) ChunkSize(hash string) (int64, error) {
+	fi, err := os.Stat(s.chunkPath(hash))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (s *diskStore) ChunkTime(hash string) (time.Time, error) {
+	fi, err := os.Stat(s.chunkPath(hash))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// DeleteChunk also removes the chunk's prefix directory once it is empty.
+func (s *diskStore) DeleteChunk(hash string) error {
+	pth := s.chunkPath(hash)
+	if err := os.Remove(pth); err != nil {
+		return err
+	}
+	_ = os.Remove(filepath.Dir(pth)) // fails harmlessly unless empty
+	return nil
+}
+
+func (s *diskStore) ListChunks() ([]string, error) {
+	prefixFIs, err := ioutil.ReadDir(filepath.Join(s.path, "chunks"))
+	if err != nil {
+		return nil, err
+	}
+	var hashes []string
+	for _, fi := range prefixFIs {
+		if !fi.IsDir() {
+			continue
+		}
+		fis, err := ioutil.ReadDir(filepath.Join(s.path, "chunks", fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, cfi := range fis {
+			if isTemp(cfi.Name()) {
+				continue
+			}
+			hashes = append(hashes, cfi.Name())
+		}
+	}
+	return hashes, nil
+}
+
+// GetManifest, HasManifest and DeleteManifest treat a directory of
+// manifests as not being one itself.
+func (s *diskStore) GetManifest(name string) ([]byte, error) {
+	p := s.manifestPath(name)
+	if isDir(p) {
+		return nil, notExist("get", name)
+	}
+	return ioutil.ReadFile(p)
+}
+
+func (s *diskStore) PutManifest(name string, data []byte) error {
+	p := s.manifestPath(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(p, data, 0660)
+}
+
+func (s *diskStore) HasManifest(name string) (bool, error) {
+	p := s.manifestPath(name)
+	if isDir(p) {
+		return false, nil
+	}
+	return exists(p)
+}
+
+// DeleteManifest also removes the directories the manifest leaves empty.
+func (s *diskStore) DeleteManifest(name string) error {
+	p := s.manifestPath(name)
+	if isDir(p) {
+		return notExist("delete", name)
+	}
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+	root := filepath.Join(s.path, "manifests")
+	for dir := filepath.Dir(p); dir != root; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break // not empty
+		}
+	}
+	return nil
+}
+
+func (s *diskStore) ListManifests(dir string) ([]string, error) {
+	root := filepath.Join(s.path, "manifests")
+	start := filepath.Join(root, filepath.FromSlash(dir))
+	if dir != "" {
+		if fi, err := os.Stat(start); os.IsNotExist(err) || err == nil && !fi.IsDir() {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	var names []string
+	err := filepath.Walk(start, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || isTemp(fi.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	return names, err
+}
+
+func (s *diskStore) GetMetadata(name string) ([]byte, error) {
+	return ioutil.ReadFile(s.metadataPath(name))
+}
+
+func (s *diskStore) PutMetadata(name string, data []byte) error {
+	p := s.metadataPath(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(p, data, 0660)
+}
+
+// Clean removes temporary files left behind by writers that crashed.
+func (s *diskStore) Clean(olderThan time.Duration) error {
+	return removeStaleTemp(s.path, olderThan)
+}
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+func exists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
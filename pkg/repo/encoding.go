@@ -0,0 +1,171 @@
+package repo
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/burke/rabit/pkg/digest"
+)
+
+// Everything a Repo puts in its Store passes through here. Chunks are
+// compressed and then, in an encrypted repository, sealed; manifests are
+// only sealed.
+//
+// Unless chunks are stored as they are, each is preceded by its size before
+// encoding, as sizeLen big-endian bytes, sealed on their own in an
+// encrypted repository. ChunkSize reads only that header, where it would
+// otherwise have to decompress or decrypt the whole chunk.
+
+const sizeLen = 8
+
+// sum returns the name of a chunk holding data.
+func (cfg *Config) sum(data []byte) string {
+	if cfg.keys == nil {
+		return digest.Sum(cfg.Hash, data)
+	}
+	newHash, _ := digest.New(cfg.Hash)
+	mac := hmac.New(newHash, cfg.keys.id)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ChunkNaming describes how the repository names chunks: by its hash
+// function and, if it is encrypted, by a fingerprint of its Encryption,
+// which holds the key that hash is keyed with. Repositories can only
+// exchange chunks if they name them alike, which two encrypted
+// repositories only do if one is a copy of the other. It needs no key, so
+// a server can tell clients without one.
+func (cfg *Config) ChunkNaming() string {
+	e := cfg.Encryption
+	if e == nil {
+		return cfg.Hash
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		panic(err) // nothing in an Encryption can fail to marshal
+	}
+	sum := sha256.Sum256(append([]byte("rabit chunk naming "), data...))
+	return "hmac-" + cfg.Hash + ":" + hex.EncodeToString(sum[:8])
+}
+
+// storedAsIs reports whether chunks are kept in the store unchanged, so
+// that their stored size is their size.
+func (cfg *Config) storedAsIs() bool {
+	return cfg.Compression == CompressionNone && cfg.keys == nil
+}
+
+// headerLen returns the length of the size header chunks start with, if
+// any.
+func (cfg *Config) headerLen() int {
+	switch {
+	case cfg.storedAsIs():
+		return 0
+	case cfg.keys == nil:
+		return sizeLen
+	default:
+		return cfg.keys.aead.NonceSize() + sizeLen + cfg.keys.aead.Overhead()
+	}
+}
+
+func (cfg *Config) encodeChunk(hash string, data []byte) ([]byte, error) {
+	stored := cfg.compress(data)
+	if cfg.keys != nil {
+		var err error
+		if stored, err = seal(cfg.keys.aead, "chunk "+hash, stored); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.storedAsIs() {
+		return stored, nil
+	}
+	header := make([]byte, sizeLen)
+	binary.BigEndian.PutUint64(header, uint64(len(data)))
+	if cfg.keys != nil {
+		var err error
+		if header, err = seal(cfg.keys.aead, "chunk size "+hash, header); err != nil {
+			return nil, err
+		}
+	}
+	return append(header, stored...), nil
+}
+
+// readSize returns the size recorded in the header at the start of stored.
+func (cfg *Config) readSize(hash string, stored []byte) (int64, error) {
+	n := cfg.headerLen()
+	if len(stored) < n {
+		return 0, fmt.Errorf("chunk %s: truncated size header", hash)
+	}
+	header := stored[:n]
+	if cfg.keys != nil {
+		var err error
+		if header, err = open(cfg.keys.aead, "chunk size "+hash, header); err != nil {
+			return 0, fmt.Errorf("chunk %s: %s", hash, err)
+		}
+	}
+	return int64(binary.BigEndian.Uint64(header)), nil
+}
+
+func (cfg *Config) openChunk(hash string, stored []byte) ([]byte, error) {
+	if cfg.keys == nil {
+		return stored, nil
+	}
+	data, err := open(cfg.keys.aead, "chunk "+hash, stored)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %s", hash, err)
+	}
+	return data, nil
+}
+
+func (cfg *Config) decodeChunk(hash string, stored []byte) ([]byte, error) {
+	if cfg.storedAsIs() {
+		return stored, nil
+	}
+	size, err := cfg.readSize(hash, stored)
+	if err != nil {
+		return nil, err
+	}
+	stored = stored[cfg.headerLen():]
+	compressed, err := cfg.openChunk(hash, stored)
+	if err != nil {
+		return nil, err
+	}
+	data, err := cfg.decompress(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %s", hash, err)
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("chunk %s is %d bytes, not the %d its header says", hash, len(data), size)
+	}
+	return data, nil
+}
+
+// decodedSize returns the size of a chunk's contents. stored need only hold
+// the first headerLen bytes of it.
+func (cfg *Config) decodedSize(hash string, stored []byte) (int64, error) {
+	if cfg.storedAsIs() {
+		return int64(len(stored)), nil
+	}
+	return cfg.readSize(hash, stored)
+}
+
+func (cfg *Config) encodeManifest(name string, data []byte) ([]byte, error) {
+	if cfg.keys == nil {
+		return data, nil
+	}
+	return seal(cfg.keys.aead, "manifest "+name, data)
+}
+
+func (cfg *Config) decodeManifest(name string, stored []byte) ([]byte, error) {
+	if cfg.keys == nil {
+		return stored, nil
+	}
+	data, err := open(cfg.keys.aead, "manifest "+name, stored)
+	if err != nil {
+		return nil, fmt.Errorf("manifest %s: %s", name, err)
+	}
+	return data, nil
+}
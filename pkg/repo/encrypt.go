@@ -0,0 +1,171 @@
+package repo
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/burke/rabit/Godeps/_workspace/src/golang.org/x/crypto/pbkdf2"
+)
+
+// Encryption settings, as recorded in Encryption.
+const (
+	CipherAES256GCM = "aes-256-gcm"
+	KDFPBKDF2SHA256 = "pbkdf2-sha256"
+)
+
+// kdfIterations is the PBKDF2 work factor for new repositories.
+var kdfIterations = 600000
+
+// minKDFIterations and minSaltLen are the least a repository's config may
+// ask for. Without them, whoever can write the config could make its key
+// cheap to guess, the next time it is wrapped.
+var (
+	minKDFIterations = 100000
+	minSaltLen       = 16
+)
+
+var (
+	// ErrLocked is returned when an encrypted repository was opened
+	// without a passphrase or key file.
+	ErrLocked = errors.New("repository is encrypted, and no passphrase or key file was given")
+	// ErrWrongKey is returned when the passphrase or key file doesn't
+	// unlock the repository.
+	ErrWrongKey = errors.New("wrong passphrase or key file for this repository")
+)
+
+// Encryption describes how an encrypted repository's chunks and manifests
+// are sealed. It holds the repository's master key only in wrapped form:
+// sealed under a key derived from the passphrase or key file.
+//
+// Chunks are named by a keyed hash, so that someone holding the store but
+// not the key can't tell whether it contains a file they know. Chunks and
+// manifests are sealed with AES-256-GCM under random nonces, and
+// authenticated along with their names, so that one can't be passed off as
+// another. Manifest names, chunk sizes and the repository's metadata are
+// not hidden.
+type Encryption struct {
+	Cipher     string `json:"cipher"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+// cipherKeys are derived from the master key once a repository is unlocked.
+type cipherKeys struct {
+	id   []byte // keys the hash chunks are named by
+	aead cipher.AEAD
+}
+
+func (e *Encryption) validate() error {
+	if e.Cipher != CipherAES256GCM {
+		return fmt.Errorf("unknown cipher %q", e.Cipher)
+	}
+	if e.KDF != KDFPBKDF2SHA256 {
+		return fmt.Errorf("unknown key derivation function %q", e.KDF)
+	}
+	if e.Iterations < minKDFIterations {
+		return fmt.Errorf("key derivation iterations %d are below the minimum of %d", e.Iterations, minKDFIterations)
+	}
+	if len(e.Salt) < minSaltLen {
+		return fmt.Errorf("key derivation salt of %d bytes is shorter than the minimum of %d", len(e.Salt), minSaltLen)
+	}
+	return nil
+}
+
+func (e *Encryption) wrappingKey(secret []byte) (cipher.AEAD, error) {
+	return newAEAD(pbkdf2.Key(secret, e.Salt, e.Iterations, 32, sha256.New))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// newEncryption generates a master key for a new repository and wraps it
+// under secret.
+func newEncryption(secret []byte) (*Encryption, *cipherKeys, error) {
+	salt, err := randomBytes(minSaltLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	e := &Encryption{
+		Cipher:     CipherAES256GCM,
+		KDF:        KDFPBKDF2SHA256,
+		Iterations: kdfIterations,
+		Salt:       salt,
+	}
+	master, err := randomBytes(32)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrap, err := e.wrappingKey(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e.WrappedKey, err = seal(wrap, "master key", master); err != nil {
+		return nil, nil, err
+	}
+	keys, err := deriveKeys(master)
+	return e, keys, err
+}
+
+// unlock unwraps the master key with secret.
+func (e *Encryption) unlock(secret []byte) (*cipherKeys, error) {
+	wrap, err := e.wrappingKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	master, err := open(wrap, "master key", e.WrappedKey)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return deriveKeys(master)
+}
+
+func deriveKeys(master []byte) (*cipherKeys, error) {
+	subkey := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, master)
+		mac.Write([]byte("rabit " + purpose))
+		return mac.Sum(nil)
+	}
+	aead, err := newAEAD(subkey("encryption"))
+	if err != nil {
+		return nil, err
+	}
+	return &cipherKeys{id: subkey("chunk id"), aead: aead}, nil
+}
+
+// seal encrypts data, binding it to label, and prepends the random nonce.
+// With 96-bit random nonces, a key is good for about 2^32 seals.
+func seal(aead cipher.AEAD, label string, data []byte) ([]byte, error) {
+	nonce, err := randomBytes(aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, []byte(label)), nil
+}
+
+func open(aead cipher.AEAD, label string, sealed []byte) ([]byte, error) {
+	n := aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("sealed data is truncated")
+	}
+	return aead.Open(nil, sealed[:n], sealed[n:], []byte(label))
+}
@@ -0,0 +1,215 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// File is a file in a repository opened for random access. It reads only
+// the chunks covering the bytes asked of it, and keeps the last chunk it
+// read, so that small sequential reads don't fetch a chunk repeatedly.
+//
+// Chunk offsets come from the manifest if it records chunk sizes. If not,
+// they are worked out as far into the file as reads have gone, so reading
+// the start of a file never needs the size of every chunk in it.
+//
+// Each chunk is checked against its hash as it is read. The file as a whole
+// can't be checked against its digest, since it needn't be read in full.
+//
+// A File holds the repository lock shared until it is closed, so that GC
+// can't delete its chunks from under it. ReadAt may be called
+// concurrently; Read and Seek share an offset, as with os.File.
+type File struct {
+	c        *repo
+	cfg      *Config
+	manifest *Manifest
+	chunks   []string
+	unlock   func()
+
+	mu   sync.Mutex
+	ends []int64 // ends[i] is the offset just past chunk i, as far as known
+	pos  int64
+
+	cached int // index of the chunk in data, or -1
+	data   []byte
+}
+
+var errNegativeOffset = errors.New("repo: negative offset")
+
+// Open opens the named file for reading.
+func (c *repo) Open(name string) (*File, error) {
+	unlock, err := c.readLock()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := c.Config()
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	manifest, err := c.LoadManifest(name)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	f := &File{c: c, cfg: cfg, manifest: manifest, chunks: manifest.Chunks, unlock: unlock, cached: -1}
+	if manifest.Sizes != nil {
+		var end int64
+		f.ends = make([]int64, len(manifest.Sizes))
+		for i, size := range manifest.Sizes {
+			end += size
+			f.ends[i] = end
+		}
+	}
+	return f, nil
+}
+
+// Close releases the repository lock.
+func (f *File) Close() error {
+	f.unlock()
+	return nil
+}
+
+// chunk returns the contents of chunk i. f.mu must be held.
+func (f *File) chunk(i int) ([]byte, error) {
+	if f.cached != i {
+		data, err := f.c.ReadChunk(f.chunks[i])
+		if err != nil {
+			return nil, err
+		}
+		if err := checkChunk(f.cfg, f.manifest, i, data); err != nil {
+			return nil, err
+		}
+		f.cached, f.data = i, data
+	}
+	return f.data, nil
+}
+
+// sizeNext works out where the first chunk of unknown size ends. Unless
+// chunks are stored as they are, that means reading it. f.mu must be held.
+func (f *File) sizeNext() error {
+	i := len(f.ends)
+	var size int64
+	if f.cfg.storedAsIs() {
+		var err error
+		if size, err = f.c.store.ChunkSize(f.chunks[i]); err != nil {
+			return err
+		}
+	} else {
+		data, err := f.chunk(i)
+		if err != nil {
+			return err
+		}
+		size = int64(len(data))
+	}
+	var start int64
+	if i > 0 {
+		start = f.ends[i-1]
+	}
+	f.ends = append(f.ends, start+size)
+	return nil
+}
+
+// locate returns the index of the chunk holding the byte at off and the
+// offset the chunk starts at, or io.EOF if off is past the end of the file.
+// f.mu must be held.
+func (f *File) locate(off int64) (int, int64, error) {
+	for len(f.ends) < len(f.chunks) && (len(f.ends) == 0 || f.ends[len(f.ends)-1] <= off) {
+		if err := f.sizeNext(); err != nil {
+			return 0, 0, err
+		}
+	}
+	i := sort.Search(len(f.ends), func(i int) bool { return f.ends[i] > off })
+	if i == len(f.ends) {
+		return 0, 0, io.EOF
+	}
+	if i == 0 {
+		return 0, 0, nil
+	}
+	return i, f.ends[i-1], nil
+}
+
+// Size returns the length of the file, which means learning the size of
+// every chunk in it.
+func (f *File) Size() (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.size()
+}
+
+func (f *File) size() (int64, error) {
+	for len(f.ends) < len(f.chunks) {
+		if err := f.sizeNext(); err != nil {
+			return 0, err
+		}
+	}
+	if len(f.ends) == 0 {
+		return 0, nil
+	}
+	return f.ends[len(f.ends)-1], nil
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readAt(p, off)
+}
+
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		i, start, err := f.locate(off + int64(n))
+		if err != nil {
+			return n, err
+		}
+		data, err := f.chunk(i)
+		if err != nil {
+			return n, err
+		}
+		if int64(len(data)) != f.ends[i]-start {
+			return n, fmt.Errorf("chunk %s is %d bytes, not the %d its manifest says", f.chunks[i], len(data), f.ends[i]-start)
+		}
+		n += copy(p[n:], data[off+int64(n)-start:])
+	}
+	return n, nil
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.readAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		size, err := f.size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, errors.New("repo: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	f.pos = offset
+	return offset, nil
+}
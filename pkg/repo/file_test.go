@@ -0,0 +1,112 @@
+package repo
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestOpen(t *testing.T) {
+	want, err := ioutil.ReadFile(blob1Path)
+	if err != nil {
+		t.Fatal("read blob1")
+	}
+	gzipped := DefaultConfig()
+	gzipped.Compression = CompressionGzip
+
+	for _, cfg := range []*Config{DefaultConfig(), gzipped} {
+		r := NewWithStore(NewMemStore())
+		r.Init(cfg)
+		addFile(t, r, blob1Path, "blob1")
+		// Without sizes, as in an old manifest, chunks are sized as
+		// reads reach them.
+		m, _ := r.LoadManifest("blob1")
+		r.WriteManifest("old", &Manifest{Chunks: m.Chunks})
+
+		for _, name := range []string{"blob1", "old"} {
+			testOpen(t, r, name, cfg.Compression, want)
+		}
+	}
+}
+
+func testOpen(t *testing.T, r Repo, name, compression string, want []byte) {
+	f, err := r.Open(name)
+	if err != nil {
+		t.Fatal("open", err)
+	}
+	sized := len(f.ends)
+
+	head := make([]byte, 100)
+	if n, err := f.ReadAt(head, 0); n != 100 || err != nil || !bytes.Equal(head, want[:100]) {
+		t.Errorf("%s: reading the head: %d, %v", compression, n, err)
+	}
+	if sized == 0 && len(f.ends) != 1 {
+		t.Errorf("%s: reading the head sized %d chunks", compression, len(f.ends))
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 50; i++ {
+		off := rnd.Int63n(int64(len(want)))
+		buf := make([]byte, rnd.Intn(100000))
+		n, err := f.ReadAt(buf, off)
+		end := off + int64(len(buf))
+		if end > int64(len(want)) {
+			end = int64(len(want))
+			if err != io.EOF {
+				t.Errorf("%s: short ReadAt at %d returned %v, not EOF", compression, off, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: ReadAt at %d: %v", compression, off, err)
+		}
+		if !bytes.Equal(buf[:n], want[off:end]) {
+			t.Errorf("%s: ReadAt(%d bytes at %d) returned the wrong data", compression, len(buf), off)
+		}
+	}
+
+	if size, err := f.Seek(0, io.SeekEnd); size != int64(len(want)) || err != nil {
+		t.Errorf("%s: seek to end: %d, %v", compression, size, err)
+	}
+	if n, err := f.Read(head); n != 0 || err != io.EOF {
+		t.Errorf("%s: read at end: %d, %v", compression, n, err)
+	}
+	if _, err := f.Seek(-1000, io.SeekEnd); err != nil {
+		t.Fatal("seek", err)
+	}
+	tail, err := ioutil.ReadAll(f)
+	if err != nil || !bytes.Equal(tail, want[len(want)-1000:]) {
+		t.Errorf("%s: reading the tail: %d bytes, %v", compression, len(tail), err)
+	}
+	if _, err := f.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("%s: seek before the start succeeded", compression)
+	}
+	f.Close()
+}
+
+func TestOpenHoldsLock(t *testing.T) {
+	r := NewWithStore(NewMemStore())
+	r.Init(nil)
+	addFile(t, r, blob1Path, "blob1")
+	f, err := r.Open("blob1")
+	if err != nil {
+		t.Fatal("open", err)
+	}
+
+	defer func(wait time.Duration) { LockWait = wait }(LockWait)
+	LockWait = 0
+	if _, err := r.GC(GCOptions{}); err == nil {
+		t.Error("gc ran while a file was open")
+	}
+	f.Close()
+	if _, err := r.GC(GCOptions{}); err != nil {
+		t.Error("gc after close", err)
+	}
+	if _, err := r.Open("missing"); err == nil {
+		t.Error("opened a missing file")
+	}
+	if _, err := r.GC(GCOptions{}); err != nil {
+		t.Error("failed open kept the lock", err)
+	}
+}
@@ -1,60 +1,266 @@
 package repo
 
 import (
-	"fmt"
-	"io/ioutil"
 	"os"
-	"path/filepath"
-	"strings"
+	"sort"
+	"time"
 )
 
-// TODO(burke): this is total crap. rewrite.
-func (c *repo) GC(verbose bool) error {
-	allChunks := make(map[string]struct{})
+// DefaultGCGrace is how old an unreferenced chunk must be before the rabit
+// command's GC deletes it.
+const DefaultGCGrace = time.Hour
 
-	manifestDir := filepath.Join(c.path, "manifests")
-	fis, err := ioutil.ReadDir(manifestDir)
+// GCOptions controls a garbage collection.
+type GCOptions struct {
+	// DryRun reports what would be deleted without deleting anything.
+	DryRun bool
+	// Grace spares unreferenced chunks written more recently than this:
+	// they may belong to an add or a push whose manifest isn't written
+	// yet. A chunk is timed by its index entry, or else by the store if it
+	// is a ChunkTimer; one timed by neither is never spared.
+	Grace time.Duration
+	// Full reads every manifest and lists every chunk, instead of relying
+	// on the reference index, and then rebuilds the index. Only a full
+	// collection finds chunks the index has no entry for, such as those
+	// written before it was made. Collections are always full in a
+	// repository without an index.
+	Full bool
+	// Progress, if set, is called for each chunk as it is deleted, or
+	// would be in a dry run. size is the space the chunk takes in the
+	// store.
+	Progress func(hash string, size int64)
+}
+
+// GCReport is the result of a garbage collection.
+type GCReport struct {
+	Chunks int   // unreferenced chunks deleted, or that would be
+	Bytes  int64 // space those chunks took in the store
+	// Spared counts unreferenced chunks kept because they were written
+	// within the grace period.
+	Spared int
+	// Versions counts the file versions dropped, or that would be, under
+	// the repository's retention policy.
+	Versions int
+}
+
+// ChunkTimer is implemented by stores that know when each chunk was
+// written, which lets GC spare recent ones.
+type ChunkTimer interface {
+	ChunkTime(hash string) (time.Time, error)
+}
+
+// GC deletes the chunks no file refers to. Ordinarily those are the chunks
+// the reference index counts no references to, so the work done is in
+// proportion to the garbage; see GCOptions.Full for the alternative.
+//
+// If the repository has a retention policy, GC first drops the versions it
+// doesn't keep, which means reading the history of every file.
+//
+// GC holds the repository lock exclusively, so that it can't delete chunks
+// an add in progress has written but not yet referenced. On stores that
+// aren't Lockers that only holds within this process; see Locker.
+//
+// The grace period covers chunks written outside the lock, like those a
+// push uploads to a server ahead of its manifest. It can't cover a push
+// counting on an old unreferenced chunk the server already had, so
+// WriteManifest checks under the lock that every chunk a pushed manifest
+// names is still there: if GC got there first, the push fails, rather than
+// publishing a file with a chunk missing.
+//
+// A manifest that can't be read aborts a full collection, since the chunks
+// it names can't be marked.
+func (c *repo) GC(opts GCOptions) (*GCReport, error) {
+	unlock, err := c.Lock(true)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer unlock()
+	return c.gc(opts)
+}
+
+func (c *repo) gc(opts GCOptions) (*GCReport, error) {
+	cfg, err := c.Config()
+	if err != nil {
+		return nil, err
+	}
+	if cl, ok := c.store.(Cleaner); ok && !opts.DryRun {
+		if err := cl.Clean(staleTempAge); err != nil {
+			return nil, err
+		}
+	}
+
+	unlock, err := c.lock(indexLock, true)
+	if err != nil {
+		return nil, err
 	}
+	defer unlock()
 
-	for _, fi := range fis {
-		p := c.manifestPath(fi.Name())
-		data, err := ioutil.ReadFile(p)
+	full := opts.Full
+	if ix, ok := c.store.(Indexer); !ok {
+		full = true
+	} else if !full {
+		err := ix.ViewIndex(func(tx IndexTx) error {
+			full = tx == nil
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	var report *GCReport
+	err = c.updateIndex(full && !opts.DryRun, func(tx IndexTx) error {
+		if full {
+			// Mark every chunk a manifest names, and sweep the rest.
+			idx, err := c.buildIndex()
+			if err != nil {
+				return err
+			}
+			if tx == nil {
+				tx = idx
+			} else if err := replaceIndex(tx, idx); err != nil {
+				return err
+			}
+		}
+		pruned, err := c.prune(cfg, tx, opts.DryRun)
 		if err != nil {
 			return err
 		}
 
-		hashes := strings.Split(strings.TrimSpace(string(data)), "\n")
-		for _, h := range hashes {
-			allChunks[h] = struct{}{}
+		var garbage []string
+		if full {
+			hashes, err := c.store.ListChunks()
+			if err != nil {
+				return err
+			}
+			for _, h := range hashes {
+				if e, _, err := tx.Get(h); err != nil {
+					return err
+				} else if e.Refs == 0 {
+					garbage = append(garbage, h)
+				}
+			}
+		} else {
+			err := tx.ForEachDead(func(h string, _ IndexEntry) error {
+				garbage = append(garbage, h)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		sort.Strings(garbage)
+
+		report, err = c.sweep(garbage, tx, opts)
+		report.Versions = pruned
+		if err == nil && opts.DryRun {
+			err = errRollback
 		}
+		return err
+	})
+	if err == errRollback {
+		err = nil
 	}
+	return report, err
+}
 
-	prefixFIs, err := ioutil.ReadDir(filepath.Join(c.path, "chunks"))
+// replaceIndex makes tx hold the entries of idx instead of its own, but
+// for those of unreferenced chunks, which idx can't know about, and which
+// keep their write times.
+func replaceIndex(tx IndexTx, idx *mapIndex) error {
+	err := tx.ForEachDead(func(h string, e IndexEntry) error {
+		if _, ok := idx.entries[h]; !ok {
+			idx.entries[h] = e
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	for _, fi := range prefixFIs {
-		fis, err := ioutil.ReadDir(filepath.Join(c.path, "chunks", fi.Name()))
+	if err := tx.Clear(); err != nil {
+		return err
+	}
+	return idx.ForEach(tx.Put)
+}
+
+// sweep deletes garbage chunks, removing them from tx. Those spared for
+// their age are left in tx with no references, for a later collection to
+// find.
+func (c *repo) sweep(garbage []string, tx IndexTx, opts GCOptions) (*GCReport, error) {
+	timer, _ := c.store.(ChunkTimer)
+	report := &GCReport{}
+	for _, h := range garbage {
+		if opts.Grace > 0 {
+			e, ok, err := tx.Get(h)
+			if err != nil {
+				return report, err
+			}
+			written := e.Written
+			if written.IsZero() && timer != nil {
+				written, err = timer.ChunkTime(h)
+				if os.IsNotExist(err) { // deleted since it was listed
+					if err := tx.Delete(h); err != nil {
+						return report, err
+					}
+					continue
+				}
+				if err != nil {
+					return report, err
+				}
+			}
+			if !written.IsZero() && time.Since(written) < opts.Grace {
+				report.Spared++
+				if !ok {
+					e.Size, _ = c.store.ChunkSize(h)
+					e.Written = written
+					if err := tx.Put(h, e); err != nil {
+						return report, err
+					}
+				}
+				continue
+			}
+		}
+
+		size, err := c.store.ChunkSize(h)
+		if os.IsNotExist(err) {
+			if err := tx.Delete(h); err != nil {
+				return report, err
+			}
+			continue
+		}
 		if err != nil {
-			return err
+			return report, err
 		}
-		for _, cfi := range fis {
-			if _, ok := allChunks[cfi.Name()]; !ok {
-				p := filepath.Join(c.path, "chunks", fi.Name(), cfi.Name())
-				_ = p
-				if verbose {
-					fmt.Println(cfi.Name())
-				}
-				os.Remove(p)
+		if !opts.DryRun {
+			if err := c.store.DeleteChunk(h); err != nil && !os.IsNotExist(err) {
+				return report, err
+			}
+			if err := tx.Delete(h); err != nil {
+				return report, err
 			}
 		}
-		fis, err = ioutil.ReadDir(filepath.Join(c.path, "chunks", fi.Name()))
-		if err == nil && len(fis) == 0 {
-			os.Remove(filepath.Join(c.path, "chunks", fi.Name()))
+		report.Chunks++
+		report.Bytes += size
+		if opts.Progress != nil {
+			opts.Progress(h, size)
 		}
 	}
+	return report, nil
+}
+
+// Repack collects garbage and then, if the repository keeps its chunks in
+// packs, rewrites them to reclaim the space the garbage took up.
+func (c *repo) Repack() error {
+	unlock, err := c.Lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
+	if _, err := c.gc(GCOptions{Grace: DefaultGCGrace}); err != nil {
+		return err
+	}
+	if p, ok := c.store.(Packer); ok {
+		return p.Repack()
+	}
 	return nil
 }
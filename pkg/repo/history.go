@@ -0,0 +1,304 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is one version of a named file.
+type Version struct {
+	Number   int       // counts up from 1, and is never reused for a name
+	Time     time.Time // when the version was written to this repository
+	Message  string    // given when the version was added, if at all
+	ID       string    // the manifest's ID; see Resolve
+	Manifest *Manifest
+}
+
+// history is what the store keeps under a name: every version of the file
+// still retained, oldest first.
+//
+// A name is a ref: each version points at a manifest by its ID, and the
+// manifest itself is stored as a chunk. A manifest written under a name
+// before histories existed is read as a history of one version pointing at
+// it; it is only stored as a chunk once that history is written.
+type history struct {
+	Versions []historyEntry `json:"history"`
+}
+
+type historyEntry struct {
+	Number  int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message,omitempty"`
+	ID      string    `json:"id"`
+
+	plain *Manifest // the manifest, if it was stored under the name itself
+}
+
+func parseHistory(cfg *Config, data []byte) (*history, error) {
+	var probe struct {
+		History json.RawMessage `json:"history"`
+	}
+	if !isManifestJSON(data) || json.Unmarshal(data, &probe) != nil || probe.History == nil {
+		m, err := ParseManifest(data)
+		if err != nil {
+			return nil, err
+		}
+		e := historyEntry{Number: 1, Time: m.Created, ID: cfg.sum([]byte(m.String())), plain: m}
+		return &history{[]historyEntry{e}}, nil
+	}
+	var h history
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("malformed history: %s", err)
+	}
+	if len(h.Versions) == 0 {
+		return nil, fmt.Errorf("history has no versions")
+	}
+	for i, e := range h.Versions {
+		if e.Number < 1 || i > 0 && e.Number <= h.Versions[i-1].Number {
+			return nil, fmt.Errorf("history is out of order at version %d", e.Number)
+		}
+		if !ValidHash(e.ID) {
+			return nil, fmt.Errorf("history version %d names no manifest", e.Number)
+		}
+	}
+	return &h, nil
+}
+
+func (h *history) bytes() []byte {
+	data, err := json.Marshal(h)
+	if err != nil {
+		panic(err) // nothing in a history can fail to marshal
+	}
+	return append(data, '\n')
+}
+
+func (h *history) latest() *historyEntry {
+	return &h.Versions[len(h.Versions)-1]
+}
+
+// find returns the entry for version n, or nil if it isn't kept.
+func (h *history) find(n int) *historyEntry {
+	for i := range h.Versions {
+		if h.Versions[i].Number == n {
+			return &h.Versions[i]
+		}
+	}
+	return nil
+}
+
+// entryManifest returns the manifest e points at.
+func (c *repo) entryManifest(cfg *Config, e *historyEntry) (*Manifest, error) {
+	if e.plain != nil {
+		return e.plain, nil
+	}
+	return c.loadObject(cfg, e.ID)
+}
+
+// entryRefs returns the chunks a version keeps alive: its manifest's, and
+// the manifest's own.
+func (c *repo) entryRefs(cfg *Config, e *historyEntry) ([]string, error) {
+	m, err := c.entryManifest(cfg, e)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{e.ID}, m.Chunks...), nil
+}
+
+func (c *repo) entryVersion(cfg *Config, e *historyEntry) (Version, error) {
+	m, err := c.entryManifest(cfg, e)
+	if err != nil {
+		return Version{}, fmt.Errorf("version %d: %s", e.Number, err)
+	}
+	return Version{Number: e.Number, Time: e.Time, Message: e.Message, ID: e.ID, Manifest: m}, nil
+}
+
+// splitVersion splits "name@n" into name and n. A name without a version
+// comes back with n of zero.
+func splitVersion(name string) (string, int) {
+	i := strings.LastIndex(name, "@")
+	if i < 0 {
+		return name, 0
+	}
+	n, err := strconv.Atoi(name[i+1:])
+	if err != nil || n < 1 || name[i+1] == '+' || name[i+1] == '0' {
+		return name, 0
+	}
+	return name[:i], n
+}
+
+// loadHistory reads the history kept under name.
+func (c *repo) loadHistory(cfg *Config, name string) (*history, error) {
+	if err := ValidName(name); err != nil {
+		return nil, err
+	}
+	stored, err := c.store.GetManifest(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := cfg.decodeManifest(name, stored)
+	if err != nil {
+		return nil, err
+	}
+	h, err := parseHistory(cfg, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return h, nil
+}
+
+func (c *repo) writeHistory(cfg *Config, name string, h *history) error {
+	for _, e := range h.Versions {
+		if e.plain == nil {
+			continue
+		}
+		if _, err := c.storeObject(cfg, e.plain); err != nil {
+			return err
+		}
+	}
+	data, err := cfg.encodeManifest(name, h.bytes())
+	if err != nil {
+		return err
+	}
+	return c.store.PutManifest(name, data)
+}
+
+// Log returns every version kept of the named file, oldest first.
+func (c *repo) Log(name string) ([]Version, error) {
+	unlock, err := c.readLock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	cfg, err := c.Config()
+	if err != nil {
+		return nil, err
+	}
+	h, err := c.loadHistory(cfg, name)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]Version, len(h.Versions))
+	for i := range h.Versions {
+		if versions[i], err = c.entryVersion(cfg, &h.Versions[i]); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return versions, nil
+}
+
+// Retention limits the history GC keeps of each file. A version is kept if
+// it is one of the last KeepLast versions, or was written within the last
+// KeepDays days; the latest version is always kept. The zero Retention
+// keeps every version.
+type Retention struct {
+	KeepLast int `json:"keep_last,omitempty"`
+	KeepDays int `json:"keep_days,omitempty"`
+}
+
+func (r *Retention) keepsAll() bool {
+	return r == nil || r.KeepLast <= 0 && r.KeepDays <= 0
+}
+
+// expired returns the versions of h that r doesn't keep, as of now.
+func (r *Retention) expired(h *history, now time.Time) []historyEntry {
+	if r.keepsAll() {
+		return nil
+	}
+	var out []historyEntry
+	n := len(h.Versions)
+	for i, e := range h.Versions {
+		switch {
+		case i == n-1:
+		case r.KeepLast > 0 && i >= n-r.KeepLast:
+		case r.KeepDays > 0 && now.Sub(e.Time) < time.Duration(r.KeepDays)*24*time.Hour:
+		default:
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// SetRetention sets the policy GC prunes history by. nil keeps every
+// version.
+func (c *repo) SetRetention(r *Retention) error {
+	unlock, err := c.Lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cfg, err := c.Config()
+	if err != nil {
+		return err
+	}
+	if r != nil && (r.KeepLast < 0 || r.KeepDays < 0) {
+		return fmt.Errorf("retention can't be negative")
+	}
+	if r.keepsAll() {
+		r = nil
+	}
+	old := cfg.Retention
+	cfg.Retention = r
+	if err := c.writeConfig(cfg); err != nil {
+		cfg.Retention = old
+		return err
+	}
+	return nil
+}
+
+// prune drops the versions the retention policy doesn't keep, releasing
+// their references in tx. A dry run only releases them. It returns the
+// number of versions dropped. A version whose manifest can't be read
+// aborts it, since the references it made can't be released.
+func (c *repo) prune(cfg *Config, tx IndexTx, dryRun bool) (int, error) {
+	if cfg.Retention.keepsAll() {
+		return 0, nil
+	}
+	names, err := c.store.ListManifests("")
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	dropped := 0
+	for _, name := range names {
+		h, err := c.loadHistory(cfg, name)
+		if os.IsNotExist(err) {
+			continue // removed since it was listed
+		}
+		if err != nil {
+			return dropped, err
+		}
+		expired := cfg.Retention.expired(h, now)
+		if len(expired) == 0 {
+			continue
+		}
+		kept := h.Versions[:0:0]
+		for _, e := range h.Versions {
+			if len(expired) > 0 && e.Number == expired[0].Number {
+				expired = expired[1:]
+				refs, err := c.entryRefs(cfg, &e)
+				if err != nil {
+					return dropped, fmt.Errorf("%s@%d: %s", name, e.Number, err)
+				}
+				if err := releaseRefs(tx, refs); err != nil {
+					return dropped, err
+				}
+				dropped++
+				continue
+			}
+			kept = append(kept, e)
+		}
+		if dryRun {
+			continue
+		}
+		if err := c.writeHistory(cfg, name, &history{kept}); err != nil {
+			return dropped, err
+		}
+	}
+	return dropped, nil
+}
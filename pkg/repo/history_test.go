@@ -0,0 +1,166 @@
+package repo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	store := NewMemStore()
+	r := NewWithStore(store)
+	r.Init(nil)
+
+	for i, message := range []string{"first", "", "third"} {
+		content := strings.Repeat(string(rune('a'+i)), 1000)
+		if err := r.AddWithOptions(strings.NewReader(content), "file", &AddOptions{Message: message}); err != nil {
+			t.Fatal("add", err)
+		}
+	}
+	versions, err := r.Log("file")
+	if err != nil {
+		t.Fatal("log", err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("%d versions, want 3", len(versions))
+	}
+	for i, v := range versions {
+		if v.Number != i+1 || v.Time.IsZero() || v.Manifest.Size != 1000 {
+			t.Errorf("version %d: %+v", i+1, v)
+		}
+	}
+	if versions[0].Message != "first" || versions[1].Message != "" {
+		t.Errorf("messages %q, %q", versions[0].Message, versions[1].Message)
+	}
+
+	for name, want := range map[string]string{
+		"file":   strings.Repeat("c", 1000),
+		"file@3": strings.Repeat("c", 1000),
+		"file@1": strings.Repeat("a", 1000),
+	} {
+		var buf bytes.Buffer
+		if err := r.CatFile(name, &buf); err != nil || buf.String() != want {
+			t.Errorf("cat %s: %v", name, err)
+		}
+	}
+	if _, err := r.LoadManifest("file@4"); err == nil {
+		t.Error("loaded a version that doesn't exist")
+	}
+	if names, _ := r.LsFiles("", true); len(names) != 1 {
+		t.Errorf("versions listed as files: %v", names)
+	}
+
+	// Writing the latest version again, as a repeated fetch does, adds
+	// nothing.
+	if err := r.WriteManifest("file", versions[2].Manifest); err != nil {
+		t.Fatal("write manifest", err)
+	}
+	if versions, _ := r.Log("file"); len(versions) != 3 {
+		t.Errorf("rewriting the latest version made %d versions", len(versions))
+	}
+	if err := r.WriteManifest("file@2", versions[0].Manifest); err == nil {
+		t.Error("wrote a particular version")
+	}
+
+	// Dropping old versions never reuses their numbers.
+	if err := r.SetRetention(&Retention{KeepLast: 2}); err != nil {
+		t.Fatal("set retention", err)
+	}
+	if report, err := r.GC(GCOptions{}); err != nil || report.Versions != 1 {
+		t.Fatalf("gc: %+v, %v", report, err)
+	}
+	r.Add(strings.NewReader("d"), "file")
+	versions, _ = r.Log("file")
+	var numbers []int
+	for _, v := range versions {
+		numbers = append(numbers, v.Number)
+	}
+	if len(numbers) != 3 || numbers[0] != 2 || numbers[2] != 4 {
+		t.Errorf("versions %v after pruning, want [2 3 4]", numbers)
+	}
+
+	// A manifest written before histories is its file's only version.
+	store.PutManifest("old", []byte(versions[0].Manifest.Chunks[0]+"\n"))
+	if versions, err := r.Log("old"); err != nil || len(versions) != 1 || versions[0].Number != 1 {
+		t.Errorf("log of an old manifest: %v, %v", versions, err)
+	}
+	if err := r.CatFile("old@1", ioutil.Discard); err != nil {
+		t.Error("cat old@1", err)
+	}
+	// Writing a second version keeps the first.
+	if err := r.WriteManifest("old", versions[1].Manifest); err != nil {
+		t.Fatal("write old", err)
+	}
+	if err := r.CatFile("old@1", ioutil.Discard); err != nil {
+		t.Error("cat old@1 after a second version", err)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	now := time.Now()
+	h := &history{}
+	for i, age := range []int{40, 35, 20, 10, 1} {
+		h.Versions = append(h.Versions, historyEntry{Number: i + 1, Time: now.Add(-time.Duration(age) * 24 * time.Hour)})
+	}
+	for _, test := range []struct {
+		r       *Retention
+		expired []int
+	}{
+		{nil, nil},
+		{&Retention{}, nil},
+		{&Retention{KeepLast: 2}, []int{1, 2, 3}},
+		{&Retention{KeepDays: 30}, []int{1, 2}},
+		{&Retention{KeepLast: 4, KeepDays: 30}, []int{1}},
+		{&Retention{KeepDays: 0, KeepLast: 10}, nil},
+		{&Retention{KeepDays: 1}, []int{1, 2, 3, 4}}, // the latest is always kept
+	} {
+		var got []int
+		for _, e := range test.r.expired(h, now) {
+			got = append(got, e.Number)
+		}
+		if len(got) != len(test.expired) {
+			t.Errorf("%+v expired %v, want %v", test.r, got, test.expired)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.expired[i] {
+				t.Errorf("%+v expired %v, want %v", test.r, got, test.expired)
+				break
+			}
+		}
+	}
+
+	for name, want := range map[string]int{
+		"a@3": 3, "a@b@12": 12, "a": 0, "a@": 0, "a@0": 0, "a@01": 0, "a@+1": 0, "a@-1": 0, "a@x": 0,
+	} {
+		if _, n := splitVersion(name); n != want {
+			t.Errorf("splitVersion(%q) = %d, want %d", name, n, want)
+		}
+	}
+}
+
+// A version to be pruned whose manifest can't be read fails the GC, which
+// changes nothing, rather than leaving its references counted for ever.
+func TestPruneUnreadableVersion(t *testing.T) {
+	store := NewMemStore()
+	r := NewWithStore(store)
+	r.Init(legacyConfig())
+	addFile(t, r, blob1Path, "blob")
+	old, _ := r.Resolve("blob")
+	addFile(t, r, blob2Path, "blob")
+	if err := store.DeleteChunk(old); err != nil {
+		t.Fatal("delete", err)
+	}
+	if err := r.SetRetention(&Retention{KeepLast: 1}); err != nil {
+		t.Fatal("set retention", err)
+	}
+	if _, err := r.GC(GCOptions{}); err == nil || !strings.Contains(err.Error(), "blob@1") {
+		t.Errorf("gc pruning an unreadable version: %v", err)
+	}
+	cfg, _ := r.Config()
+	if h, err := r.(*repo).loadHistory(cfg, "blob"); err != nil || len(h.Versions) != 2 {
+		t.Errorf("failed gc changed the history: %v, %v", h, err)
+	}
+}
@@ -0,0 +1,412 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// IndexEntry is what a reference index records about a chunk.
+type IndexEntry struct {
+	// Refs counts the versions using the chunk, over every name's history:
+	// a name counts once for each of its versions that does, and a version
+	// two names share counts once for each. It is not the number of names.
+	Refs int
+	Size int64 // space the chunk takes in the store
+	// Written is when a chunk no version has used yet was written, for
+	// GC's grace period. It is cleared once a version uses the chunk.
+	Written time.Time
+}
+
+// Indexer is implemented by stores that can keep a reference index: a table
+// of every chunk written, with the number of file versions using it now and
+// its stored size. A chunk is entered with no references as it is written,
+// and chunks no kept version uses any more stay in the index, with no
+// references, until GC deletes them; that is what lets GC find them without
+// reading every manifest, even those an interrupted add wrote and nothing
+// came to use.
+//
+// The index is only changed in transactions, which must exclude each other
+// across every process using the store, so that no update is lost. A Repo
+// updates it before writing a chunk or a manifest, and after versions are
+// pruned or removed, touching only the entries of the chunks concerned. A
+// crash in between leaves it counting too many references, or a chunk that
+// was never written, which keeps entries alive longer than necessary but
+// never loses a chunk. A full GC counts them afresh.
+//
+// Repositories on other stores, such as S3 buckets, keep no index. Nor does
+// a repository created before the index existed, until its first GC. Without
+// one, GC reads every manifest, and queries count references from the
+// manifests.
+type Indexer interface {
+	// UpdateIndex calls f in a read-write transaction, and commits what f
+	// did if it returns nil. If the store has no index, f gets a nil
+	// IndexTx, unless create is set, in which case an empty index is made
+	// for it.
+	UpdateIndex(create bool, f func(IndexTx) error) error
+	// ViewIndex calls f in a read-only transaction, with a nil IndexTx if
+	// the store has no index.
+	ViewIndex(f func(IndexTx) error) error
+	// DropIndex deletes the index, if there is one, so that the next GC
+	// counts every reference afresh.
+	DropIndex() error
+}
+
+// IndexTx is a transaction on a reference index. Entries mustn't be changed
+// from within ForEach or ForEachDead.
+type IndexTx interface {
+	// Get returns a chunk's entry; ok is false if the index has none.
+	Get(hash string) (e IndexEntry, ok bool, err error)
+	Put(hash string, e IndexEntry) error
+	Delete(hash string) error
+	// ForEach calls f for every entry.
+	ForEach(f func(hash string, e IndexEntry) error) error
+	// ForEachDead calls f for every entry with no references. Its work is
+	// in proportion to those, not to the size of the index.
+	ForEachDead(f func(hash string, e IndexEntry) error) error
+	// Clear deletes every entry.
+	Clear() error
+}
+
+// errRollback makes a transaction roll back what it did, as in a dry run.
+var errRollback = errors.New("rolled back")
+
+// recordChunks enters chunks about to be written in the index, with their
+// stored sizes and the time. A chunk no version uses has its time renewed,
+// since something is about to; one in use is left alone.
+func recordChunks(tx IndexTx, sizes map[string]int64, now time.Time) error {
+	for h, size := range sizes {
+		e, ok, err := tx.Get(h)
+		if err != nil {
+			return err
+		}
+		if ok && e.Refs > 0 {
+			continue
+		}
+		if !ok {
+			e.Size = size
+		}
+		e.Written = now
+		if err := tx.Put(h, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkRecorder records chunks in the index before they are written; see
+// putChunk. Chunks written at once, as by the goroutines of an add, are
+// recorded together: whoever commits takes every chunk waiting, and the
+// others find theirs done.
+type chunkRecorder struct {
+	commit sync.Mutex // held while a batch is committed
+	mu     sync.Mutex // guards next
+	next   *chunkBatch
+}
+
+type chunkBatch struct {
+	sizes map[string]int64
+	done  bool // guarded by commit, as is err
+	err   error
+}
+
+func (r *chunkRecorder) record(c *repo, hash string, size int64) error {
+	r.mu.Lock()
+	if r.next == nil {
+		r.next = &chunkBatch{sizes: make(map[string]int64)}
+	}
+	b := r.next
+	b.sizes[hash] = size
+	r.mu.Unlock()
+
+	r.commit.Lock()
+	defer r.commit.Unlock()
+	if !b.done {
+		r.mu.Lock()
+		r.next = nil
+		r.mu.Unlock()
+		b.err = c.updateIndex(false, func(tx IndexTx) error {
+			if tx == nil {
+				return nil
+			}
+			return recordChunks(tx, b.sizes, time.Now())
+		})
+		b.done = true
+	}
+	return b.err
+}
+
+// putChunk writes a chunk to the store, having first entered it in the
+// reference index, if the repository keeps one.
+func (c *repo) putChunk(hash string, stored []byte) error {
+	if _, ok := c.store.(Indexer); ok {
+		if err := c.recorder.record(c, hash, int64(len(stored))); err != nil {
+			return err
+		}
+	}
+	return c.store.PutChunk(hash, stored)
+}
+
+// addRefs counts a reference from a file version made of chunks. size is
+// consulted for chunks the index doesn't have yet.
+func addRefs(tx IndexTx, chunks []string, size func(string) (int64, error)) error {
+	for _, h := range distinct(chunks) {
+		e, ok, err := tx.Get(h)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			n, err := size(h)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			e.Size = n
+		}
+		e.Refs++
+		e.Written = time.Time{}
+		if err := tx.Put(h, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseRefs drops a reference from a file version made of chunks.
+func releaseRefs(tx IndexTx, chunks []string) error {
+	for _, h := range distinct(chunks) {
+		e, ok, err := tx.Get(h)
+		if err != nil {
+			return err
+		}
+		if ok && e.Refs > 0 {
+			e.Refs--
+			if err := tx.Put(h, e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func distinct(hashes []string) []string {
+	seen := make(map[string]bool, len(hashes))
+	var out []string
+	for _, h := range hashes {
+		if !seen[h] {
+			seen[h] = true
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// mapIndex is an IndexTx on a map. If undo is set, it records there the
+// original entry for each hash changed, or nil if there was none, so that
+// the changes can be rolled back.
+type mapIndex struct {
+	entries map[string]IndexEntry
+	undo    map[string]*IndexEntry
+}
+
+func newMapIndex() *mapIndex {
+	return &mapIndex{entries: make(map[string]IndexEntry)}
+}
+
+func (x *mapIndex) Get(hash string) (IndexEntry, bool, error) {
+	e, ok := x.entries[hash]
+	return e, ok, nil
+}
+
+func (x *mapIndex) save(hash string) {
+	if x.undo == nil {
+		return
+	}
+	if _, ok := x.undo[hash]; ok {
+		return
+	}
+	if e, ok := x.entries[hash]; ok {
+		x.undo[hash] = &e
+	} else {
+		x.undo[hash] = nil
+	}
+}
+
+func (x *mapIndex) Put(hash string, e IndexEntry) error {
+	x.save(hash)
+	x.entries[hash] = e
+	return nil
+}
+
+func (x *mapIndex) Delete(hash string) error {
+	x.save(hash)
+	delete(x.entries, hash)
+	return nil
+}
+
+func (x *mapIndex) ForEach(f func(string, IndexEntry) error) error {
+	for h, e := range x.entries {
+		if err := f(h, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *mapIndex) ForEachDead(f func(string, IndexEntry) error) error {
+	return x.ForEach(func(h string, e IndexEntry) error {
+		if e.Refs > 0 {
+			return nil
+		}
+		return f(h, e)
+	})
+}
+
+func (x *mapIndex) Clear() error {
+	for h := range x.entries {
+		x.Delete(h)
+	}
+	return nil
+}
+
+func (x *mapIndex) rollback() {
+	for h, e := range x.undo {
+		if e == nil {
+			delete(x.entries, h)
+		} else {
+			x.entries[h] = *e
+		}
+	}
+	x.undo = nil
+}
+
+// updateIndex calls f in a transaction on the repository's reference index,
+// as Indexer.UpdateIndex does; f gets a nil IndexTx if the store isn't an
+// Indexer.
+func (c *repo) updateIndex(create bool, f func(IndexTx) error) error {
+	if ix, ok := c.store.(Indexer); ok {
+		return ix.UpdateIndex(create, f)
+	}
+	return f(nil)
+}
+
+// dropIndex deletes the repository's reference index, when something
+// written can't be counted. The caller must hold the index lock.
+func (c *repo) dropIndex() error {
+	if ix, ok := c.store.(Indexer); ok {
+		return ix.DropIndex()
+	}
+	return nil
+}
+
+// viewIndex calls f with the repository's reference index, or one counted
+// from the manifests if it doesn't keep one.
+func (c *repo) viewIndex(f func(IndexTx) error) error {
+	view := func(tx IndexTx) error {
+		if tx == nil {
+			idx, err := c.buildIndex()
+			if err != nil {
+				return err
+			}
+			tx = idx
+		}
+		return f(tx)
+	}
+	if ix, ok := c.store.(Indexer); ok {
+		return ix.ViewIndex(view)
+	}
+	return view(nil)
+}
+
+// buildIndex counts references by reading every version of every file.
+func (c *repo) buildIndex() (*mapIndex, error) {
+	cfg, err := c.Config()
+	if err != nil {
+		return nil, err
+	}
+	names, err := c.store.ListManifests("")
+	if err != nil {
+		return nil, err
+	}
+	idx := newMapIndex()
+	for _, name := range names {
+		h, err := c.loadHistory(cfg, name)
+		if os.IsNotExist(err) {
+			continue // removed since it was listed
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range h.Versions {
+			refs, err := c.entryRefs(cfg, &h.Versions[i])
+			if err != nil {
+				return nil, fmt.Errorf("%s@%d: %s", name, h.Versions[i].Number, err)
+			}
+			if err := addRefs(idx, refs, c.store.ChunkSize); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return idx, nil
+}
+
+// Usage describes the space a repository takes up.
+type Usage struct {
+	Files  int
+	Chunks int   // chunks some kept version of a file uses
+	Bytes  int64 // space those take in the store, counting each chunk once
+	// DeadChunks and DeadBytes count chunks no kept version uses any
+	// more, which the next GC will delete.
+	DeadChunks int
+	DeadBytes  int64
+}
+
+// Usage reports how many chunks the repository's files share between them,
+// and the space they take up.
+func (c *repo) Usage() (*Usage, error) {
+	unlock, err := c.readLock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	names, err := c.store.ListManifests("")
+	if err != nil {
+		return nil, err
+	}
+	u := &Usage{Files: len(names)}
+	err = c.viewIndex(func(tx IndexTx) error {
+		return tx.ForEach(func(_ string, e IndexEntry) error {
+			if e.Refs > 0 {
+				u.Chunks++
+				u.Bytes += e.Size
+			} else {
+				u.DeadChunks++
+				u.DeadBytes += e.Size
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// ChunkRefs returns the number of file versions that use a chunk, which
+// isn't the number of names; see IndexEntry.Refs.
+func (c *repo) ChunkRefs(hash string) (int, error) {
+	unlock, err := c.readLock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	var e IndexEntry
+	err = c.viewIndex(func(tx IndexTx) error {
+		e, _, err = tx.Get(hash)
+		return err
+	})
+	return e.Refs, err
+}
@@ -0,0 +1,293 @@
+package repo
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func addFile(t *testing.T, r Repo, path, name string) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal("open", path)
+	}
+	defer f.Close()
+	if err := r.Add(f, name); err != nil {
+		t.Fatal("add", err)
+	}
+}
+
+func TestReferenceIndex(t *testing.T) {
+	store := NewMemStore()
+	r := NewWithStore(store)
+	r.Init(legacyConfig())
+	addFile(t, r, blob1Path, "blob1")
+	addFile(t, r, blob2Path, "blob2")
+	addFile(t, r, blob2Path, "copy")
+
+	// The expected names below are SHA-1 hashes.
+	for hash, want := range map[string]int{
+		"24662838814f422b3050a99575b29a62d8af9e0f": 3, // in every file
+		"270d8cd95b5f56d0153c37c17ba9bda6de181185": 1, // only in blob1
+		"0000000000000000000000000000000000000000": 0,
+	} {
+		if refs, err := r.ChunkRefs(hash); err != nil || refs != want {
+			t.Errorf("ChunkRefs(%s) = %d, %v; want %d", hash, refs, err, want)
+		}
+	}
+	var stored int64
+	hashes, _ := store.ListChunks()
+	for _, h := range hashes {
+		size, _ := store.ChunkSize(h)
+		stored += size
+	}
+	u, err := r.Usage()
+	if err != nil {
+		t.Fatal("usage", err)
+	}
+	// Manifests are chunks too, and blob2 and copy may share one.
+	if u.Files != 3 || u.Chunks != len(hashes) || u.Bytes != stored || u.DeadChunks != 0 {
+		t.Errorf("usage %+v", u)
+	}
+
+	// Replacing blob1 keeps its old version, and so every chunk.
+	addFile(t, r, blob2Path, "blob1")
+	hashes, _ = store.ListChunks()
+	if u, _ := r.Usage(); u.Chunks != len(hashes) || u.DeadChunks != 0 {
+		t.Errorf("after overwrite, usage %+v", u)
+	}
+	if err := r.Rm("copy"); err != nil {
+		t.Fatal("rm", err)
+	}
+	if refs, _ := r.ChunkRefs("24662838814f422b3050a99575b29a62d8af9e0f"); refs != 3 {
+		t.Errorf("after rm, shared chunk has %d references", refs)
+	}
+
+	// Keeping only the latest version lets GC drop the two chunks only the
+	// old blob1 used, and its manifest.
+	if err := r.SetRetention(&Retention{KeepLast: 1}); err != nil {
+		t.Fatal("set retention", err)
+	}
+	report, err := r.GC(GCOptions{})
+	if err != nil {
+		t.Fatal("gc", err)
+	}
+	if report.Versions != 1 || report.Chunks != 3 {
+		t.Errorf("gc dropped %d versions and %d chunks, want 1 and 3", report.Versions, report.Chunks)
+	}
+	if left, _ := store.ListChunks(); len(left) != len(hashes)-3 {
+		t.Errorf("%d chunks left after gc, want %d", len(left), len(hashes)-3)
+	}
+	if refs, _ := r.ChunkRefs("24662838814f422b3050a99575b29a62d8af9e0f"); refs != 2 {
+		t.Errorf("after gc, shared chunk has %d references", refs)
+	}
+
+	c := r.(*repo)
+	kept := make(map[string]IndexEntry)
+	store.(Indexer).ViewIndex(func(tx IndexTx) error {
+		return tx.ForEach(func(h string, e IndexEntry) error {
+			kept[h] = e
+			return nil
+		})
+	})
+	counted, _ := c.buildIndex()
+	if !reflect.DeepEqual(kept, counted.entries) {
+		t.Errorf("index kept as files changed differs from a recount:\n%v\n%v", kept, counted.entries)
+	}
+}
+
+func TestRepoWithoutIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(dir)
+
+	r := New(dir)
+	r.Init(legacyConfig())
+	indexPath := filepath.Join(dir, "metadata", indexFile)
+	if err := os.Remove(indexPath); err != nil {
+		t.Fatal("remove index", err)
+	}
+	addFile(t, r, blob1Path, "blob1")
+	addFile(t, r, blob2Path, "blob2")
+	if _, err := os.Stat(indexPath); !os.IsNotExist(err) {
+		t.Fatal("add created a partial index")
+	}
+
+	if refs, err := r.ChunkRefs("24662838814f422b3050a99575b29a62d8af9e0f"); err != nil || refs != 2 {
+		t.Errorf("ChunkRefs counted from manifests = %d, %v; want 2", refs, err)
+	}
+
+	if err := r.Rm("blob1"); err != nil {
+		t.Fatal("rm", err)
+	}
+	report, err := r.GC(GCOptions{})
+	if err != nil {
+		t.Fatal("gc", err)
+	}
+	if report.Chunks != 3 {
+		t.Errorf("gc removed %d chunks, want blob1's two and its manifest", report.Chunks)
+	}
+	if _, err := os.Stat(indexPath); err != nil {
+		t.Error("gc didn't build an index", err)
+	}
+	if u, _ := r.Usage(); u.Files != 1 || u.Chunks != 4 || u.DeadChunks != 0 {
+		t.Errorf("usage after gc %+v", u)
+	}
+}
+
+func TestDiskIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewDiskStore(dir).(Indexer)
+	written := time.Unix(1500000000, 0)
+	err = s.UpdateIndex(true, func(tx IndexTx) error {
+		tx.Put("aa", IndexEntry{Refs: 2, Size: 10})
+		tx.Put("bb", IndexEntry{Refs: 1, Size: 20})
+		tx.Put("cc", IndexEntry{Size: 30, Written: written})
+		return nil
+	})
+	if err != nil {
+		t.Fatal("update", err)
+	}
+	// A failed transaction changes nothing.
+	failed := errors.New("failed")
+	err = s.UpdateIndex(false, func(tx IndexTx) error {
+		tx.Delete("aa")
+		return failed
+	})
+	if err != failed {
+		t.Fatal("update returned", err)
+	}
+	s.UpdateIndex(false, func(tx IndexTx) error {
+		return tx.Put("bb", IndexEntry{Size: 20})
+	})
+
+	var dead []string
+	all := make(map[string]IndexEntry)
+	err = s.ViewIndex(func(tx IndexTx) error {
+		if tx == nil {
+			return errors.New("no index")
+		}
+		tx.ForEachDead(func(h string, _ IndexEntry) error {
+			dead = append(dead, h)
+			return nil
+		})
+		return tx.ForEach(func(h string, e IndexEntry) error {
+			all[h] = e
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal("view", err)
+	}
+	if !reflect.DeepEqual(dead, []string{"bb", "cc"}) {
+		t.Errorf("dead entries %v, want bb and cc", dead)
+	}
+	want := map[string]IndexEntry{"aa": {Refs: 2, Size: 10}, "bb": {Size: 20}, "cc": {Size: 30, Written: written}}
+	if !reflect.DeepEqual(all, want) {
+		t.Errorf("entries %v, want %v", all, want)
+	}
+}
+
+// failingReader returns an error after reading everything r has.
+type failingReader struct {
+	r io.Reader
+}
+
+func (f failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		err = errors.New("interrupted")
+	}
+	return n, err
+}
+
+// Chunks an add wrote before failing are in the index, so an ordinary GC
+// finds them, and spares them for the grace period.
+func TestOrphanChunks(t *testing.T) {
+	store := NewMemStore()
+	r := NewWithStore(store)
+	// Small chunks, so that some are written before the read fails.
+	cfg := legacyConfig()
+	cfg.MinChunkSize, cfg.AvgChunkSize, cfg.MaxChunkSize = 1<<10, 5<<10, 16<<10
+	if err := r.Init(cfg); err != nil {
+		t.Fatal("init", err)
+	}
+	f, err := os.Open(blob1Path)
+	if err != nil {
+		t.Fatal("open", blob1Path)
+	}
+	defer f.Close()
+	if err := r.Add(failingReader{f}, "blob1"); err == nil {
+		t.Fatal("add didn't fail")
+	}
+	orphans, _ := store.ListChunks()
+	if len(orphans) == 0 {
+		t.Fatal("add wrote no chunks")
+	}
+	if u, err := r.Usage(); err != nil || u.DeadChunks != len(orphans) {
+		t.Errorf("usage %+v, %v; want %d dead chunks", u, err, len(orphans))
+	}
+
+	report, err := r.GC(GCOptions{Grace: time.Hour})
+	if err != nil {
+		t.Fatal("gc", err)
+	}
+	if report.Chunks != 0 || report.Spared != len(orphans) {
+		t.Errorf("fresh orphans weren't spared: %+v", report)
+	}
+	report, err = r.GC(GCOptions{})
+	if err != nil {
+		t.Fatal("gc", err)
+	}
+	if left, _ := store.ListChunks(); report.Chunks != len(orphans) || len(left) != 0 {
+		t.Errorf("gc removed %d of %d orphans", report.Chunks, len(orphans))
+	}
+}
+
+// plainStore hides every optional interface of the store it wraps, as a
+// store that can't keep an index would.
+type plainStore struct {
+	Store
+}
+
+func TestStoreWithoutIndexer(t *testing.T) {
+	store := NewMemStore()
+	r := NewWithStore(plainStore{store})
+	r.Init(legacyConfig())
+	addFile(t, r, blob1Path, "blob1")
+	addFile(t, r, blob2Path, "blob2")
+	if err := store.(Indexer).ViewIndex(func(tx IndexTx) error {
+		if tx != nil {
+			return errors.New("index made")
+		}
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+
+	if refs, err := r.ChunkRefs("24662838814f422b3050a99575b29a62d8af9e0f"); err != nil || refs != 2 {
+		t.Errorf("ChunkRefs = %d, %v; want 2", refs, err)
+	}
+	if err := r.Rm("blob1"); err != nil {
+		t.Fatal("rm", err)
+	}
+	report, err := r.GC(GCOptions{})
+	if err != nil {
+		t.Fatal("gc", err)
+	}
+	if report.Chunks != 3 {
+		t.Errorf("gc removed %d chunks, want blob1's two and its manifest", report.Chunks)
+	}
+}
@@ -0,0 +1,306 @@
+package repo
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// LockWait is how long operations wait for the repository lock before
+// giving up with a *LockTimeoutError. Zero means don't wait at all.
+var LockWait = 5 * time.Minute
+
+const (
+	// lockRefresh is how often a held lock file is rewritten, so that
+	// other hosts can tell it is still in use.
+	lockRefresh = time.Minute
+	// lockStale is how long a lock file can go without being refreshed
+	// before it is assumed to be abandoned.
+	lockStale = 10 * time.Minute
+)
+
+// The locks a Repo takes. When both are held, the repository lock is taken
+// first.
+const (
+	repoLock  = "repo"
+	indexLock = "index"
+)
+
+// Locker is implemented by stores that can coordinate several processes
+// using them at once. Each named lock is independent. Any number of shared
+// locks on a name can be held together, but an exclusive lock excludes
+// every other lock on it. Lock waits up to wait for the lock, and returns
+// a function that releases it.
+//
+// A Repo takes the "repo" lock shared to add, read or remove files, and
+// exclusive to collect garbage, so that it can't delete chunks an add in
+// progress has written but not yet referenced. It takes the "index" lock
+// exclusive to update a file's history along with the reference index.
+//
+// Stores that aren't Lockers, such as S3 buckets, are only locked against
+// other users of the same Repo value. Nothing stops a GC in one process
+// from deleting chunks an add in another has written but not yet
+// referenced, beyond the grace period GC gives new chunks.
+type Locker interface {
+	Lock(name string, exclusive bool, wait time.Duration) (unlock func(), err error)
+}
+
+// LockInfo describes the holder of a lock.
+type LockInfo struct {
+	Exclusive bool      `json:"exclusive"`
+	Hostname  string    `json:"hostname"`
+	PID       int       `json:"pid"`
+	Time      time.Time `json:"time"` // when the lock was last refreshed
+}
+
+func (l *LockInfo) String() string {
+	kind := "shared"
+	if l.Exclusive {
+		kind = "exclusive"
+	}
+	return fmt.Sprintf("%s lock held by pid %d on %s", kind, l.PID, l.Hostname)
+}
+
+// stale reports whether the lock's holder has gone away: it was a process
+// on this host that no longer exists, or it hasn't refreshed the lock in
+// a long time.
+func (l *LockInfo) stale(hostname string) bool {
+	if l.Hostname == hostname && !processExists(l.PID) {
+		return true
+	}
+	return time.Since(l.Time) > lockStale
+}
+
+// LockTimeoutError is returned when a lock couldn't be acquired in time.
+type LockTimeoutError struct {
+	Holder string
+}
+
+func (e *LockTimeoutError) Error() string {
+	return "timed out waiting for the repository lock: " + e.Holder
+}
+
+// retryLock calls try until it succeeds, or wait has passed, backing off
+// between attempts. try returns a description of the conflicting lock
+// holder, or "" once it has the lock.
+func retryLock(wait time.Duration, try func() (string, error)) error {
+	deadline := time.Now().Add(wait)
+	delay := 10 * time.Millisecond
+	for {
+		holder, err := try()
+		if err != nil {
+			return err
+		}
+		if holder == "" {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return &LockTimeoutError{Holder: holder}
+		}
+		// Randomness breaks ties between two lockers backing off from each
+		// other.
+		b, _ := randomBytes(1)
+		sleep := delay + delay*time.Duration(b[0])/256
+		if remaining := time.Until(deadline); sleep > remaining {
+			sleep = remaining
+		}
+		time.Sleep(sleep)
+		if delay < time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// Lock takes a lock by writing a file describing it under locks/<name>/,
+// and then checking that no conflicting lock file exists. Conflicting lock
+// files that have gone stale are removed. Lock files aren't synced: one
+// only has to outlast its holder, which a crash ends too.
+func (s *diskStore) Lock(name string, exclusive bool, wait time.Duration) (func(), error) {
+	dir := filepath.Join(s.path, "locks", name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	b, err := randomBytes(8)
+	if err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(b)
+	path := filepath.Join(dir, id)
+	info := LockInfo{Exclusive: exclusive, Hostname: hostname, PID: os.Getpid()}
+	write := func() error {
+		info.Time = time.Now()
+		data, err := json.Marshal(&info)
+		if err != nil {
+			return err
+		}
+		return writeFile(path, data, 0660, false)
+	}
+
+	err = retryLock(wait, func() (string, error) {
+		if err := write(); err != nil {
+			return "", err
+		}
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			os.Remove(path)
+			return "", err
+		}
+		for _, fi := range fis {
+			if fi.Name() == id || isTemp(fi.Name()) {
+				continue
+			}
+			other := filepath.Join(dir, fi.Name())
+			var held LockInfo
+			data, err := ioutil.ReadFile(other)
+			if err != nil || json.Unmarshal(data, &held) != nil {
+				continue // released as we looked, or still being written
+			}
+			if held.stale(hostname) {
+				os.Remove(other)
+				continue
+			}
+			if exclusive || held.Exclusive {
+				os.Remove(path)
+				return held.String(), nil
+			}
+		}
+		return "", nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The refresher is stopped before the file is removed, so that it
+	// can't write the file back after.
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(lockRefresh)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				write()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+			os.Remove(path)
+		})
+	}, nil
+}
+
+// rwLock is a lock with a timeout, for coordinating users of one process.
+// Its state is the number of shared holders, or -1 while it is held
+// exclusive, and is passed through a channel so that whoever has taken it
+// out has it to themselves.
+type rwLock struct {
+	state chan int
+}
+
+func newRWLock() *rwLock {
+	l := &rwLock{state: make(chan int, 1)}
+	l.state <- 0
+	return l
+}
+
+func (l *rwLock) Lock(exclusive bool, wait time.Duration) (func(), error) {
+	err := retryLock(wait, func() (string, error) {
+		if l.try(exclusive) {
+			return "", nil
+		}
+		return "lock held within this process", nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	return func() { once.Do(func() { l.release(exclusive) }) }, nil
+}
+
+// try takes the lock if nothing conflicting holds it, and reports whether
+// it did.
+func (l *rwLock) try(exclusive bool) bool {
+	n := <-l.state
+	ok := n == 0 || !exclusive && n > 0
+	if ok && exclusive {
+		n = -1
+	} else if ok {
+		n++
+	}
+	l.state <- n
+	return ok
+}
+
+func (l *rwLock) release(exclusive bool) {
+	n := <-l.state
+	if exclusive {
+		n = 0
+	} else {
+		n--
+	}
+	l.state <- n
+}
+
+// lockSet holds a process's named rwLocks.
+type lockSet struct {
+	mu    sync.Mutex
+	locks map[string]*rwLock
+}
+
+func (s *lockSet) Lock(name string, exclusive bool, wait time.Duration) (func(), error) {
+	s.mu.Lock()
+	if s.locks == nil {
+		s.locks = make(map[string]*rwLock)
+	}
+	l := s.locks[name]
+	if l == nil {
+		l = newRWLock()
+		s.locks[name] = l
+	}
+	s.mu.Unlock()
+	return l.Lock(exclusive, wait)
+}
+
+// Lock takes the repository lock. Only top-level operations take it, so
+// that they can call each other's parts freely; holding a lock while
+// calling one of them that takes a conflicting lock waits for LockWait
+// and then fails.
+func (c *repo) Lock(exclusive bool) (func(), error) {
+	return c.lock(repoLock, exclusive)
+}
+
+// readLock takes the repository lock shared for an operation that only
+// reads, so that GC can't remove chunks from under it. It is best-effort:
+// if the lock can't be taken at all, as on a read-only mount, the read goes
+// ahead without it, and at worst fails part way should GC run meanwhile.
+// Only timing out behind an exclusive holder is an error.
+func (c *repo) readLock() (func(), error) {
+	unlock, err := c.Lock(false)
+	if _, ok := err.(*LockTimeoutError); ok {
+		return nil, err
+	}
+	if err != nil {
+		return func() {}, nil
+	}
+	return unlock, nil
+}
+
+func (c *repo) lock(name string, exclusive bool) (func(), error) {
+	if l, ok := c.store.(Locker); ok {
+		return l.Lock(name, exclusive, LockWait)
+	}
+	return c.localLocks.Lock(name, exclusive, LockWait)
+}
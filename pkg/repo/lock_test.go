@@ -0,0 +1,183 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDiskLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(dir)
+	testLocker(t, NewDiskStore(dir).(Locker))
+	if fis, _ := ioutil.ReadDir(filepath.Join(dir, "locks", "repo")); len(fis) != 0 {
+		t.Errorf("%d lock files left behind", len(fis))
+	}
+}
+
+func TestLocalLock(t *testing.T) {
+	testLocker(t, &lockSet{})
+}
+
+func testLocker(t *testing.T, s Locker) {
+	unlock1, err := s.Lock("repo", false, 0)
+	if err != nil {
+		t.Fatal("shared lock", err)
+	}
+	unlock2, err := s.Lock("repo", false, 0)
+	if err != nil {
+		t.Fatal("second shared lock", err)
+	}
+	if _, err := s.Lock("repo", true, 50*time.Millisecond); err == nil {
+		t.Fatal("exclusive lock granted alongside shared ones")
+	} else if _, ok := err.(*LockTimeoutError); !ok {
+		t.Fatalf("expected a LockTimeoutError, got %v", err)
+	}
+	unlock1()
+	unlock2()
+
+	unlockX, err := s.Lock("repo", true, 0)
+	if err != nil {
+		t.Fatal("exclusive lock", err)
+	}
+	if _, err := s.Lock("repo", false, 0); err == nil {
+		t.Fatal("shared lock granted alongside an exclusive one")
+	}
+	unlockX()
+	unlockX() // releasing twice is harmless
+	unlock, err := s.Lock("repo", false, 0)
+	if err != nil {
+		t.Fatal("shared lock after release", err)
+	}
+	unlock()
+}
+
+func TestStaleLocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(dir)
+	s := NewDiskStore(dir).(Locker)
+	hostname, _ := os.Hostname()
+
+	writeLock := func(name string, info LockInfo) {
+		os.MkdirAll(filepath.Join(dir, "locks", "repo"), 0755)
+		data, _ := json.Marshal(&info)
+		ioutil.WriteFile(filepath.Join(dir, "locks", "repo", name), data, 0660)
+	}
+
+	// A process that no longer exists on this host.
+	writeLock("dead", LockInfo{Exclusive: true, Hostname: hostname, PID: 1 << 30, Time: time.Now()})
+	unlock, err := s.Lock("repo", true, 0)
+	if err != nil {
+		t.Fatal("lock held by a dead process wasn't broken:", err)
+	}
+	unlock()
+
+	// A process on another host that stopped refreshing its lock.
+	writeLock("old", LockInfo{Exclusive: true, Hostname: "elsewhere", PID: 1, Time: time.Now().Add(-2 * lockStale)})
+	unlock, err = s.Lock("repo", false, 0)
+	if err != nil {
+		t.Fatal("abandoned lock wasn't broken:", err)
+	}
+	unlock()
+
+	// A live process on another host.
+	writeLock("live", LockInfo{Exclusive: true, Hostname: "elsewhere", PID: 1, Time: time.Now()})
+	if _, err := s.Lock("repo", false, 0); err == nil {
+		t.Fatal("lock held on another host was broken")
+	}
+}
+
+// GC running alongside adds must never remove chunks the adds go on to
+// reference.
+func TestConcurrentAddAndGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(dir)
+	New(dir).Init(nil)
+
+	data, err := ioutil.ReadFile(blob1Path)
+	if err != nil {
+		t.Fatal("read blob1")
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 5; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			// Each add gets a Repo of its own, as separate processes would.
+			errs <- New(dir).Add(bytes.NewReader(data), fmt.Sprintf("blob%d", i))
+		}(i)
+		go func() {
+			defer wg.Done()
+			_, err := New(dir).GC(GCOptions{})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := New(dir).Verify(false)
+	if err != nil {
+		t.Fatal("verify", err)
+	}
+	if !report.OK() || len(report.Manifests) != 5 {
+		t.Errorf("repository damaged by concurrent gc: %+v", report)
+	}
+}
+
+// unlockable is a store whose locks fail, as on a read-only mount, or time
+// out.
+type unlockable struct {
+	Store
+	err error
+}
+
+func (s unlockable) Lock(name string, exclusive bool, wait time.Duration) (func(), error) {
+	return nil, s.err
+}
+
+func TestReadsWithoutLocks(t *testing.T) {
+	store := NewMemStore()
+	r := NewWithStore(store)
+	r.Init(nil)
+	r.Add(bytes.NewReader([]byte("data")), "file")
+
+	readOnly := NewWithStore(unlockable{store, &os.PathError{Op: "mkdir", Path: "locks", Err: syscall.EROFS}})
+	var buf bytes.Buffer
+	if err := readOnly.CatFile("file", &buf); err != nil || buf.String() != "data" {
+		t.Errorf("cat where locks can't be written: %q, %v", buf.String(), err)
+	}
+	if _, err := readOnly.Log("file"); err != nil {
+		t.Error("log where locks can't be written:", err)
+	}
+	if err := readOnly.Add(bytes.NewReader([]byte("more")), "other"); err == nil {
+		t.Error("added where locks can't be written")
+	}
+
+	busy := NewWithStore(unlockable{store, &LockTimeoutError{Holder: "gc"}})
+	if err := busy.CatFile("file", ioutil.Discard); err == nil {
+		t.Error("cat went ahead of a GC holding the lock")
+	}
+}
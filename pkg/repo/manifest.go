@@ -1,13 +1,166 @@
 package repo
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
 	"strings"
+	"time"
 )
 
-type manifest struct {
-	chunks []string
+// ManifestVersion is the manifest format Add writes.
+const ManifestVersion = 2
+
+// Manifest is the ordered list of chunk hashes that make up a file, along
+// with what is known about the file as a whole.
+//
+// Manifests come in two formats. Version 1, which is all that older
+// repositories have, is just the chunk hashes, one per line, and records
+// nothing else. Version 2 is a JSON object recording each chunk's length
+// too, along with the fields below. A manifest is written back out in the
+// format it was read in, byte for byte, since signatures cover it.
+type Manifest struct {
+	// Version is the manifest's format. Zero means version 1.
+	Version int
+
+	Chunks []string
+	// Sizes holds the length of each chunk's contents, or is nil if the
+	// manifest doesn't record them.
+	Sizes []int64
+
+	// The rest are only recorded by version 2.
+	Size    int64     // length of the file
+	Digest  string    // "<hash>:<hex>", the hash of the whole file
+	Created time.Time // when the file was added
+	Mode    os.FileMode
+	ModTime time.Time         // zero if not recorded
+	Meta    map[string]string // free-form, given when the file was added
+}
+
+// manifestJSON is the encoding of a version 2 manifest.
+type manifestJSON struct {
+	Version int               `json:"version"`
+	Size    int64             `json:"size"`
+	Digest  string            `json:"digest"`
+	Created time.Time         `json:"created"`
+	Mode    os.FileMode       `json:"mode,omitempty"`
+	ModTime *time.Time        `json:"mtime,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	Chunks  []chunkJSON       `json:"chunks"`
+}
+
+type chunkJSON struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// ParseManifest decodes a manifest in either format. Manifests may come
+// from a remote, so every hash is checked to be one, and every size to add
+// up.
+func ParseManifest(data []byte) (*Manifest, error) {
+	if isManifestJSON(data) {
+		return parseManifestJSON(data)
+	}
+
+	var hashes []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		if !ValidHash(line) {
+			return nil, fmt.Errorf("malformed manifest line %q", line)
+		}
+		hashes = append(hashes, line)
+	}
+	return &Manifest{Version: 1, Chunks: hashes}, nil
+}
+
+// isManifestJSON reports whether data is a manifest of version 2 or later.
+func isManifestJSON(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+func parseManifestJSON(data []byte) (*Manifest, error) {
+	var mj manifestJSON
+	if err := json.Unmarshal(data, &mj); err != nil {
+		return nil, fmt.Errorf("malformed manifest: %s", err)
+	}
+	if mj.Version != 2 {
+		return nil, fmt.Errorf("unsupported manifest version %d", mj.Version)
+	}
+	m := &Manifest{
+		Version: mj.Version,
+		Chunks:  make([]string, len(mj.Chunks)),
+		Sizes:   make([]int64, len(mj.Chunks)),
+		Size:    mj.Size,
+		Digest:  mj.Digest,
+		Created: mj.Created,
+		Mode:    mj.Mode,
+		Meta:    mj.Meta,
+	}
+	if mj.ModTime != nil {
+		m.ModTime = *mj.ModTime
+	}
+	var total int64
+	for i, c := range mj.Chunks {
+		if !ValidHash(c.Hash) {
+			return nil, fmt.Errorf("malformed manifest chunk %q", c.Hash)
+		}
+		if c.Size < 0 {
+			return nil, fmt.Errorf("manifest chunk %s has negative size", c.Hash)
+		}
+		m.Chunks[i], m.Sizes[i] = c.Hash, c.Size
+		total += c.Size
+	}
+	if total != m.Size {
+		return nil, fmt.Errorf("manifest chunks add up to %d bytes, not %d", total, m.Size)
+	}
+	return m, nil
+}
+
+func (m *Manifest) validate() error {
+	if m.Version >= 2 && len(m.Sizes) != len(m.Chunks) {
+		return fmt.Errorf("manifest has %d chunks but %d sizes", len(m.Chunks), len(m.Sizes))
+	}
+	if m.Version > ManifestVersion {
+		return fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	return nil
+}
+
+func (m *Manifest) String() string {
+	if m.Version < 2 {
+		return strings.Join(m.Chunks, "\n") + "\n"
+	}
+	mj := manifestJSON{
+		Version: m.Version,
+		Size:    m.Size,
+		Digest:  m.Digest,
+		Created: m.Created,
+		Mode:    m.Mode,
+		Meta:    m.Meta,
+		Chunks:  make([]chunkJSON, len(m.Chunks)),
+	}
+	if !m.ModTime.IsZero() {
+		mj.ModTime = &m.ModTime
+	}
+	for i, h := range m.Chunks {
+		mj.Chunks[i] = chunkJSON{Hash: h, Size: m.Sizes[i]}
+	}
+	data, err := json.Marshal(&mj)
+	if err != nil {
+		panic(err) // nothing in a manifestJSON can fail to marshal
+	}
+	return string(data) + "\n"
 }
 
-func (m *manifest) String() string {
-	return strings.Join(m.chunks, "\n") + "\n"
+// ValidHash reports whether h looks like a chunk hash.
+func ValidHash(h string) bool {
+	if len(h) < 2 || strings.ToLower(h) != h {
+		return false
+	}
+	_, err := hex.DecodeString(h)
+	return err == nil
 }
@@ -0,0 +1,94 @@
+package repo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/burke/rabit/pkg/digest"
+)
+
+func TestManifestFormats(t *testing.T) {
+	v1 := "24662838814f422b3050a99575b29a62d8af9e0f\n270d8cd95b5f56d0153c37c17ba9bda6de181185\n"
+	v2 := `{"version":2,"size":7,"digest":"sha1:00","created":"2015-11-24T00:00:00Z","mode":420,` +
+		`"mtime":"2015-11-23T12:00:00-05:00","meta":{"a":"b"},"chunks":[` +
+		`{"hash":"24662838814f422b3050a99575b29a62d8af9e0f","size":3},` +
+		`{"hash":"270d8cd95b5f56d0153c37c17ba9bda6de181185","size":4}]}` + "\n"
+
+	for _, data := range []string{v1, v2} {
+		m, err := ParseManifest([]byte(data))
+		if err != nil {
+			t.Fatalf("parse %q: %v", data, err)
+		}
+		if len(m.Chunks) != 2 {
+			t.Errorf("parsed %d chunks", len(m.Chunks))
+		}
+		if m.String() != data {
+			t.Errorf("manifest didn't round-trip:\n%s\n%s", data, m.String())
+		}
+	}
+
+	m, _ := ParseManifest([]byte(v2))
+	if !reflect.DeepEqual(m.Sizes, []int64{3, 4}) || m.Mode != 0644 || m.Meta["a"] != "b" {
+		t.Errorf("parsed %+v", m)
+	}
+
+	for _, bad := range []string{
+		strings.Replace(v2, `"size":7`, `"size":8`, 1),
+		strings.Replace(v2, `"size":4`, `"size":-1`, 1),
+		strings.Replace(v2, `"version":2`, `"version":3`, 1),
+		strings.Replace(v2, `"hash":"2466`, `"hash":"xx`, 1),
+		`{"version":2`,
+	} {
+		if _, err := ParseManifest([]byte(bad)); err == nil {
+			t.Errorf("parsed bad manifest %q", bad)
+		}
+	}
+}
+
+func TestAddRecordsFileDetails(t *testing.T) {
+	want, err := ioutil.ReadFile(blob1Path)
+	if err != nil {
+		t.Fatal("read blob1")
+	}
+	r := NewWithStore(NewMemStore())
+	r.Init(nil)
+	mtime := time.Date(2015, 11, 24, 0, 0, 0, 0, time.UTC)
+	opts := &AddOptions{Mode: 0755, ModTime: mtime, Meta: map[string]string{"build": "42"}}
+	before := time.Now().Add(-time.Second)
+	if err := r.AddWithOptions(bytes.NewReader(want), "blob1", opts); err != nil {
+		t.Fatal("add", err)
+	}
+
+	m, err := r.LoadManifest("blob1")
+	if err != nil {
+		t.Fatal("load manifest", err)
+	}
+	if m.Version != ManifestVersion || m.Size != int64(len(want)) || len(m.Sizes) != len(m.Chunks) {
+		t.Errorf("manifest %+v", m)
+	}
+	var offset int64
+	for i, h := range m.Chunks {
+		data, _ := r.ReadChunk(h)
+		if !bytes.Equal(data, want[offset:offset+m.Sizes[i]]) {
+			t.Errorf("chunk %d isn't the %d bytes at %d", i, m.Sizes[i], offset)
+		}
+		offset += m.Sizes[i]
+	}
+	if m.Digest != "sha256:"+digest.Sum(digest.SHA256, want) {
+		t.Errorf("digest %s", m.Digest)
+	}
+	if m.Created.Before(before) || m.Created.After(time.Now()) {
+		t.Errorf("created %s", m.Created)
+	}
+	if m.Mode != 0755 || !m.ModTime.Equal(mtime) || m.Meta["build"] != "42" {
+		t.Errorf("options not recorded: %+v", m)
+	}
+
+	if err := r.WriteManifest("bad", &Manifest{Version: 2, Chunks: m.Chunks}); err == nil {
+		t.Error("wrote a version 2 manifest without chunk sizes")
+	}
+}
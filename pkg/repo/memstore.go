@@ -0,0 +1,194 @@
+package repo
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// memStore keeps everything in maps. It is meant for tests and for
+// short-lived repositories that never need to touch disk.
+type memStore struct {
+	locks     lockSet
+	mu        sync.RWMutex
+	chunks    map[string][]byte
+	manifests map[string][]byte
+	metadata  map[string][]byte
+
+	indexMu sync.Mutex
+	index   map[string]IndexEntry // nil until made
+}
+
+// NewMemStore returns an empty in-memory Store.
+func NewMemStore() Store {
+	return &memStore{
+		chunks:    make(map[string][]byte),
+		manifests: make(map[string][]byte),
+		metadata:  make(map[string][]byte),
+	}
+}
+
+func (s *memStore) Init() error {
+	return nil
+}
+
+func (s *memStore) Lock(name string, exclusive bool, wait time.Duration) (func(), error) {
+	return s.locks.Lock(name, exclusive, wait)
+}
+
+func (s *memStore) UpdateIndex(create bool, f func(IndexTx) error) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	made := false
+	if s.index == nil {
+		if !create {
+			return f(nil)
+		}
+		s.index, made = make(map[string]IndexEntry), true
+	}
+	tx := &mapIndex{entries: s.index, undo: make(map[string]*IndexEntry)}
+	if err := f(tx); err != nil {
+		tx.rollback()
+		if made {
+			s.index = nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *memStore) ViewIndex(f func(IndexTx) error) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	if s.index == nil {
+		return f(nil)
+	}
+	return f(&mapIndex{entries: s.index})
+}
+
+func (s *memStore) DropIndex() error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	s.index = nil
+	return nil
+}
+
+func (s *memStore) get(m map[string][]byte, op, key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := m[key]
+	if !ok {
+		return nil, notExist(op, key)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (s *memStore) put(m map[string][]byte, key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *memStore) has(m map[string][]byte, key string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := m[key]
+	return ok, nil
+}
+
+func (s *memStore) delete(m map[string][]byte, op, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := m[key]; !ok {
+		return notExist(op, key)
+	}
+	delete(m, key)
+	return nil
+}
+
+func (s *memStore) list(m map[string][]byte) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (s *memStore) GetChunk(hash string) ([]byte, error) {
+	return s.get(s.chunks, "get chunk", hash)
+}
+
+func (s *memStore) ChunkHeader(hash string, n int) ([]byte, error) {
+	data, err := s.get(s.chunks, "get chunk", hash)
+	if err != nil || len(data) <= n {
+		return data, err
+	}
+	return data[:n], nil
+}
+
+func (s *memStore) PutChunk(hash string, data []byte) error {
+	return s.put(s.chunks, hash, data)
+}
+
+func (s *memStore) HasChunk(hash string) (bool, error) {
+	return s.has(s.chunks, hash)
+}
+
+func (s *memStore) ChunkSize(hash string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.chunks[hash]
+	if !ok {
+		return 0, notExist("stat chunk", hash)
+	}
+	return int64(len(data)), nil
+}
+
+func (s *memStore) DeleteChunk(hash string) error {
+	return s.delete(s.chunks, "delete chunk", hash)
+}
+
+func (s *memStore) ListChunks() ([]string, error) {
+	return s.list(s.chunks)
+}
+
+func (s *memStore) GetManifest(name string) ([]byte, error) {
+	return s.get(s.manifests, "get manifest", name)
+}
+
+func (s *memStore) PutManifest(name string, data []byte) error {
+	return s.put(s.manifests, name, data)
+}
+
+func (s *memStore) HasManifest(name string) (bool, error) {
+	return s.has(s.manifests, name)
+}
+
+func (s *memStore) DeleteManifest(name string) error {
+	return s.delete(s.manifests, "delete manifest", name)
+}
+
+func (s *memStore) ListManifests(dir string) ([]string, error) {
+	names, err := s.list(s.manifests)
+	if dir == "" || err != nil {
+		return names, err
+	}
+	var under []string
+	for _, name := range names {
+		if strings.HasPrefix(name, dir+"/") {
+			under = append(under, name)
+		}
+	}
+	return under, nil
+}
+
+func (s *memStore) GetMetadata(name string) ([]byte, error) {
+	return s.get(s.metadata, "get metadata", name)
+}
+
+func (s *memStore) PutMetadata(name string, data []byte) error {
+	return s.put(s.metadata, name, data)
+}
@@ -0,0 +1,46 @@
+package repo
+
+import (
+	"fmt"
+	"io"
+)
+
+// Migrate copies every file in src into dst, which must already be
+// initialized, with every version of each kept in its history. Files are
+// re-chunked and re-hashed according to dst's configuration, so this is
+// how a repository moves to a different hash function or chunker. What
+// manifests record about each file, and each version's message, are
+// carried over; when each was added is not. Signed metadata is not copied,
+// since it covers manifests that no longer exist in the new form.
+func Migrate(src, dst Repo) error {
+	names, err := src.LsFiles("", true)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		versions, err := src.Log(name)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		for _, v := range versions {
+			if err := migrateVersion(src, dst, name, v); err != nil {
+				return fmt.Errorf("%s@%d: %s", name, v.Number, err)
+			}
+		}
+	}
+	return nil
+}
+
+func migrateVersion(src, dst Repo, name string, v Version) error {
+	m := v.Manifest
+	opts := &AddOptions{Mode: m.Mode, ModTime: m.ModTime, Meta: m.Meta, Message: v.Message}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(src.CatFile(fmt.Sprintf("%s@%d", name, v.Number), pw))
+	}()
+	if err := dst.AddWithOptions(pr, name, opts); err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package repo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ValidName checks that name can name a file. Names are slash-separated
+// paths, like "builds/v1/app.img", which disk stores keep in nested
+// directories. They must be relative, and no element may be empty, "." or
+// "..", so that no name can point outside the repository.
+func ValidName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty name")
+	}
+	if strings.ContainsAny(name, "\\\x00\n") {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	for _, elem := range strings.Split(name, "/") {
+		switch elem {
+		case "", ".", "..":
+			return fmt.Errorf("invalid name %q", name)
+		}
+		if isTemp(elem) {
+			return fmt.Errorf("invalid name %q: %q is reserved", name, tempPrefix)
+		}
+	}
+	return nil
+}
+
+// checkParents makes sure no directory name would need is a file already,
+// and, if name is new, that it isn't a directory already. The caller must
+// hold the index lock, so that no other name is made meanwhile that would
+// conflict.
+func (c *repo) checkParents(name string) error {
+	for i := range name {
+		if name[i] != '/' {
+			continue
+		}
+		parent := name[:i]
+		if ok, err := c.store.HasManifest(parent); err != nil {
+			return err
+		} else if ok {
+			return fmt.Errorf("%s: %s is a file, not a directory", name, parent)
+		}
+	}
+	if ok, err := c.store.HasManifest(name); err != nil || ok {
+		return err
+	}
+	names, err := c.store.ListManifests(name)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("%s is a directory, holding %s", name, names[0])
+	}
+	return nil
+}
+
+// LsFiles lists the files under the directory prefix, or every file if
+// prefix is empty. Unless recursive is set, it lists only what is directly
+// inside the directory, and gives each subdirectory once, as "<dir>/".
+// Names come back in full, and sorted.
+func (c *repo) LsFiles(prefix string, recursive bool) ([]string, error) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix != "" {
+		if err := ValidName(prefix); err != nil {
+			return nil, err
+		}
+	}
+	names, err := c.store.ListManifests(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	var out []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !recursive {
+			if i := strings.Index(name[len(prefix):], "/"); i >= 0 {
+				name = name[:len(prefix)+i+1]
+			}
+		}
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
@@ -0,0 +1,135 @@
+package repo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidName(t *testing.T) {
+	for name, ok := range map[string]bool{
+		"app.img":             true,
+		"builds/v1/app.img":   true,
+		"release/stable":      true,
+		"a@3":                 true,
+		"":                    false,
+		"/etc/passwd":         false,
+		"builds/":             false,
+		"builds//app.img":     false,
+		"../config.json":      false,
+		"builds/../../x":      false,
+		"./app.img":           false,
+		"builds\\app.img":     false,
+		"builds/.tmp-1234":    false,
+		"line\nbreak":         false,
+		"nul\x00":             false,
+		"builds/v1/app.img/.": false,
+	} {
+		if err := ValidName(name); (err == nil) != ok {
+			t.Errorf("ValidName(%q) = %v", name, err)
+		}
+	}
+}
+
+func TestHierarchicalNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(dir)
+
+	r := New(dir)
+	r.Init(nil)
+	for _, name := range []string{"builds/v1/app.img", "builds/v1/lib.so", "builds/v2/app.img", "builds/README", "top"} {
+		if err := r.Add(strings.NewReader(name), name); err != nil {
+			t.Fatal("add", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "manifests", "builds", "v1", "app.img")); err != nil {
+		t.Error("manifest not stored in a nested directory", err)
+	}
+	if m, err := r.LoadManifest("builds/v1/app.img"); err != nil || m.Size != int64(len("builds/v1/app.img")) {
+		t.Errorf("load nested manifest: %v", err)
+	}
+
+	for _, test := range []struct {
+		prefix    string
+		recursive bool
+		want      []string
+	}{
+		{"", false, []string{"builds/", "top"}},
+		{"builds", false, []string{"builds/README", "builds/v1/", "builds/v2/"}},
+		{"builds/", true, []string{"builds/README", "builds/v1/app.img", "builds/v1/lib.so", "builds/v2/app.img"}},
+		{"builds/v1", false, []string{"builds/v1/app.img", "builds/v1/lib.so"}},
+		{"nothing", true, nil},
+	} {
+		names, err := r.LsFiles(test.prefix, test.recursive)
+		if err != nil || !reflect.DeepEqual(names, test.want) {
+			t.Errorf("LsFiles(%q, %v) = %v, %v; want %v", test.prefix, test.recursive, names, err, test.want)
+		}
+	}
+	if _, err := r.LsFiles("../", true); err == nil {
+		t.Error("listed outside the repository")
+	}
+
+	for _, name := range []string{"../metadata/config.json", "/etc/passwd", "builds/../top"} {
+		if err := r.Add(strings.NewReader("x"), name); err == nil {
+			t.Errorf("added %q", name)
+		}
+		if err := r.CatFile(name, ioutil.Discard); err == nil || os.IsNotExist(err) {
+			t.Errorf("cat %q: %v", name, err)
+		}
+	}
+	if err := r.Add(strings.NewReader("x"), "top/below"); err == nil {
+		t.Error("added a file under another file")
+	}
+	for _, name := range []string{"builds", "builds/v1"} {
+		if err := r.Add(strings.NewReader("x"), name); err == nil {
+			t.Errorf("added a file over the directory %s", name)
+		}
+	}
+	mem := NewWithStore(NewMemStore())
+	mem.Init(nil)
+	mem.Add(strings.NewReader("x"), "a/b")
+	if err := mem.Add(strings.NewReader("x"), "a"); err == nil {
+		t.Error("added a file over a directory in a store without directories")
+	}
+
+	if err := r.Rm("builds/v2/app.img"); err != nil {
+		t.Fatal("rm", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "manifests", "builds", "v2")); !os.IsNotExist(err) {
+		t.Error("rm left an empty directory behind")
+	}
+	if err := r.Rm("builds/v1"); !os.IsNotExist(err) {
+		t.Errorf("rm of a directory: %v", err)
+	}
+}
+
+// A file and a directory of the same name, added at once, can't both be
+// made.
+func TestConcurrentFileAndDirectory(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		r := NewWithStore(NewMemStore())
+		r.Init(nil)
+		errs := make(chan error, 2)
+		for _, name := range []string{"x", "x/y"} {
+			go func(name string) {
+				errs <- r.Add(strings.NewReader(name), name)
+			}(name)
+		}
+		failed := 0
+		for j := 0; j < 2; j++ {
+			if err := <-errs; err != nil {
+				failed++
+			}
+		}
+		if failed != 1 {
+			names, _ := r.LsFiles("", true)
+			t.Fatalf("%d of the adds failed, leaving %v", failed, names)
+		}
+	}
+}
@@ -0,0 +1,644 @@
+package repo
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// packMagic starts every pack file.
+const packMagic = "RABITPACK1\n"
+
+// maxPackSize is the size at which a pack is closed and a new one started.
+var maxPackSize int64 = 64 << 20
+
+type packEntry struct {
+	pack           string
+	offset, length int64
+}
+
+// packStore appends chunks to large pack files under packs/, instead of
+// keeping each in a file of its own. Manifests and metadata are kept just
+// as in a diskStore.
+//
+// Each pack is written by a single process. A pack is a header followed by
+// records, each a "<hash> <length>\n" line and then the chunk itself. Once
+// a pack is flushed, an index is written beside it listing
+// "<hash> <offset> <length>" for each chunk, sorted by hash:
+//
+//	packs/<id>.pack
+//	packs/<id>.idx
+//
+// A pack without an index, left behind by a process that died, is scanned
+// instead; a torn record at its end is ignored.
+//
+// Deleting a chunk only removes it from its pack's index. Repack reclaims
+// the space.
+//
+// Other processes may change the packs while a store has them loaded, so
+// the index is reloaded when the pack directory changes; see fresh.
+type packStore struct {
+	*diskStore
+
+	mu      sync.RWMutex
+	loaded  bool
+	dirTime time.Time            // the pack directory's mtime, as last checked
+	seen    map[string]fileStamp // its files, as last loaded or written here
+	index   map[string]packEntry
+	packs   map[string]map[string]struct{} // pack id to the chunks in it
+
+	cur     *os.File // the pack being appended to, if any
+	curID   string
+	curSize int64
+}
+
+// NewPackStore returns a Store using the directory at path and keeping
+// chunks in pack files.
+func NewPackStore(path string) Store {
+	return &packStore{diskStore: &diskStore{path: path}}
+}
+
+func (s *packStore) Init() error {
+	if err := os.Mkdir(s.packDir(), 0755); err != nil {
+		return err
+	}
+	return os.Mkdir(filepath.Join(s.path, "manifests"), 0755)
+}
+
+func (s *packStore) packDir() string {
+	return filepath.Join(s.path, "packs")
+}
+
+func (s *packStore) packPath(id string) string {
+	return filepath.Join(s.packDir(), id+".pack")
+}
+
+func (s *packStore) indexPath(id string) string {
+	return filepath.Join(s.packDir(), id+".idx")
+}
+
+// fileStamp is what tells a pack or index file has changed.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// load loads the index, or reloads it if the pack directory has changed;
+// see fresh.
+func (s *packStore) load() error {
+	return s.fresh("")
+}
+
+// fresh brings the index up to date with the pack directory, which other
+// processes may have changed since it was loaded. If the directory's mtime
+// has changed, or hash isn't in the index, it lists the directory, and
+// reloads the index if any pack or index file in it isn't as last seen.
+// A miss is checked for because appending to a pack changes only the
+// pack; hash is "" when there is nothing to look up.
+//
+// The checking is done under the read lock, and only a change found takes
+// the write lock.
+func (s *packStore) fresh(hash string) error {
+	s.mu.RLock()
+	dirTime, reload, err := s.stale(hash)
+	current := !reload && dirTime.Equal(s.dirTime)
+	s.mu.RUnlock()
+	if err != nil || current {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dirTime, reload, err = s.stale(hash)
+	if err != nil {
+		return err
+	}
+	if reload {
+		_, err = s.reload()
+		return err
+	}
+	s.dirTime = dirTime
+	return nil
+}
+
+// stale returns the pack directory's mtime, and reports whether the index
+// must be reloaded to be sure of hash. s.mu must be held, if only for
+// reading.
+func (s *packStore) stale(hash string) (time.Time, bool, error) {
+	if !s.loaded {
+		return time.Time{}, true, nil
+	}
+	fi, err := os.Stat(s.packDir())
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	_, found := s.index[hash]
+	if fi.ModTime().Equal(s.dirTime) && (hash == "" || found) {
+		return fi.ModTime(), false, nil
+	}
+	_, files, err := s.listPacks()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return fi.ModTime(), !s.sameFiles(files), nil
+}
+
+// sameFiles reports whether files are those last seen, but for the pack
+// this store is writing, which only it changes.
+func (s *packStore) sameFiles(files map[string]fileStamp) bool {
+	own := func(name string) bool { return s.cur != nil && name == s.curID+".pack" }
+	for name, st := range files {
+		if own(name) {
+			continue
+		}
+		if seen, ok := s.seen[name]; !ok || seen != st {
+			return false
+		}
+	}
+	for name := range s.seen {
+		if _, ok := files[name]; !ok && !own(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// listPacks returns the pack directory's mtime and its pack and index
+// files. The mtime is taken first, so a change during the listing is
+// caught by the next check.
+func (s *packStore) listPacks() (time.Time, map[string]fileStamp, error) {
+	dir, err := os.Stat(s.packDir())
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	fis, err := ioutil.ReadDir(s.packDir())
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	files := make(map[string]fileStamp, len(fis))
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), ".pack") || strings.HasSuffix(fi.Name(), ".idx") {
+			files[fi.Name()] = fileStamp{fi.Size(), fi.ModTime()}
+		}
+	}
+	return dir.ModTime(), files, nil
+}
+
+// saw records the files of a pack as this store has just written them, so
+// that its own writes don't count as changes. s.mu must be held.
+func (s *packStore) saw(id string) {
+	for _, name := range []string{id + ".pack", id + ".idx"} {
+		fi, err := os.Stat(filepath.Join(s.packDir(), name))
+		if err != nil {
+			delete(s.seen, name)
+			continue
+		}
+		s.seen[name] = fileStamp{fi.Size(), fi.ModTime()}
+	}
+}
+
+// reload reads the index afresh from every pack on disk, and returns the
+// packs that have index files: those their writers have finished. The
+// pack this store is writing, if any, is kept as it is, without the chunks
+// that turn out to be in other packs. s.mu must be held.
+func (s *packStore) reload() ([]string, error) {
+	dirTime, files, err := s.listPacks()
+	if err != nil {
+		return nil, err
+	}
+	own := make(map[string]packEntry)
+	for h := range s.packs[s.curID] {
+		own[h] = s.index[h]
+	}
+
+	s.loaded = false
+	s.index = make(map[string]packEntry)
+	s.packs = make(map[string]map[string]struct{})
+	var ids []string
+	for name := range files {
+		id := strings.TrimSuffix(name, ".pack")
+		if id != name && (s.cur == nil || id != s.curID) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	var indexed []string
+	for _, id := range ids {
+		ok, err := s.loadPack(id)
+		if err != nil {
+			return nil, fmt.Errorf("pack %s: %s", id, err)
+		}
+		if ok {
+			indexed = append(indexed, id)
+		}
+	}
+	if s.cur != nil {
+		s.packs[s.curID] = make(map[string]struct{})
+		for h, e := range own {
+			if _, ok := s.index[h]; !ok {
+				s.index[h] = e
+				s.packs[s.curID][h] = struct{}{}
+			}
+		}
+	}
+	s.loaded, s.dirTime, s.seen = true, dirTime, files
+	return indexed, nil
+}
+
+// loadPack adds a pack's chunks to the index, from its index file if it has
+// one, or by scanning it if not. It reports whether there was an index.
+func (s *packStore) loadPack(id string) (bool, error) {
+	add := func(hash string, offset, length int64) {
+		if _, ok := s.index[hash]; ok {
+			return // left over from an interrupted repack
+		}
+		s.index[hash] = packEntry{pack: id, offset: offset, length: length}
+		if s.packs[id] == nil {
+			s.packs[id] = make(map[string]struct{})
+		}
+		s.packs[id][hash] = struct{}{}
+	}
+
+	idx, err := ioutil.ReadFile(s.indexPath(id))
+	if err == nil {
+		for _, line := range strings.Split(string(idx), "\n") {
+			if line == "" {
+				continue
+			}
+			var hash string
+			var offset, length int64
+			if _, err := fmt.Sscanf(line, "%s %d %d", &hash, &offset, &length); err != nil {
+				return false, fmt.Errorf("bad index line %q", line)
+			}
+			add(hash, offset, length)
+		}
+		return true, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	f, err := os.Open(s.packPath(id))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return false, scanPack(f, add)
+}
+
+// scanPack calls f for each complete record in a pack.
+func scanPack(r io.Reader, f func(hash string, offset, length int64)) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(packMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != packMagic {
+		return fmt.Errorf("not a pack file")
+	}
+	offset := int64(len(packMagic))
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil // end of pack, or a torn header
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !ValidHash(fields[0]) {
+			return fmt.Errorf("bad record header at offset %d", offset)
+		}
+		length, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || length < 0 {
+			return fmt.Errorf("bad record header at offset %d", offset)
+		}
+		offset += int64(len(line))
+		if n, _ := br.Discard(int(length)); int64(n) < length {
+			return nil // torn record
+		}
+		f(fields[0], offset, length)
+		offset += length
+	}
+}
+
+func (s *packStore) GetChunk(hash string) ([]byte, error) {
+	if err := s.fresh(hash); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.index[hash]
+	if !ok {
+		return nil, notExist("get", hash)
+	}
+	f, err := os.Open(s.packPath(e.pack))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, e.length)
+	if _, err := f.ReadAt(data, e.offset); err != nil {
+		return nil, fmt.Errorf("pack %s: chunk %s: %s", e.pack, hash, err)
+	}
+	return data, nil
+}
+
+func (s *packStore) ChunkHeader(hash string, n int) ([]byte, error) {
+	if err := s.fresh(hash); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.index[hash]
+	if !ok {
+		return nil, notExist("get", hash)
+	}
+	if int64(n) > e.length {
+		n = int(e.length)
+	}
+	f, err := os.Open(s.packPath(e.pack))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, n)
+	if _, err := f.ReadAt(header, e.offset); err != nil {
+		return nil, fmt.Errorf("pack %s: chunk %s: %s", e.pack, hash, err)
+	}
+	return header, nil
+}
+
+// PutChunk appends the chunk to this process's current pack, unless some
+// pack already has it.
+func (s *packStore) PutChunk(hash string, data []byte) error {
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.index[hash]; ok {
+		return nil
+	}
+	return s.appendChunk(hash, data)
+}
+
+// appendChunk writes a chunk to the current pack, starting one if need be.
+// s.mu must be held.
+func (s *packStore) appendChunk(hash string, data []byte) error {
+	if s.cur == nil {
+		if err := s.startPack(); err != nil {
+			return err
+		}
+	}
+
+	header := fmt.Sprintf("%s %d\n", hash, len(data))
+	if _, err := io.WriteString(s.cur, header); err != nil {
+		return err
+	}
+	if _, err := s.cur.Write(data); err != nil {
+		return err
+	}
+	offset := s.curSize + int64(len(header))
+	s.curSize = offset + int64(len(data))
+	s.index[hash] = packEntry{pack: s.curID, offset: offset, length: int64(len(data))}
+	s.packs[s.curID][hash] = struct{}{}
+
+	if s.curSize >= maxPackSize {
+		return s.finishPack()
+	}
+	return nil
+}
+
+func (s *packStore) startPack() error {
+	b, err := randomBytes(12)
+	if err != nil {
+		return err
+	}
+	id := hex.EncodeToString(b)
+	f, err := os.OpenFile(s.packPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, packMagic); err != nil {
+		f.Close()
+		return err
+	}
+	s.cur, s.curID, s.curSize = f, id, int64(len(packMagic))
+	s.packs[id] = make(map[string]struct{})
+	return nil
+}
+
+// finishPack syncs the current pack and writes its index. Writing the
+// index syncs the directory, which makes the pack's own name durable too.
+func (s *packStore) finishPack() error {
+	f, id := s.cur, s.curID
+	s.cur, s.curID, s.curSize = nil, "", 0
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return s.writeIndex(id)
+}
+
+// writeIndex replaces a pack's index with the chunks the store still has
+// in it, or removes the pack altogether if it has none.
+func (s *packStore) writeIndex(id string) error {
+	hashes := make([]string, 0, len(s.packs[id]))
+	for h := range s.packs[id] {
+		hashes = append(hashes, h)
+	}
+	if len(hashes) == 0 {
+		delete(s.packs, id)
+		defer s.saw(id)
+		if err := os.Remove(s.indexPath(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Remove(s.packPath(id))
+	}
+	sort.Strings(hashes)
+
+	var buf strings.Builder
+	for _, h := range hashes {
+		e := s.index[h]
+		fmt.Fprintf(&buf, "%s %d %d\n", h, e.offset, e.length)
+	}
+	defer s.saw(id)
+	return writeFileAtomic(s.indexPath(id), []byte(buf.String()), 0660)
+}
+
+// Flush finishes the current pack, so that everything written so far is
+// on disk and indexed.
+func (s *packStore) Flush() error {
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cur == nil {
+		return nil
+	}
+	return s.finishPack()
+}
+
+func (s *packStore) HasChunk(hash string) (bool, error) {
+	if err := s.fresh(hash); err != nil {
+		return false, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.index[hash]
+	return ok, nil
+}
+
+func (s *packStore) ChunkSize(hash string) (int64, error) {
+	if err := s.fresh(hash); err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.index[hash]
+	if !ok {
+		return 0, notExist("stat", hash)
+	}
+	return e.length, nil
+}
+
+// ChunkTime returns when the chunk's pack was last written to.
+func (s *packStore) ChunkTime(hash string) (time.Time, error) {
+	if err := s.fresh(hash); err != nil {
+		return time.Time{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.index[hash]
+	if !ok {
+		return time.Time{}, notExist("stat", hash)
+	}
+	fi, err := os.Stat(s.packPath(e.pack))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// DeleteChunk drops the chunk from its pack's index. The pack keeps the
+// bytes until the next Repack, unless no other chunk in it is left.
+func (s *packStore) DeleteChunk(hash string) error {
+	if err := s.fresh(hash); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.index[hash]
+	if !ok {
+		return notExist("delete", hash)
+	}
+	delete(s.index, hash)
+	delete(s.packs[e.pack], hash)
+	if e.pack == s.curID {
+		return nil // indexed when finished
+	}
+	return s.writeIndex(e.pack)
+}
+
+func (s *packStore) ListChunks() ([]string, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hashes := make([]string, 0, len(s.index))
+	for h := range s.index {
+		hashes = append(hashes, h)
+	}
+	return hashes, nil
+}
+
+// Repack copies every chunk still in the store into fresh, full packs and
+// removes the old ones, reclaiming the space of deleted chunks. Chunks keep
+// the order they were written in.
+//
+// It first rereads the index, since other processes may have added and
+// deleted chunks since it was loaded, and rewrites only packs with index
+// files. A pack without one may still be being written; it is left as it
+// is, and its chunks stay readable from it.
+func (s *packStore) Repack() error {
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cur != nil {
+		if err := s.finishPack(); err != nil {
+			return err
+		}
+	}
+
+	old, err := s.reload()
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]packEntry, len(s.index))
+	for h, e := range s.index {
+		entries[h] = e
+	}
+
+	for _, id := range old {
+		hashes := make([]string, 0, len(s.packs[id]))
+		for h := range s.packs[id] {
+			hashes = append(hashes, h)
+		}
+		sort.Slice(hashes, func(i, j int) bool { return entries[hashes[i]].offset < entries[hashes[j]].offset })
+
+		f, err := os.Open(s.packPath(id))
+		if err != nil {
+			return err
+		}
+		for _, h := range hashes {
+			e := entries[h]
+			data := make([]byte, e.length)
+			if _, err := f.ReadAt(data, e.offset); err != nil {
+				f.Close()
+				return fmt.Errorf("pack %s: chunk %s: %s", id, h, err)
+			}
+			delete(s.index, h)
+			delete(s.packs[id], h)
+			if err := s.appendChunk(h, data); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		f.Close()
+	}
+	if s.cur != nil {
+		if err := s.finishPack(); err != nil {
+			return err
+		}
+	}
+
+	// Every chunk now lives in a new pack as well, so the old ones can go.
+	for _, id := range old {
+		delete(s.packs, id)
+		err := os.Remove(s.indexPath(id))
+		if err == nil || os.IsNotExist(err) {
+			err = os.Remove(s.packPath(id))
+		}
+		s.saw(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package repo
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/burke/rabit/pkg/digest"
+)
+
+func packFiles(t *testing.T, dir, suffix string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, "packs", "*"+suffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestPackStore(t *testing.T) {
+	saved := maxPackSize
+	maxPackSize = 4 << 10
+	defer func() { maxPackSize = saved }()
+
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewPackStore(dir)
+	if err := s.Init(); err != nil {
+		t.Fatal("init", err)
+	}
+	chunks := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 1000+i)
+		hash := digest.Sum(digest.SHA1, data)
+		chunks[hash] = data
+		if err := s.PutChunk(hash, data); err != nil {
+			t.Fatal("put", err)
+		}
+	}
+	if err := s.(Flusher).Flush(); err != nil {
+		t.Fatal("flush", err)
+	}
+	if n := len(packFiles(t, dir, ".pack")); n < 4 {
+		t.Errorf("expected several packs, got %d", n)
+	}
+	if len(packFiles(t, dir, ".idx")) != len(packFiles(t, dir, ".pack")) {
+		t.Error("flushed packs without indexes")
+	}
+
+	// Delete half, then check a fresh store sees the rest.
+	n := 0
+	for hash := range chunks {
+		if n%2 == 0 {
+			if err := s.DeleteChunk(hash); err != nil {
+				t.Fatal("delete", err)
+			}
+			delete(chunks, hash)
+		}
+		n++
+	}
+	check := func(s Store) {
+		hashes, err := s.ListChunks()
+		if err != nil || len(hashes) != len(chunks) {
+			t.Fatalf("ListChunks: %d chunks, %v; want %d", len(hashes), err, len(chunks))
+		}
+		for hash, data := range chunks {
+			got, err := s.GetChunk(hash)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("chunk %s: %v", hash, err)
+			}
+		}
+	}
+	check(NewPackStore(dir))
+
+	var before int64
+	for _, p := range packFiles(t, dir, ".pack") {
+		fi, _ := os.Stat(p)
+		before += fi.Size()
+	}
+	if err := s.(Packer).Repack(); err != nil {
+		t.Fatal("repack", err)
+	}
+	var after int64
+	for _, p := range packFiles(t, dir, ".pack") {
+		fi, _ := os.Stat(p)
+		after += fi.Size()
+	}
+	if after >= before*3/4 {
+		t.Errorf("repack only shrank packs from %d to %d bytes", before, after)
+	}
+	check(s)
+	check(NewPackStore(dir))
+}
+
+// A pack whose writer died before indexing it is scanned, up to the last
+// complete record.
+func TestPackStoreRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewPackStore(dir)
+	if err := s.Init(); err != nil {
+		t.Fatal("init", err)
+	}
+	one, two := []byte("one"), []byte("two")
+	s.PutChunk(digest.Sum(digest.SHA1, one), one)
+	s.PutChunk(digest.Sum(digest.SHA1, two), two)
+
+	packs := packFiles(t, dir, ".pack")
+	if len(packs) != 1 || len(packFiles(t, dir, ".idx")) != 0 {
+		t.Fatalf("expected one unindexed pack, got %v", packs)
+	}
+	f, _ := os.OpenFile(packs[0], os.O_WRONLY|os.O_APPEND, 0)
+	fmt.Fprintf(f, "%s 100\ntorn", digest.Sum(digest.SHA1, []byte("three")))
+	f.Close()
+
+	r := NewPackStore(dir)
+	for _, data := range [][]byte{one, two} {
+		if got, err := r.GetChunk(digest.Sum(digest.SHA1, data)); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("recovered %q, %v; want %q", got, err, data)
+		}
+	}
+	if hashes, _ := r.ListChunks(); len(hashes) != 2 {
+		t.Errorf("recovered %d chunks, want 2: %s", len(hashes), strings.Join(hashes, " "))
+	}
+}
+
+// Repack sees what other stores on the same directory did since it loaded,
+// and leaves alone packs still being written.
+func TestRepackSharedPacks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewPackStore(dir)
+	if err := s.Init(); err != nil {
+		t.Fatal("init", err)
+	}
+	one, two, three := []byte("one"), []byte("two"), []byte("three")
+	s.PutChunk(digest.Sum(digest.SHA1, one), one)
+	s.(Flusher).Flush()
+	writer := NewPackStore(dir)
+	writer.PutChunk(digest.Sum(digest.SHA1, three), three)
+	var writing string
+	for _, pack := range packFiles(t, dir, ".pack") {
+		if _, err := os.Stat(strings.TrimSuffix(pack, ".pack") + ".idx"); os.IsNotExist(err) {
+			writing = pack
+		}
+	}
+
+	repacker := NewPackStore(dir)
+	repacker.ListChunks() // loads the index
+	s.PutChunk(digest.Sum(digest.SHA1, two), two)
+	s.(Flusher).Flush()
+	s.DeleteChunk(digest.Sum(digest.SHA1, one))
+
+	if err := repacker.(Packer).Repack(); err != nil {
+		t.Fatal("repack", err)
+	}
+	if _, err := os.Stat(writing); err != nil {
+		t.Error("repack removed a pack still being written:", err)
+	}
+	writer.(Flusher).Flush()
+
+	r := NewPackStore(dir)
+	for _, data := range [][]byte{two, three} {
+		if got, err := r.GetChunk(digest.Sum(digest.SHA1, data)); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("after repack, read %q, %v; want %q", got, err, data)
+		}
+	}
+	if ok, _ := r.HasChunk(digest.Sum(digest.SHA1, one)); ok {
+		t.Error("repack brought back a deleted chunk")
+	}
+}
+
+// A store sees chunks another store on the same directory added, deleted
+// and repacked after it loaded the index.
+func TestPackStoreRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewPackStore(dir)
+	if err := s.Init(); err != nil {
+		t.Fatal("init", err)
+	}
+	one, two, three := []byte("one"), []byte("two"), []byte("three")
+	s.PutChunk(digest.Sum(digest.SHA1, one), one)
+	s.(Flusher).Flush()
+
+	other := NewPackStore(dir)
+	if hashes, err := other.ListChunks(); err != nil || len(hashes) != 1 {
+		t.Fatalf("ListChunks: %v, %v", hashes, err)
+	}
+
+	// Added, unindexed and then indexed.
+	s.PutChunk(digest.Sum(digest.SHA1, two), two)
+	if got, err := other.GetChunk(digest.Sum(digest.SHA1, two)); err != nil || !bytes.Equal(got, two) {
+		t.Errorf("chunk being written: %q, %v", got, err)
+	}
+	s.PutChunk(digest.Sum(digest.SHA1, three), three)
+	s.(Flusher).Flush()
+	if ok, err := other.HasChunk(digest.Sum(digest.SHA1, three)); !ok || err != nil {
+		t.Errorf("flushed chunk not found: %v", err)
+	}
+
+	// Deleted.
+	if err := s.DeleteChunk(digest.Sum(digest.SHA1, one)); err != nil {
+		t.Fatal("delete", err)
+	}
+	if hashes, _ := other.ListChunks(); len(hashes) != 2 {
+		t.Errorf("after delete, listed %d chunks, want 2", len(hashes))
+	}
+
+	// Repacked, so the packs other loaded are gone.
+	if err := s.(Packer).Repack(); err != nil {
+		t.Fatal("repack", err)
+	}
+	for _, data := range [][]byte{two, three} {
+		if got, err := other.GetChunk(digest.Sum(digest.SHA1, data)); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("after repack, read %q, %v; want %q", got, err, data)
+		}
+	}
+}
+
+func TestRepoOnPackStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(dir)
+
+	repo := NewWithStore(NewPackStore(dir))
+	if err := repo.Init(nil); err != nil {
+		t.Fatal("init", err)
+	}
+	for _, path := range []string{blob1Path, blob2Path} {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal("open", path)
+		}
+		if err := repo.Add(f, filepath.Base(path)); err != nil {
+			t.Fatal("add", err)
+		}
+		f.Close()
+	}
+	if len(packFiles(t, dir, ".idx")) != 2 {
+		t.Error("expected each add to leave an indexed pack")
+	}
+
+	if err := repo.Rm("blob1"); err != nil {
+		t.Fatal("rm", err)
+	}
+	if _, err := repo.GC(GCOptions{}); err != nil {
+		t.Fatal("gc", err)
+	}
+	if err := repo.Repack(); err != nil {
+		t.Fatal("repack", err)
+	}
+	if n := len(packFiles(t, dir, ".pack")); n != 1 {
+		t.Errorf("expected repack to leave one pack, got %d", n)
+	}
+
+	var out bytes.Buffer
+	if err := NewWithStore(NewPackStore(dir)).CatFile("blob2", &out); err != nil {
+		t.Fatal("cat", err)
+	}
+	expected, _ := ioutil.ReadFile(blob2Path)
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Error("blob2 changed by repack")
+	}
+}
@@ -0,0 +1,231 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrRefChanged is returned by a compare-and-swap update of a name that
+// doesn't point where it was expected to.
+var ErrRefChanged = errors.New("repo: name doesn't point at the expected manifest")
+
+// MissingChunkError is returned by WriteManifest for a manifest naming a
+// chunk the repository doesn't have.
+type MissingChunkError struct {
+	Hash string
+}
+
+func (e *MissingChunkError) Error() string {
+	return "missing chunk " + e.Hash
+}
+
+// RefOptions controls UpdateRef.
+type RefOptions struct {
+	// Expect, if set, is the ID of the manifest the name must point at for
+	// the update to go ahead.
+	Expect string
+	// Create refuses the update if the name exists already.
+	Create bool
+	// Message is recorded in the name's history; see Log.
+	Message string
+}
+
+// A manifest's ID is its hash, under the repository's hash function. Every
+// manifest written is also stored as a chunk named by its ID, so that any
+// number of names can point at it, and it is kept while any does.
+
+// loadObject reads the manifest stored under id.
+func (c *repo) loadObject(cfg *Config, id string) (*Manifest, error) {
+	data, err := c.ReadChunk(id)
+	if err != nil {
+		return nil, err
+	}
+	if actual := cfg.sum(data); actual != id {
+		return nil, fmt.Errorf("manifest %s is corrupt: its contents hash to %s", id, actual)
+	}
+	return ParseManifest(data)
+}
+
+// storeObject stores m as a chunk, if it isn't already, and returns its ID.
+func (c *repo) storeObject(cfg *Config, m *Manifest) (string, error) {
+	data := []byte(m.String())
+	id := cfg.sum(data)
+	if ok, err := c.store.HasChunk(id); err != nil || ok {
+		return id, err
+	}
+	stored, err := cfg.encodeChunk(id, data)
+	if err != nil {
+		return "", err
+	}
+	return id, c.putChunk(id, stored)
+}
+
+// resolve finds the manifest ref names, and its ID. ref is a name, a name
+// and version as "<name>@<n>", or a manifest ID. A name wins over an ID
+// spelled the same way.
+func (c *repo) resolve(cfg *Config, ref string) (*Manifest, string, error) {
+	base, n := splitVersion(ref)
+	h, err := c.loadHistory(cfg, base)
+	if os.IsNotExist(err) && n == 0 && ValidHash(ref) {
+		m, oerr := c.loadObject(cfg, ref)
+		if oerr == nil {
+			return m, ref, nil
+		}
+		if !os.IsNotExist(oerr) {
+			return nil, "", oerr
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	e := h.latest()
+	if n != 0 {
+		if e = h.find(n); e == nil {
+			return nil, "", fmt.Errorf("%s: no version %d", base, n)
+		}
+	}
+	m, err := c.entryManifest(cfg, e)
+	if err != nil {
+		return nil, "", err
+	}
+	return m, e.ID, nil
+}
+
+// LoadManifest returns the manifest of the latest version of the named
+// file, of version n if name is "<name>@<n>", or the manifest with the ID
+// name.
+func (c *repo) LoadManifest(name string) (*Manifest, error) {
+	cfg, err := c.Config()
+	if err != nil {
+		return nil, err
+	}
+	m, _, err := c.resolve(cfg, name)
+	return m, err
+}
+
+// Resolve returns the ID of the manifest that LoadManifest would return.
+func (c *repo) Resolve(name string) (string, error) {
+	cfg, err := c.Config()
+	if err != nil {
+		return "", err
+	}
+	_, id, err := c.resolve(cfg, name)
+	return id, err
+}
+
+// WriteManifest makes m the latest version of the named file, unless it
+// already is. m must name only chunks the repository has; they are checked
+// under the lock GC takes, so that none can be collected in between.
+func (c *repo) WriteManifest(name string, m *Manifest) error {
+	unlock, err := c.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return c.writeManifest(name, m, nil, true)
+}
+
+// UpdateRef points name at the manifest target resolves to, as its latest
+// version, without copying anything. target is anything LoadManifest
+// accepts. With opts.Expect or opts.Create, the update is a
+// compare-and-swap, failing with ErrRefChanged if name has moved.
+func (c *repo) UpdateRef(name, target string, opts *RefOptions) error {
+	unlock, err := c.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	m, err := c.LoadManifest(target)
+	if err != nil {
+		return err
+	}
+	return c.writeManifest(name, m, opts, false)
+}
+
+// writeManifest adds m to name's history. With check set, it first makes
+// sure the store has every chunk m names, as it must when m came from
+// elsewhere. The caller must hold the repository lock.
+func (c *repo) writeManifest(name string, m *Manifest, opts *RefOptions, check bool) error {
+	if opts == nil {
+		opts = &RefOptions{}
+	}
+	cfg, err := c.Config()
+	if err != nil {
+		return err
+	}
+	if _, n := splitVersion(name); n != 0 {
+		return fmt.Errorf("%s: can't write a particular version", name)
+	}
+	if err := ValidName(name); err != nil {
+		return err
+	}
+	if err := m.validate(); err != nil {
+		return err
+	}
+	id, err := c.storeObject(cfg, m)
+	if err != nil {
+		return err
+	}
+	if f, ok := c.store.(Flusher); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+
+	unlock, err := c.lock(indexLock, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := c.checkParents(name); err != nil {
+		return err
+	}
+
+	entry := historyEntry{
+		Number:  1,
+		Time:    time.Now().UTC().Truncate(time.Second),
+		Message: opts.Message,
+		ID:      id,
+	}
+	h, err := c.loadHistory(cfg, name)
+	switch {
+	case os.IsNotExist(err):
+		if opts.Expect != "" {
+			return ErrRefChanged
+		}
+		h = &history{}
+	case err != nil:
+		return err
+	case opts.Create || opts.Expect != "" && h.latest().ID != opts.Expect:
+		return ErrRefChanged
+	case h.latest().ID == id:
+		return nil
+	default:
+		entry.Number = h.latest().Number + 1
+	}
+	h.Versions = append(h.Versions, entry)
+
+	if check {
+		for _, hash := range m.Chunks {
+			if ok, err := c.store.HasChunk(hash); err != nil {
+				return err
+			} else if !ok {
+				return &MissingChunkError{hash}
+			}
+		}
+	}
+	// Count the new references before the history makes them.
+	err = c.updateIndex(false, func(tx IndexTx) error {
+		if tx == nil {
+			return nil
+		}
+		return addRefs(tx, append([]string{id}, m.Chunks...), c.store.ChunkSize)
+	})
+	if err != nil {
+		return err
+	}
+	return c.writeHistory(cfg, name, h)
+}
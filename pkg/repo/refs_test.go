@@ -0,0 +1,135 @@
+package repo
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRefs(t *testing.T) {
+	store := NewMemStore()
+	r := NewWithStore(store)
+	r.Init(nil)
+
+	r.Add(strings.NewReader("first build"), "build")
+	first, err := r.Resolve("build")
+	if err != nil {
+		t.Fatal("resolve", err)
+	}
+	r.Add(strings.NewReader("second build"), "build")
+	second, _ := r.Resolve("build")
+	if first == second {
+		t.Fatal("different manifests have the same ID")
+	}
+	if id, _ := r.Resolve("build@1"); id != first {
+		t.Errorf("build@1 resolves to %s, not %s", id, first)
+	}
+
+	// A manifest is stored as a chunk named by its hash.
+	data, err := r.ReadChunk(first)
+	if err != nil {
+		t.Fatal("read manifest", err)
+	}
+	m, _ := r.LoadManifest(first)
+	if string(data) != m.String() {
+		t.Error("manifest ID names something else")
+	}
+
+	if err := r.UpdateRef("stable", "build@1", &RefOptions{Create: true, Message: "promoted"}); err != nil {
+		t.Fatal("create stable", err)
+	}
+	var buf bytes.Buffer
+	if err := r.CatFile("stable", &buf); err != nil || buf.String() != "first build" {
+		t.Errorf("cat stable: %q, %v", buf.String(), err)
+	}
+	for _, test := range []struct {
+		opts *RefOptions
+		err  error
+	}{
+		{&RefOptions{Create: true}, ErrRefChanged},
+		{&RefOptions{Expect: second}, ErrRefChanged},
+		{&RefOptions{Expect: first}, nil},
+	} {
+		if err := r.UpdateRef("stable", second, test.opts); err != test.err {
+			t.Errorf("update with %+v: %v, want %v", test.opts, err, test.err)
+		}
+	}
+	if err := r.UpdateRef("nightly", first, &RefOptions{Expect: first}); err != ErrRefChanged {
+		t.Errorf("expected a missing name to point somewhere: %v", err)
+	}
+	versions, _ := r.Log("stable")
+	if len(versions) != 2 || versions[0].Message != "promoted" || versions[1].ID != second {
+		t.Errorf("history of stable: %+v", versions)
+	}
+
+	// A manifest lives while any name's history points at it.
+	if err := r.Rm("build"); err != nil {
+		t.Fatal("rm", err)
+	}
+	r.SetRetention(&Retention{KeepLast: 1})
+	if _, err := r.GC(GCOptions{}); err != nil {
+		t.Fatal("gc", err)
+	}
+	if ok, _ := r.HasChunk(second); !ok {
+		t.Error("gc removed the manifest stable points at")
+	}
+	if ok, _ := r.HasChunk(first); ok {
+		t.Error("gc kept a manifest nothing points at")
+	}
+	if err := r.CatFile(second, &bytes.Buffer{}); err != nil {
+		t.Error("cat by ID", err)
+	}
+	if _, err := r.LoadManifest(first); !os.IsNotExist(err) {
+		t.Errorf("loading a collected manifest: %v", err)
+	}
+
+	// Nor can a manifest naming a collected chunk be written again.
+	if err := r.WriteManifest("revived", m); err == nil {
+		t.Error("wrote a manifest naming a collected chunk")
+	} else if _, ok := err.(*MissingChunkError); !ok {
+		t.Errorf("expected a MissingChunkError, got %v", err)
+	}
+	if _, err := r.Log("revived"); !os.IsNotExist(err) {
+		t.Errorf("manifest naming a collected chunk written: %v", err)
+	}
+}
+
+func TestRefCompareAndSwap(t *testing.T) {
+	r := NewWithStore(NewMemStore())
+	r.Init(nil)
+	r.Add(strings.NewReader("a"), "a")
+	r.Add(strings.NewReader("b"), "b")
+	r.UpdateRef("current", "a", nil)
+	old, _ := r.Resolve("current")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target := []string{"a@1", "b"}[i%2]
+			errs[i] = r.UpdateRef("current", target, &RefOptions{Expect: old})
+		}(i)
+	}
+	wg.Wait()
+
+	// Swapping current for what it already is changes nothing, so every
+	// update to a@1 succeeds until one to b does; after that, none can.
+	versions, _ := r.Log("current")
+	moved := 0
+	for i, err := range errs {
+		switch {
+		case err == ErrRefChanged:
+		case err != nil:
+			t.Fatal("update", err)
+		case i%2 == 1:
+			moved++
+		}
+	}
+	if moved != 1 || len(versions) != 2 {
+		t.Errorf("%d updates moved current, leaving %d versions; want 1 and 2", moved, len(versions))
+	}
+}
@@ -2,97 +2,296 @@
 package repo
 
 import (
+	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"path/filepath"
-	"strings"
+	"sync"
+	"time"
 )
 
 type Repo interface {
-	Init() error
+	Init(*Config) error
+	Config() (*Config, error)
 	Add(io.Reader, string) error
-	LsFiles() ([]string, error)
+	AddWithOptions(io.Reader, string, *AddOptions) error
+	LsFiles(string, bool) ([]string, error)
 	CatFile(string, io.Writer) error
-	Rm(string) error
-	GC(bool) error
-	ChunkPath(string) string
+	CatFileWithOptions(string, io.Writer, *CatOptions) error
+	Open(string) (*File, error)
+	Log(string) ([]Version, error)
+	Rm(...string) error
+	GC(GCOptions) (*GCReport, error)
+	Repack() error
+	SetRetention(*Retention) error
+	Verify(bool) (*Report, error)
+	Usage() (*Usage, error)
+	ChunkRefs(string) (int, error)
+	Lock(bool) (func(), error)
+	LoadManifest(string) (*Manifest, error)
+	WriteManifest(string, *Manifest) error
+	Resolve(string) (string, error)
+	UpdateRef(string, string, *RefOptions) error
+	HasChunk(string) (bool, error)
+	ChunkSize(string) (int64, error)
+	ReadChunk(string) ([]byte, error)
+	WriteChunk(string, []byte) error
+	LoadMetadata(string) ([]byte, error)
+	WriteMetadata(string, []byte) error
+
+	// Exchanging an encrypted repository sealed; see sealed.go.
+	StoredConfig() (*Config, error)
+	ReadStoredChunk(string) ([]byte, error)
+	StoredChunkSize(string) (int64, error)
+	WriteStoredChunk(string, []byte) error
+	OpenChunk(string, []byte) ([]byte, error)
+	ReadStoredManifest(string) ([]byte, error)
+	WriteStoredManifest(string, []byte) error
+	OpenHistory(string, []byte) ([]Version, error)
+	SealVersion(string, []byte, string) ([]byte, error)
 }
 
 type repo struct {
-	path string
+	store  Store
+	secret []byte // unlocks an encrypted repository
+
+	localLocks lockSet // for stores that aren't Lockers
+	recorder   chunkRecorder
+
+	configOnce sync.Once
+	config     *Config // unlocked, if the repository is encrypted
+	stored     *Config // as stored; see StoredConfig
+	configErr  error
 }
 
+// New returns a Repo kept on disk in the directory at path.
 func New(path string) Repo {
-	return &repo{path: path}
+	return NewWithStore(NewDiskStore(path))
+}
+
+// NewWithStore returns a Repo kept in s.
+func NewWithStore(s Store) Repo {
+	return &repo{store: s}
+}
+
+// NewWithKey returns a Repo kept in s and encrypted under secret, a
+// passphrase or the contents of a key file. Init on such a Repo creates an
+// encrypted repository. The secret is ignored if the repository in s turns
+// out not to be encrypted.
+func NewWithKey(s Store, secret []byte) Repo {
+	return &repo{store: s, secret: secret}
 }
 
-func (c *repo) Init() error {
-	if err := os.Mkdir(filepath.Join(c.path, "chunks"), 0755); err != nil {
+// ErrInitialized is returned by Init when the store already holds a
+// repository.
+var ErrInitialized = errors.New("repo: already initialized")
+
+// Init creates a new repository chunking files according to cfg, or
+// DefaultConfig if cfg is nil. The repository is encrypted if c was
+// created by NewWithKey. Init fails with ErrInitialized, changing nothing,
+// if the store has a repository's config already.
+func (c *repo) Init(cfg *Config) error {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if _, err := c.store.GetMetadata(configName); err == nil {
+		return ErrInitialized
+	} else if !os.IsNotExist(err) {
 		return err
 	}
+	own := *cfg
+	cfg = &own
+	cfg.Encryption, cfg.keys = nil, nil
+	if c.secret != nil {
+		var err error
+		if cfg.Encryption, cfg.keys, err = newEncryption(c.secret); err != nil {
+			return err
+		}
+	}
+	if err := c.store.Init(); err != nil {
+		return err
+	}
+	if err := c.writeConfig(cfg); err != nil {
+		return err
+	}
+	return c.updateIndex(true, func(IndexTx) error { return nil })
+}
 
-	return os.Mkdir(filepath.Join(c.path, "manifests"), 0755)
+// AddOptions describes a file being added, for its manifest to record.
+type AddOptions struct {
+	Mode    os.FileMode
+	ModTime time.Time
+	Meta    map[string]string
+	Message string // recorded in the file's history; see Log
 }
 
+// Add stores the contents of r under name, as a new version of any file
+// already there.
 func (c *repo) Add(r io.Reader, name string) error {
-	w := newChunkWriter(c.path, r)
-	spans, err := w.writeChunks(c)
+	return c.AddWithOptions(r, name, nil)
+}
+
+// AddWithOptions is Add, also recording what opts describes, if it isn't
+// nil, in the file's manifest.
+func (c *repo) AddWithOptions(r io.Reader, name string, opts *AddOptions) error {
+	unlock, err := c.Lock(false)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	return writeManifest(c.manifestPath(name), spans)
-}
+	cfg, err := c.Config()
+	if err != nil {
+		return err
+	}
 
-func (c *repo) LsFiles() ([]string, error) {
-	manifestDir := filepath.Join(c.path, "manifests")
-	fis, err := ioutil.ReadDir(manifestDir)
+	w := newChunkWriter(r, cfg)
+	spans, err := w.writeChunks(c.putChunk)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	m := &Manifest{
+		Version: ManifestVersion,
+		Digest:  w.digest(),
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	for _, span := range spans {
+		m.Chunks = append(m.Chunks, span.br)
+		m.Sizes = append(m.Sizes, span.size)
+		m.Size += span.size
 	}
-	var names []string
-	for _, fi := range fis {
-		names = append(names, fi.Name())
+	var message string
+	if opts != nil {
+		m.Mode, m.ModTime, m.Meta = opts.Mode, opts.ModTime, opts.Meta
+		message = opts.Message
 	}
-	return names, nil
+	return c.writeManifest(name, m, &RefOptions{Message: message}, false)
 }
 
-func (c *repo) Rm(name string) error {
-	mp := c.manifestPath(name)
-	if err := os.Remove(mp); err != nil {
+// Rm removes the named files, with all their history. The manifests and
+// chunks they pointed at stay in the store until the next GC, which keeps
+// those another name still points at. Removing several files and then
+// collecting once is much cheaper than collecting after each. Rm stops at
+// the first name that can't be removed.
+func (c *repo) Rm(names ...string) error {
+	unlock, err := c.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	cfg, err := c.Config()
+	if err != nil {
+		return err
+	}
+	unlockIndex, err := c.lock(indexLock, true)
+	if err != nil {
 		return err
 	}
-	return c.GC(false)
+	defer unlockIndex()
+
+	// A failure part way leaves the names before it removed, so what was
+	// done is committed either way.
+	var rmErr error
+	err = c.updateIndex(false, func(tx IndexTx) error {
+		for _, name := range names {
+			if rmErr = ValidName(name); rmErr != nil {
+				return nil
+			}
+			var h *history
+			if tx != nil {
+				// A history that can't be read can't be released; the
+				// index just goes on counting its references.
+				h, _ = c.loadHistory(cfg, name)
+			}
+			if rmErr = c.store.DeleteManifest(name); rmErr != nil {
+				return nil
+			}
+			if h == nil {
+				continue
+			}
+			for i := range h.Versions {
+				if refs, err := c.entryRefs(cfg, &h.Versions[i]); err == nil {
+					if err := releaseRefs(tx, refs); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if rmErr != nil {
+		return rmErr
+	}
+	return err
 }
 
-func (c *repo) ChunkPath(hash string) string {
-	prefix := hash[0:2]
-	return filepath.Join(c.path, "chunks", prefix, hash)
+func (c *repo) HasChunk(hash string) (bool, error) {
+	return c.store.HasChunk(hash)
 }
 
-func (c *repo) manifestPath(name string) string {
-	return filepath.Join(c.path, "manifests", name)
+// ChunkSize returns the size of a chunk's contents, which for a compressed
+// or encrypted chunk isn't the size it takes up in the store.
+func (c *repo) ChunkSize(hash string) (int64, error) {
+	cfg, err := c.Config()
+	if err != nil {
+		return 0, err
+	}
+	if cfg.storedAsIs() {
+		return c.store.ChunkSize(hash)
+	}
+	var stored []byte
+	if hr, ok := c.store.(ChunkHeaderReader); ok {
+		stored, err = hr.ChunkHeader(hash, cfg.headerLen())
+	} else {
+		stored, err = c.store.GetChunk(hash)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return cfg.decodedSize(hash, stored)
 }
 
-func (c *repo) loadManifest(name string) (*manifest, error) {
-	p := c.manifestPath(name)
-	data, err := ioutil.ReadFile(p)
+// ReadChunk returns the contents of a chunk, decrypted and decompressed if
+// need be.
+func (c *repo) ReadChunk(hash string) ([]byte, error) {
+	cfg, err := c.Config()
 	if err != nil {
 		return nil, err
 	}
-
-	hashes := strings.Split(strings.TrimSpace(string(data)), "\n")
-	return &manifest{chunks: hashes}, nil
+	stored, err := c.store.GetChunk(hash)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.decodeChunk(hash, stored)
 }
 
-func writeManifest(path string, spans []span) error {
-	var hashes []string
-	for _, span := range spans {
-		hashes = append(hashes, span.br)
+// WriteChunk stores a chunk received from elsewhere, refusing it if its
+// contents don't match hash under the repository's hash function.
+func (c *repo) WriteChunk(hash string, data []byte) error {
+	cfg, err := c.Config()
+	if err != nil {
+		return err
+	}
+	if actual := cfg.sum(data); actual != hash {
+		return fmt.Errorf("chunk %s has hash %s", hash, actual)
 	}
+	stored, err := cfg.encodeChunk(hash, data)
+	if err != nil {
+		return err
+	}
+	return c.putChunk(hash, stored)
+}
 
-	manifest := manifest{chunks: hashes}
+// LoadMetadata reads a signed metadata file, such as the TUF role files
+// written by package tuf.
+func (c *repo) LoadMetadata(name string) ([]byte, error) {
+	return c.store.GetMetadata(name)
+}
 
-	return ioutil.WriteFile(path, []byte(manifest.String()), 0660)
+func (c *repo) WriteMetadata(name string, data []byte) error {
+	return c.store.PutMetadata(name, data)
 }
@@ -4,13 +4,21 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/burke/rabit/pkg/chunker"
+	"github.com/burke/rabit/pkg/digest"
 )
 
 const (
@@ -26,7 +34,8 @@ func TestGarbage(t *testing.T) {
 	defer os.RemoveAll(dir)
 
 	repo := New(dir)
-	repo.Init()
+	// The expected names below are SHA-1 hashes.
+	repo.Init(legacyConfig())
 
 	blob1, err := os.Open(blob1Path)
 	if err != nil {
@@ -54,6 +63,9 @@ func TestGarbage(t *testing.T) {
 	if err := repo.Rm("blob1"); err != nil {
 		t.Fatal("rm fail")
 	}
+	if _, err := repo.GC(GCOptions{}); err != nil {
+		t.Fatal("GC fail")
+	}
 
 	expectChunks(t, dir, map[string]string{})
 	expectManifests(t, dir, map[string]string{})
@@ -97,7 +109,7 @@ c82241b955d9d1d1acac4ca85b05e288af8f6135
 `,
 	})
 
-	files, err := repo.LsFiles()
+	files, err := repo.LsFiles("", true)
 	if err != nil {
 		t.Error("ls failed")
 	}
@@ -107,10 +119,12 @@ c82241b955d9d1d1acac4ca85b05e288af8f6135
 		t.Fatal("ls didn't look right")
 	}
 
+	// Removed behind the repository's back, so only a full collection
+	// notices.
 	if err := os.Remove(filepath.Join(dir, "manifests", "blob1")); err != nil {
 		t.Fatal("os remove fail")
 	}
-	if err := repo.GC(false); err != nil {
+	if _, err := repo.GC(GCOptions{Full: true}); err != nil {
 		t.Fatal("GC fail")
 	}
 
@@ -141,6 +155,26 @@ c82241b955d9d1d1acac4ca85b05e288af8f6135
 func expectChunks(t *testing.T, dir string, expects map[string]string) {
 	var chunks []string
 
+	// Manifests stored as chunks are checked by expectManifests.
+	manifestIDs := make(map[string]bool)
+	mfis, err := ioutil.ReadDir(filepath.Join(dir, "manifests"))
+	if err != nil {
+		t.Fatal("readdir manifests")
+	}
+	for _, mfi := range mfis {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "manifests", mfi.Name()))
+		if err != nil {
+			t.Fatal("read history", err)
+		}
+		h, err := parseHistory(legacyConfig(), data)
+		if err != nil {
+			t.Fatal("parse history", err)
+		}
+		for _, e := range h.Versions {
+			manifestIDs[e.ID] = true
+		}
+	}
+
 	prefixes, err := ioutil.ReadDir(filepath.Join(dir, "chunks"))
 	if err != nil {
 		t.Fatal("readdir prefixes")
@@ -152,7 +186,9 @@ func expectChunks(t *testing.T, dir string, expects map[string]string) {
 			t.Fatal("readdir chunk")
 		}
 		for _, fi := range cinfo {
-			chunks = append(chunks, fi.Name())
+			if !manifestIDs[fi.Name()] {
+				chunks = append(chunks, fi.Name())
+			}
 		}
 	}
 
@@ -201,7 +237,25 @@ func expectManifests(t *testing.T, dir string, expects map[string]string) {
 		if err != nil {
 			t.Error("readfile fail", err)
 		}
-		acontents := string(acontentsBytes)
+		// Compare the latest chunk lists, in the form of a version 1
+		// manifest.
+		h, err := parseHistory(legacyConfig(), acontentsBytes)
+		if err != nil {
+			t.Error("parse history", err)
+			continue
+		}
+		id := h.latest().ID
+		data, err := ioutil.ReadFile(filepath.Join(dir, "chunks", id[:2], id))
+		if err != nil {
+			t.Error("read manifest", id, err)
+			continue
+		}
+		m, err := ParseManifest(data)
+		if err != nil {
+			t.Error("parse manifest", err)
+			continue
+		}
+		acontents := (&Manifest{Chunks: m.Chunks}).String()
 		if econtents != acontents {
 			t.Errorf("expected %s to be %s but was %s", name, econtents, acontents)
 		}
@@ -223,3 +277,661 @@ func fileMD5(filePath string) (string, error) {
 
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
+
+func TestChunkingConfig(t *testing.T) {
+	store := NewMemStore()
+	cfg := &Config{Hash: digest.BLAKE2b, Chunker: chunker.Rollsum, MinChunkSize: 4 << 10, AvgChunkSize: 8 << 10, MaxChunkSize: 16 << 10}
+	if err := NewWithStore(store).Init(cfg); err != nil {
+		t.Fatal("init", err)
+	}
+
+	// A fresh Repo on the same store must pick the parameters up.
+	repo := NewWithStore(store)
+	actual, err := repo.Config()
+	if err != nil || *actual != *cfg {
+		t.Fatalf("config not persisted: %+v, %v", actual, err)
+	}
+	// Initializing it again fails, and changes nothing.
+	if err := repo.Init(nil); err != ErrInitialized {
+		t.Errorf("init of an initialized repository: %v", err)
+	}
+	if actual, _ := NewWithStore(store).Config(); *actual != *cfg {
+		t.Errorf("init again changed the config to %+v", actual)
+	}
+
+	blob1, err := os.Open(blob1Path)
+	if err != nil {
+		t.Fatal("open blob1")
+	}
+	defer blob1.Close()
+	if err := repo.Add(blob1, "blob1"); err != nil {
+		t.Fatal("repo add", err)
+	}
+
+	m, err := repo.LoadManifest("blob1")
+	if err != nil {
+		t.Fatal("load manifest")
+	}
+	if len(m.Chunks) < 175408/(16<<10) {
+		t.Errorf("expected small chunks, got %d chunks", len(m.Chunks))
+	}
+	for _, h := range m.Chunks {
+		if size, _ := store.ChunkSize(h); size > 16<<10 {
+			t.Errorf("chunk %s is %d bytes, over the maximum", h, size)
+		}
+	}
+
+	for _, bad := range []*Config{
+		{Hash: "md5", Chunker: chunker.Rollsum, MinChunkSize: 0, AvgChunkSize: 8 << 10, MaxChunkSize: 1 << 20},
+		{Hash: digest.SHA256, Chunker: "nope", MinChunkSize: 0, AvgChunkSize: 8 << 10, MaxChunkSize: 1 << 20},
+		{Hash: digest.SHA256, Chunker: chunker.Rollsum, MinChunkSize: 0, AvgChunkSize: 3000, MaxChunkSize: 1 << 20},
+		{Hash: digest.SHA256, Chunker: chunker.Rollsum, MinChunkSize: 1 << 20, AvgChunkSize: 8 << 10, MaxChunkSize: 1 << 10},
+		{Hash: digest.SHA256, Chunker: chunker.Rollsum, MinChunkSize: 0, AvgChunkSize: 8 << 10, MaxChunkSize: 1 << 30},
+		{Hash: digest.SHA256, Chunker: chunker.Rollsum, MinChunkSize: 64 << 10, AvgChunkSize: 8 << 10, MaxChunkSize: 1 << 20},
+		{Hash: digest.SHA256, Chunker: chunker.Rollsum, MinChunkSize: 64 << 10, AvgChunkSize: 100 << 10, MaxChunkSize: 1 << 20},
+		{Hash: digest.SHA256, Chunker: chunker.FastCDC, MinChunkSize: 64 << 10, AvgChunkSize: 8 << 10, MaxChunkSize: 1 << 20},
+		{Hash: digest.SHA256, Chunker: chunker.FastCDC, MinChunkSize: 0, AvgChunkSize: 3000, MaxChunkSize: 1 << 20},
+	} {
+		if err := NewWithStore(NewMemStore()).Init(bad); err == nil {
+			t.Errorf("accepted invalid config %+v", bad)
+		}
+	}
+}
+
+func TestFastCDCRepo(t *testing.T) {
+	store := NewMemStore()
+	if err := NewWithStore(store).Init(DefaultConfigFor(chunker.FastCDC)); err != nil {
+		t.Fatal("init", err)
+	}
+
+	// The algorithm is recorded, so reopening the store keeps using it.
+	repo := NewWithStore(store)
+	if cfg, err := repo.Config(); err != nil || cfg.Chunker != chunker.FastCDC {
+		t.Fatalf("expected fastcdc config, got %+v, %v", cfg, err)
+	}
+
+	data, err := ioutil.ReadFile(blob1Path)
+	if err != nil {
+		t.Fatal("read blob1")
+	}
+	if err := repo.Add(bytes.NewReader(data), "blob1"); err != nil {
+		t.Fatal("repo add", err)
+	}
+
+	var out bytes.Buffer
+	if err := repo.CatFile("blob1", &out); err != nil {
+		t.Fatal("cat", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Error("fastcdc round trip changed the contents of blob1")
+	}
+}
+
+func TestLegacyConfigUsesSHA1(t *testing.T) {
+	store := NewMemStore()
+	if cfg, err := NewWithStore(store).Config(); err != nil || cfg.Hash != digest.SHA1 {
+		t.Errorf("repository without a config: got %+v, %v", cfg, err)
+	}
+
+	// Configs written before the hash was recorded.
+	store.PutMetadata(configName, []byte(`{"min_chunk_size": 1024, "average_chunk_size": 2048, "max_chunk_size": 4096}`))
+	if cfg, err := NewWithStore(store).Config(); err != nil || cfg.Hash != digest.SHA1 || cfg.MaxChunkSize != 4096 {
+		t.Errorf("config without a hash: got %+v, %v", cfg, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	src := NewWithStore(NewMemStore())
+	src.Init(legacyConfig())
+	for _, path := range []string{blob1Path, blob2Path} {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal("open", path)
+		}
+		if err := src.Add(f, filepath.Base(path)); err != nil {
+			t.Fatal("add", err)
+		}
+		f.Close()
+	}
+	src.AddWithOptions(strings.NewReader("newer"), "blob1", &AddOptions{Message: "replaced"})
+
+	cfg := DefaultConfig()
+	cfg.Hash = digest.BLAKE2b
+	dst := NewWithStore(NewMemStore())
+	if err := dst.Init(cfg); err != nil {
+		t.Fatal("init", err)
+	}
+	if err := Migrate(src, dst); err != nil {
+		t.Fatal("migrate", err)
+	}
+
+	for _, path := range []string{blob1Path, blob2Path} {
+		name := filepath.Base(path)
+		var out bytes.Buffer
+		if err := dst.CatFile(name+"@1", &out); err != nil {
+			t.Fatal("cat", err)
+		}
+		expected, _ := ioutil.ReadFile(path)
+		if !bytes.Equal(out.Bytes(), expected) {
+			t.Errorf("%s changed in migration", name)
+		}
+
+		m, err := dst.LoadManifest(name + "@1")
+		if err != nil {
+			t.Fatal("load manifest", err)
+		}
+		for _, h := range m.Chunks {
+			data, err := dst.ReadChunk(h)
+			if err != nil || digest.Sum(digest.BLAKE2b, data) != h {
+				t.Errorf("%s: chunk %s not addressed by blake2b", name, h)
+			}
+		}
+	}
+
+	versions, err := dst.Log("blob1")
+	if err != nil || len(versions) != 2 || versions[1].Message != "replaced" {
+		t.Errorf("history of blob1 not carried over: %v, %v", versions, err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	store := NewMemStore()
+	cfg := DefaultConfig()
+	cfg.Compression = CompressionGzip
+	repo := NewWithStore(store)
+	if err := repo.Init(cfg); err != nil {
+		t.Fatal("init", err)
+	}
+
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 4000)
+	noise := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(noise)
+
+	for name, data := range map[string][]byte{"text": text, "noise": noise} {
+		if err := repo.Add(bytes.NewReader(data), name); err != nil {
+			t.Fatal("add", err)
+		}
+		var out bytes.Buffer
+		if err := repo.CatFile(name, &out); err != nil {
+			t.Fatal("cat", err)
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Errorf("%s changed in a round trip", name)
+		}
+
+		m, _ := repo.LoadManifest(name)
+		var stored, size int64
+		for _, h := range m.Chunks {
+			n, _ := store.ChunkSize(h)
+			stored += n
+			n, err := repo.ChunkSize(h)
+			if err != nil {
+				t.Fatal("chunk size", err)
+			}
+			size += n
+			chunk, _ := repo.ReadChunk(h)
+			if digest.Sum(cfg.Hash, chunk) != h {
+				t.Errorf("%s: chunk %s isn't named by its uncompressed contents", name, h)
+			}
+		}
+		if size != int64(len(data)) {
+			t.Errorf("%s: chunk sizes add up to %d, not %d", name, size, len(data))
+		}
+		switch name {
+		case "text":
+			if stored > size/10 {
+				t.Errorf("text stored in %d bytes, barely compressed", stored)
+			}
+		case "noise":
+			if stored != size+int64(len(m.Chunks)*(sizeLen+1)) {
+				t.Errorf("noise stored in %d bytes, not raw", stored)
+			}
+		}
+	}
+}
+
+// cheapKDF makes encrypted repositories quick to unlock, until the function
+// it returns is called.
+func cheapKDF() func() {
+	iterations, min := kdfIterations, minKDFIterations
+	kdfIterations, minKDFIterations = 1000, 1000
+	return func() { kdfIterations, minKDFIterations = iterations, min }
+}
+
+func TestEncryption(t *testing.T) {
+	defer cheapKDF()()
+
+	secret := []byte("correct horse battery staple")
+	store := NewMemStore()
+	if err := NewWithKey(store, secret).Init(nil); err != nil {
+		t.Fatal("init", err)
+	}
+
+	repo := NewWithKey(store, secret)
+	data, err := ioutil.ReadFile(blob1Path)
+	if err != nil {
+		t.Fatal("read blob1")
+	}
+	if err := repo.Add(bytes.NewReader(data), "blob1"); err != nil {
+		t.Fatal("add", err)
+	}
+	var out bytes.Buffer
+	if err := repo.CatFile("blob1", &out); err != nil {
+		t.Fatal("cat", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Error("blob1 changed in a round trip")
+	}
+
+	// Nothing in the store gives the contents away.
+	m, err := repo.LoadManifest("blob1")
+	if err != nil {
+		t.Fatal("load manifest", err)
+	}
+	stored, _ := store.GetManifest("blob1")
+	if bytes.Contains(stored, []byte(m.Chunks[0])) {
+		t.Error("manifest stored in the clear")
+	}
+	plain := NewWithStore(NewMemStore())
+	plain.Init(nil)
+	plain.Add(bytes.NewReader(data), "blob1")
+	pm, _ := plain.LoadManifest("blob1")
+	for i, h := range m.Chunks {
+		if h == pm.Chunks[i] {
+			t.Errorf("chunk %d named by an unkeyed hash", i)
+		}
+		stored, _ := store.GetChunk(h)
+		chunk, _ := repo.ReadChunk(h)
+		if bytes.Contains(stored, chunk[:64]) {
+			t.Errorf("chunk %s stored in the clear", h)
+		}
+	}
+
+	if _, err := NewWithStore(store).LoadManifest("blob1"); err != ErrLocked {
+		t.Errorf("expected ErrLocked without a key, got %v", err)
+	}
+	if _, err := NewWithKey(store, []byte("hunter2")).LoadManifest("blob1"); err != ErrWrongKey {
+		t.Errorf("expected ErrWrongKey, got %v", err)
+	}
+
+	// A config weakened to make the key cheap to guess is refused.
+	saved, _ := store.GetMetadata(configName)
+	for _, weaken := range []func(e *Encryption){
+		func(e *Encryption) { e.Iterations = minKDFIterations - 1 },
+		func(e *Encryption) { e.Salt = e.Salt[:minSaltLen-1] },
+		func(e *Encryption) { e.Salt = nil },
+	} {
+		cfg, _ := NewWithKey(store, secret).Config()
+		weak := *cfg
+		e := *cfg.Encryption
+		weaken(&e)
+		weak.Encryption = &e
+		data, _ := json.Marshal(&weak)
+		store.PutMetadata(configName, data)
+		if _, err := NewWithKey(store, secret).Config(); err == nil {
+			t.Errorf("accepted encryption %+v", e)
+		}
+		store.PutMetadata(configName, saved)
+	}
+
+	// Chunks are bound to their names.
+	a, _ := store.GetChunk(m.Chunks[0])
+	store.DeleteChunk(m.Chunks[1])
+	store.PutChunk(m.Chunks[1], a)
+	if _, err := repo.ReadChunk(m.Chunks[1]); err == nil {
+		t.Error("read a chunk stored under another chunk's name")
+	}
+
+	if err := repo.Rm("blob1"); err != nil {
+		t.Fatal("rm", err)
+	}
+	if _, err := repo.GC(GCOptions{}); err != nil {
+		t.Fatal("gc", err)
+	}
+	if chunks, _ := store.ListChunks(); len(chunks) != 0 {
+		t.Errorf("gc left %d chunks behind", len(chunks))
+	}
+}
+
+// headerStore refuses to read whole chunks, to show what needs only their
+// headers.
+type headerStore struct {
+	Store
+}
+
+func (s headerStore) GetChunk(hash string) ([]byte, error) {
+	return nil, fmt.Errorf("read all of chunk %s", hash)
+}
+
+func (s headerStore) ChunkHeader(hash string, n int) ([]byte, error) {
+	return s.Store.(ChunkHeaderReader).ChunkHeader(hash, n)
+}
+
+func TestSizeHeader(t *testing.T) {
+	defer cheapKDF()()
+
+	secret := []byte("correct horse battery staple")
+	data, err := ioutil.ReadFile(blob1Path)
+	if err != nil {
+		t.Fatal("read blob1")
+	}
+
+	for _, tc := range []struct {
+		compression string
+		key         []byte
+	}{
+		{CompressionGzip, nil},
+		{CompressionNone, secret},
+		{CompressionGzip, secret},
+	} {
+		cfg := DefaultConfig()
+		cfg.Compression = tc.compression
+		store := NewMemStore()
+		if err := NewWithKey(store, tc.key).Init(cfg); err != nil {
+			t.Fatal("init", err)
+		}
+		repo := NewWithKey(store, tc.key)
+		if err := repo.Add(bytes.NewReader(data), "blob1"); err != nil {
+			t.Fatal("add", err)
+		}
+		m, _ := repo.LoadManifest("blob1")
+		headers := NewWithKey(headerStore{store}, tc.key)
+		for i, h := range m.Chunks {
+			chunk, _ := repo.ReadChunk(h)
+			if size, err := headers.ChunkSize(h); err != nil || size != int64(len(chunk)) {
+				t.Errorf("%q, encrypted %v: chunk %d size %d, %v, want %d", tc.compression, tc.key != nil, i, size, err, len(chunk))
+			}
+		}
+
+		// A header that disagrees with the contents is caught.
+		rcfg, _ := repo.Config()
+		n := rcfg.headerLen()
+		stored, _ := store.GetChunk(m.Chunks[0])
+		chunk, _ := repo.ReadChunk(m.Chunks[0])
+		wrong, _ := rcfg.encodeChunk(m.Chunks[0], make([]byte, len(chunk)+1))
+		store.DeleteChunk(m.Chunks[0])
+		store.PutChunk(m.Chunks[0], append(wrong[:n:n], stored[n:]...))
+		if _, err := repo.ReadChunk(m.Chunks[0]); err == nil {
+			t.Errorf("%q, encrypted %v: read a chunk with a wrong size header", tc.compression, tc.key != nil)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	store := NewMemStore()
+	repo := NewWithStore(store)
+	repo.Init(nil)
+	for _, path := range []string{blob1Path, blob2Path} {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal("open", path)
+		}
+		if err := repo.Add(f, filepath.Base(path)); err != nil {
+			t.Fatal("add", err)
+		}
+		f.Close()
+	}
+
+	report, err := repo.Verify(false)
+	if err != nil {
+		t.Fatal("verify", err)
+	}
+	// Five chunks of data, and the two manifests.
+	if !report.OK() || len(report.Orphans) != 0 || report.Chunks != 7 {
+		t.Fatalf("intact repository: %+v", report)
+	}
+
+	m1, _ := repo.LoadManifest("blob1")
+	m2, _ := repo.LoadManifest("blob2")
+	shared, only1 := m1.Chunks[0], m1.Chunks[1]
+	if m2.Chunks[0] != shared {
+		t.Fatal("expected blob1 and blob2 to share their first chunk")
+	}
+	data, _ := store.GetChunk(shared)
+	data[0] ^= 1
+	store.PutChunk(shared, data)
+	store.DeleteChunk(only1)
+	store.PutChunk("0123", []byte("orphan"))
+	store.PutManifest("broken", []byte(m2.Chunks[1]+"\nnot a hash\n"))
+
+	report, err = repo.Verify(true)
+	if err != nil {
+		t.Fatal("verify", err)
+	}
+	if report.OK() {
+		t.Fatal("damaged repository passed")
+	}
+	byName := make(map[string]ManifestReport)
+	for _, m := range report.Manifests {
+		byName[m.Name] = m
+	}
+	if m := byName["blob1"]; !reflect.DeepEqual(m.Missing, []string{only1}) || !reflect.DeepEqual(m.Corrupt, []string{shared}) {
+		t.Errorf("blob1: %+v", m)
+	}
+	if m := byName["blob2"]; len(m.Missing) != 0 || !reflect.DeepEqual(m.Corrupt, []string{shared}) {
+		t.Errorf("blob2: %+v", m)
+	}
+	if m := byName["broken"]; !reflect.DeepEqual(m.BadLines, []string{"not a hash"}) || m.OK() {
+		t.Errorf("broken: %+v", m)
+	}
+	if !reflect.DeepEqual(report.Orphans, []string{"0123"}) {
+		t.Errorf("orphans: %v", report.Orphans)
+	}
+	want := []string{"0123", shared}
+	sort.Strings(want)
+	if !reflect.DeepEqual(report.Corrupt, want) {
+		t.Errorf("corrupt: %v", report.Corrupt)
+	}
+
+	if ok, _ := repo.HasChunk(shared); ok {
+		t.Error("corrupt chunk not quarantined")
+	}
+	if q, err := store.GetMetadata(quarantinePrefix + shared); err != nil || !bytes.Equal(q, data) {
+		t.Errorf("quarantined chunk not kept: %v", err)
+	}
+}
+
+func TestInterruptedWritesCleanedUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(dir)
+
+	repo := New(dir)
+	repo.Init(nil)
+	blob1, err := os.Open(blob1Path)
+	if err != nil {
+		t.Fatal("open blob1")
+	}
+	defer blob1.Close()
+	if err := repo.Add(blob1, "blob1"); err != nil {
+		t.Fatal("add", err)
+	}
+
+	temps := func() []string {
+		var found []string
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && isTemp(fi.Name()) {
+				found = append(found, path)
+			}
+			return nil
+		})
+		sort.Strings(found)
+		return found
+	}
+	if found := temps(); len(found) != 0 {
+		t.Fatalf("add left temporary files: %v", found)
+	}
+
+	// What a crash part way through writing a chunk and a manifest leaves.
+	old := time.Now().Add(-2 * staleTempAge)
+	stale := []string{
+		filepath.Join(dir, "chunks", "ab", tempPrefix+"1"),
+		filepath.Join(dir, "manifests", tempPrefix+"2"),
+	}
+	fresh := filepath.Join(dir, "manifests", tempPrefix+"3")
+	os.Mkdir(filepath.Join(dir, "chunks", "ab"), 0755)
+	for _, p := range append(stale, fresh) {
+		if err := ioutil.WriteFile(p, []byte("partial"), 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range stale {
+		os.Chtimes(p, old, old)
+	}
+
+	if names, _ := repo.LsFiles("", true); !reflect.DeepEqual(names, []string{"blob1"}) {
+		t.Errorf("temporary files listed as manifests: %v", names)
+	}
+	if _, err := repo.GC(GCOptions{}); err != nil {
+		t.Fatal("gc", err)
+	}
+	if found := temps(); !reflect.DeepEqual(found, []string{fresh}) {
+		t.Errorf("after gc, temporary files %v; want only the fresh one", found)
+	}
+	var out bytes.Buffer
+	if err := repo.CatFile("blob1", &out); err != nil || out.Len() != 175408 {
+		t.Errorf("blob1 damaged by gc: %d bytes, %v", out.Len(), err)
+	}
+}
+
+func TestGCDryRunAndGrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewDiskStore(dir)
+	repo := NewWithStore(store)
+	repo.Init(nil)
+	for _, path := range []string{blob1Path, blob2Path} {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal("open", path)
+		}
+		if err := repo.Add(f, filepath.Base(path)); err != nil {
+			t.Fatal("add", err)
+		}
+		f.Close()
+	}
+	kept, _ := repo.LoadManifest("blob1")
+	if err := repo.Rm("blob2"); err != nil {
+		t.Fatal("rm", err)
+	}
+	before, _ := store.ListChunks()
+	garbage := len(before) - len(kept.Chunks) - 1 // and blob1's manifest
+
+	var listed []string
+	report, err := repo.GC(GCOptions{DryRun: true, Progress: func(hash string, size int64) {
+		listed = append(listed, hash)
+	}})
+	if err != nil {
+		t.Fatal("dry run", err)
+	}
+	if report.Chunks != garbage || len(listed) != garbage || report.Bytes == 0 {
+		t.Errorf("dry run reported %+v and listed %d chunks; want %d", report, len(listed), garbage)
+	}
+	if after, _ := store.ListChunks(); len(after) != len(before) {
+		t.Error("dry run deleted chunks")
+	}
+
+	report, err = repo.GC(GCOptions{Grace: time.Hour})
+	if err != nil {
+		t.Fatal("gc", err)
+	}
+	if report.Chunks != 0 || report.Spared != garbage {
+		t.Errorf("fresh chunks weren't spared: %+v", report)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(filepath.Join(dir, "chunks", listed[0][:2], listed[0]), old, old)
+	report, err = repo.GC(GCOptions{Grace: time.Hour})
+	if err != nil {
+		t.Fatal("gc", err)
+	}
+	if report.Chunks != 1 || report.Spared != garbage-1 {
+		t.Errorf("expected only the old chunk to go: %+v", report)
+	}
+	if ok, _ := repo.HasChunk(listed[0]); ok {
+		t.Error("old chunk survived")
+	}
+	var out bytes.Buffer
+	if err := repo.CatFile("blob1", &out); err != nil || out.Len() != 175408 {
+		t.Errorf("blob1 damaged by gc: %d bytes, %v", out.Len(), err)
+	}
+}
+
+func TestRmLeavesChunksForGC(t *testing.T) {
+	store := NewMemStore()
+	repo := NewWithStore(store)
+	repo.Init(nil)
+	for _, path := range []string{blob1Path, blob2Path} {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal("open", path)
+		}
+		if err := repo.Add(f, filepath.Base(path)); err != nil {
+			t.Fatal("add", err)
+		}
+		f.Close()
+	}
+	before, _ := store.ListChunks()
+
+	if err := repo.Rm("blob1", "blob2"); err != nil {
+		t.Fatal("rm", err)
+	}
+	if names, _ := repo.LsFiles("", true); len(names) != 0 {
+		t.Errorf("files left after rm: %v", names)
+	}
+	if after, _ := store.ListChunks(); len(after) != len(before) {
+		t.Errorf("rm deleted chunks: %d of %d left", len(after), len(before))
+	}
+	if err := repo.Rm("blob1"); !os.IsNotExist(err) {
+		t.Errorf("expected not-exist error removing a missing file, got %v", err)
+	}
+
+	report, err := repo.GC(GCOptions{})
+	if err != nil {
+		t.Fatal("gc", err)
+	}
+	if report.Chunks != len(before) {
+		t.Errorf("gc removed %d chunks, want %d", report.Chunks, len(before))
+	}
+}
+
+func TestCatVerifies(t *testing.T) {
+	store := NewMemStore()
+	r := NewWithStore(store)
+	r.Init(nil)
+	addFile(t, r, blob1Path, "blob1")
+	m, _ := r.LoadManifest("blob1")
+
+	// Swap the second chunk's contents for the first's.
+	first, _ := store.GetChunk(m.Chunks[0])
+	store.PutChunk(m.Chunks[1], first)
+	var out bytes.Buffer
+	err := r.CatFile("blob1", &out)
+	if err == nil || !strings.Contains(err.Error(), m.Chunks[1]) {
+		t.Errorf("corrupt chunk not named: %v", err)
+	}
+	out.Reset()
+	if err := r.CatFileWithOptions("blob1", &out, &CatOptions{NoVerify: true}); err != nil {
+		t.Errorf("unverified cat: %v", err)
+	}
+	f, _ := r.Open("blob1")
+	if _, err := f.ReadAt(make([]byte, 10), m.Sizes[0]); err == nil {
+		t.Error("read a corrupt chunk through Open")
+	}
+	f.Close()
+
+	// Intact chunks that don't make up the file the digest describes.
+	addFile(t, r, blob1Path, "blob1")
+	m, _ = r.LoadManifest("blob1")
+	m.Digest = "sha256:" + digest.Sum(digest.SHA256, []byte("something else"))
+	r.WriteManifest("blob1", m)
+	if err := r.CatFile("blob1", &out); err == nil || !strings.Contains(err.Error(), "blob1 is corrupt") {
+		t.Errorf("digest mismatch not reported: %v", err)
+	}
+}
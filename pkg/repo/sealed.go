@@ -0,0 +1,191 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// An encrypted repository is exchanged with a remote sealed: chunks as they
+// are stored, and a name's history as the client seals it, so that a
+// server holding the repository needs no key. The server can't check what
+// it is given, but a client checks everything it fetches, which must open
+// under its key and hash to its name.
+//
+// Only an encrypted repository is exchanged this way. Others exchange
+// chunks' contents, as they may store them differently.
+
+// errNotEncrypted is returned by the sealed methods of a repository that
+// isn't encrypted.
+var errNotEncrypted = errors.New("repository isn't encrypted, so has nothing sealed")
+
+// sealedConfig returns the stored config of an encrypted repository.
+func (c *repo) sealedConfig() (*Config, error) {
+	cfg, err := c.StoredConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Encryption == nil {
+		return nil, errNotEncrypted
+	}
+	return cfg, nil
+}
+
+// ReadStoredChunk returns a chunk of an encrypted repository as stored.
+func (c *repo) ReadStoredChunk(hash string) ([]byte, error) {
+	if _, err := c.sealedConfig(); err != nil {
+		return nil, err
+	}
+	return c.store.GetChunk(hash)
+}
+
+// StoredChunkSize returns the size of a chunk of an encrypted repository as
+// stored.
+func (c *repo) StoredChunkSize(hash string) (int64, error) {
+	if _, err := c.sealedConfig(); err != nil {
+		return 0, err
+	}
+	return c.store.ChunkSize(hash)
+}
+
+// WriteStoredChunk stores a chunk received sealed from a copy of this
+// encrypted repository. With the key, it refuses a chunk that doesn't open
+// or hash to its name; without, it can only take the chunk on trust.
+func (c *repo) WriteStoredChunk(hash string, stored []byte) error {
+	if _, err := c.sealedConfig(); err != nil {
+		return err
+	}
+	if c.secret != nil {
+		if _, err := c.OpenChunk(hash, stored); err != nil {
+			return err
+		}
+	}
+	return c.putChunk(hash, stored)
+}
+
+// OpenChunk returns the contents of a chunk as a copy of this encrypted
+// repository stores it, refusing it if it doesn't open or hash to its name.
+func (c *repo) OpenChunk(hash string, stored []byte) ([]byte, error) {
+	cfg, err := c.Config()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Encryption == nil {
+		return nil, errNotEncrypted
+	}
+	data, err := cfg.decodeChunk(hash, stored)
+	if err != nil {
+		return nil, err
+	}
+	if actual := cfg.sum(data); actual != hash {
+		return nil, fmt.Errorf("chunk %s has hash %s", hash, actual)
+	}
+	return data, nil
+}
+
+// ReadStoredManifest returns the history of name in an encrypted repository
+// as stored.
+func (c *repo) ReadStoredManifest(name string) ([]byte, error) {
+	if _, err := c.sealedConfig(); err != nil {
+		return nil, err
+	}
+	if err := ValidName(name); err != nil {
+		return nil, err
+	}
+	return c.store.GetManifest(name)
+}
+
+// WriteStoredManifest replaces the history of name in an encrypted
+// repository with one sealed by a client; see SealVersion. The references
+// it makes can't be counted without the key, so the reference index is
+// dropped, and the next GC counts them all.
+func (c *repo) WriteStoredManifest(name string, stored []byte) error {
+	unlock, err := c.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := c.sealedConfig(); err != nil {
+		return err
+	}
+	if err := ValidName(name); err != nil {
+		return err
+	}
+	if c.secret != nil {
+		if _, err := c.OpenHistory(name, stored); err != nil {
+			return err
+		}
+	}
+
+	unlockIndex, err := c.lock(indexLock, true)
+	if err != nil {
+		return err
+	}
+	defer unlockIndex()
+	if err := c.checkParents(name); err != nil {
+		return err
+	}
+	if err := c.dropIndex(); err != nil {
+		return err
+	}
+	return c.store.PutManifest(name, stored)
+}
+
+// OpenHistory returns the versions in stored, the history of name as a copy
+// of this encrypted repository stores it, oldest first. Their manifests
+// aren't loaded: each is the chunk named by its ID.
+func (c *repo) OpenHistory(name string, stored []byte) ([]Version, error) {
+	cfg, err := c.Config()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Encryption == nil {
+		return nil, errNotEncrypted
+	}
+	data, err := cfg.decodeManifest(name, stored)
+	if err != nil {
+		return nil, err
+	}
+	h, err := parseHistory(cfg, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	versions := make([]Version, len(h.Versions))
+	for i, e := range h.Versions {
+		versions[i] = Version{Number: e.Number, Time: e.Time, Message: e.Message, ID: e.ID}
+	}
+	return versions, nil
+}
+
+// SealVersion returns stored, the history of name as a copy of this
+// encrypted repository stores it, with the manifest id added as its latest
+// version, unless it is already. stored is nil for a name not yet written.
+func (c *repo) SealVersion(name string, stored []byte, id string) ([]byte, error) {
+	cfg, err := c.Config()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Encryption == nil {
+		return nil, errNotEncrypted
+	}
+	h := &history{}
+	if stored != nil {
+		data, err := cfg.decodeManifest(name, stored)
+		if err != nil {
+			return nil, err
+		}
+		if h, err = parseHistory(cfg, data); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	e := historyEntry{Number: 1, Time: time.Now().UTC().Truncate(time.Second), ID: id}
+	if len(h.Versions) > 0 {
+		if h.latest().ID == id {
+			return stored, nil
+		}
+		e.Number = h.latest().Number + 1
+	}
+	h.Versions = append(h.Versions, e)
+	return cfg.encodeManifest(name, h.bytes())
+}
@@ -0,0 +1,68 @@
+package repo
+
+import (
+	"os"
+	"time"
+)
+
+// Store is the storage backend underneath a Repo. It holds three
+// namespaces of opaque byte strings: chunks keyed by hash, manifests keyed
+// by name, and metadata keyed by file name. Manifest names may be
+// slash-separated paths; see ValidName. ListManifests lists them in full,
+// those in one directory or every one.
+//
+// Lookups of missing keys return an error satisfying os.IsNotExist.
+type Store interface {
+	// Init prepares a new, empty store.
+	Init() error
+
+	GetChunk(hash string) ([]byte, error)
+	PutChunk(hash string, data []byte) error
+	HasChunk(hash string) (bool, error)
+	ChunkSize(hash string) (int64, error)
+	DeleteChunk(hash string) error
+	ListChunks() ([]string, error)
+
+	GetManifest(name string) ([]byte, error)
+	PutManifest(name string, data []byte) error
+	HasManifest(name string) (bool, error)
+	DeleteManifest(name string) error
+	// ListManifests lists the manifests in the directory dir and those
+	// below it, or every manifest if dir is empty.
+	ListManifests(dir string) ([]string, error)
+
+	GetMetadata(name string) ([]byte, error)
+	PutMetadata(name string, data []byte) error
+}
+
+func notExist(op, key string) error {
+	return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+}
+
+// Flusher is implemented by stores that buffer chunk writes. A Repo
+// flushes before writing a manifest, so that a manifest never refers to
+// chunks that could still be lost.
+type Flusher interface {
+	Flush() error
+}
+
+// Packer is implemented by stores that keep chunks together in packs, where
+// deleting a chunk doesn't free its space. Repack rewrites the packs with
+// only the chunks still present.
+type Packer interface {
+	Repack() error
+}
+
+// ChunkHeaderReader is implemented by stores that can read the start of a
+// chunk without the rest of it. ChunkHeader returns the first n bytes of
+// the chunk, or all of it if it is shorter.
+type ChunkHeaderReader interface {
+	ChunkHeader(hash string, n int) ([]byte, error)
+}
+
+// Cleaner is implemented by stores that a crash can leave holding partly
+// written files. GC calls Clean to remove those older than olderThan;
+// younger ones may still be in use.
+type Cleaner interface {
+	Clean(olderThan time.Duration) error
+}
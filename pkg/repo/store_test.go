@@ -0,0 +1,84 @@
+package repo_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/burke/rabit/pkg/digest"
+	"github.com/burke/rabit/pkg/repo"
+	"github.com/burke/rabit/pkg/repo/storetest"
+)
+
+func TestDiskStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(dir)
+
+	storetest.Run(t, repo.NewDiskStore(dir))
+}
+
+func TestMemStore(t *testing.T) {
+	storetest.Run(t, repo.NewMemStore())
+}
+
+func TestRepoOnMemStore(t *testing.T) {
+	// The chunk names below are SHA-1 hashes.
+	cfg := repo.DefaultConfig()
+	cfg.Hash = digest.SHA1
+	r := repo.NewWithStore(repo.NewMemStore())
+	if err := r.Init(cfg); err != nil {
+		t.Fatal("init")
+	}
+
+	for _, name := range []string{"blob1", "blob2"} {
+		f, err := os.Open("testfiles/" + name)
+		if err != nil {
+			t.Fatal("open", name)
+		}
+		if err := r.Add(f, name); err != nil {
+			t.Fatal("repo add", err)
+		}
+		f.Close()
+	}
+
+	if err := r.Rm("blob1"); err != nil {
+		t.Fatal("rm", err)
+	}
+	if _, err := r.GC(repo.GCOptions{}); err != nil {
+		t.Fatal("gc", err)
+	}
+	if ok, _ := r.HasChunk("24662838814f422b3050a99575b29a62d8af9e0f"); !ok {
+		t.Error("chunk shared with blob2 didn't survive rm")
+	}
+	for _, h := range []string{
+		"270d8cd95b5f56d0153c37c17ba9bda6de181185",
+		"35d23ee504acbb6dfd638a44167d7bb0f182d442",
+	} {
+		if ok, _ := r.HasChunk(h); ok {
+			t.Errorf("chunk %s only used by blob1 survived rm", h)
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := r.CatFile("blob2", buf); err != nil {
+		t.Fatal("cat", err)
+	}
+	expected, _ := ioutil.ReadFile("testfiles/blob2")
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Error("compare failed")
+	}
+}
+
+func TestPackStoreConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(dir)
+
+	storetest.Run(t, repo.NewPackStore(dir))
+}
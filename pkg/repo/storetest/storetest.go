@@ -0,0 +1,149 @@
+// Package storetest checks that a repo.Store implementation behaves the way
+// package repo expects.
+package storetest
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/burke/rabit/pkg/repo"
+)
+
+// Run checks the behaviour every repo.Store implementation must share. s
+// must be freshly created and empty.
+func Run(t *testing.T, s repo.Store) {
+	if err := s.Init(); err != nil {
+		t.Fatal("init", err)
+	}
+
+	const h1 = "24662838814f422b3050a99575b29a62d8af9e0f"
+	const h2 = "270d8cd95b5f56d0153c37c17ba9bda6de181185"
+
+	if _, err := s.GetChunk(h1); !os.IsNotExist(err) {
+		t.Errorf("expected not-exist error for missing chunk, got %v", err)
+	}
+	if ok, err := s.HasChunk(h1); ok || err != nil {
+		t.Errorf("HasChunk on empty store: %v, %v", ok, err)
+	}
+
+	if err := s.PutChunk(h1, []byte("one")); err != nil {
+		t.Fatal("put chunk", err)
+	}
+	if err := s.PutChunk(h2, []byte("two!")); err != nil {
+		t.Fatal("put chunk", err)
+	}
+	if data, err := s.GetChunk(h1); err != nil || string(data) != "one" {
+		t.Errorf("get chunk: %q, %v", data, err)
+	}
+	if ok, err := s.HasChunk(h1); !ok || err != nil {
+		t.Errorf("HasChunk: %v, %v", ok, err)
+	}
+	if size, err := s.ChunkSize(h2); size != 4 || err != nil {
+		t.Errorf("ChunkSize: %d, %v", size, err)
+	}
+
+	if timer, ok := s.(repo.ChunkTimer); ok {
+		written, err := timer.ChunkTime(h2)
+		if err != nil || time.Since(written) > time.Minute || time.Until(written) > time.Minute {
+			t.Errorf("ChunkTime of a new chunk: %v, %v", written, err)
+		}
+		if _, err := timer.ChunkTime("0000000000000000000000000000000000000000"); !os.IsNotExist(err) {
+			t.Errorf("expected not-exist error for the time of a missing chunk, got %v", err)
+		}
+	}
+
+	if hr, ok := s.(repo.ChunkHeaderReader); ok {
+		if header, err := hr.ChunkHeader(h2, 2); err != nil || string(header) != "tw" {
+			t.Errorf("ChunkHeader: %q, %v", header, err)
+		}
+		if header, err := hr.ChunkHeader(h1, 10); err != nil || string(header) != "one" {
+			t.Errorf("ChunkHeader longer than the chunk: %q, %v", header, err)
+		}
+		if _, err := hr.ChunkHeader("0000000000000000000000000000000000000000", 2); !os.IsNotExist(err) {
+			t.Errorf("expected not-exist error for the header of a missing chunk, got %v", err)
+		}
+	}
+
+	hashes, err := s.ListChunks()
+	if err != nil {
+		t.Fatal("list chunks", err)
+	}
+	sort.Strings(hashes)
+	if !reflect.DeepEqual(hashes, []string{h1, h2}) {
+		t.Errorf("ListChunks: %v", hashes)
+	}
+
+	if err := s.DeleteChunk(h1); err != nil {
+		t.Fatal("delete chunk", err)
+	}
+	if ok, _ := s.HasChunk(h1); ok {
+		t.Error("chunk still present after delete")
+	}
+	if err := s.DeleteChunk(h1); !os.IsNotExist(err) {
+		t.Errorf("expected not-exist error deleting missing chunk, got %v", err)
+	}
+
+	if err := s.PutManifest("blob", []byte(h2+"\n")); err != nil {
+		t.Fatal("put manifest", err)
+	}
+	if ok, err := s.HasManifest("blob"); !ok || err != nil {
+		t.Errorf("HasManifest: %v, %v", ok, err)
+	}
+	if names, err := s.ListManifests(""); err != nil || !reflect.DeepEqual(names, []string{"blob"}) {
+		t.Errorf("ListManifests: %v, %v", names, err)
+	}
+	if err := s.DeleteManifest("blob"); err != nil {
+		t.Fatal("delete manifest", err)
+	}
+	if _, err := s.GetManifest("blob"); !os.IsNotExist(err) {
+		t.Errorf("expected not-exist error for deleted manifest, got %v", err)
+	}
+
+	for _, name := range []string{"dir/sub/blob", "dir/blob"} {
+		if err := s.PutManifest(name, []byte(h2+"\n")); err != nil {
+			t.Fatal("put nested manifest", err)
+		}
+	}
+	names, err := s.ListManifests("")
+	sort.Strings(names)
+	if err != nil || !reflect.DeepEqual(names, []string{"dir/blob", "dir/sub/blob"}) {
+		t.Errorf("ListManifests: %v, %v", names, err)
+	}
+	for dir, want := range map[string][]string{
+		"dir":      {"dir/blob", "dir/sub/blob"},
+		"dir/sub":  {"dir/sub/blob"},
+		"di":       nil,
+		"dir/blob": nil,
+		"missing":  nil,
+	} {
+		names, err := s.ListManifests(dir)
+		sort.Strings(names)
+		if err != nil || len(names) != len(want) || len(want) > 0 && !reflect.DeepEqual(names, want) {
+			t.Errorf("ListManifests(%q): %v, %v; want %v", dir, names, err, want)
+		}
+	}
+	if data, err := s.GetManifest("dir/sub/blob"); err != nil || string(data) != h2+"\n" {
+		t.Errorf("get nested manifest: %q, %v", data, err)
+	}
+	for _, name := range []string{"dir/sub/blob", "dir/blob"} {
+		if err := s.DeleteManifest(name); err != nil {
+			t.Fatal("delete nested manifest", err)
+		}
+	}
+	if names, err := s.ListManifests(""); err != nil || len(names) != 0 {
+		t.Errorf("ListManifests after deleting everything: %v, %v", names, err)
+	}
+
+	if _, err := s.GetMetadata("root.json"); !os.IsNotExist(err) {
+		t.Errorf("expected not-exist error for missing metadata, got %v", err)
+	}
+	if err := s.PutMetadata("root.json", []byte("{}")); err != nil {
+		t.Fatal("put metadata", err)
+	}
+	if data, err := s.GetMetadata("root.json"); err != nil || string(data) != "{}" {
+		t.Errorf("get metadata: %q, %v", data, err)
+	}
+}
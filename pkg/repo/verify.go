@@ -0,0 +1,244 @@
+package repo
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// quarantinePrefix is where Verify moves corrupt chunks, in the metadata
+// namespace, so that they can be examined but are no longer served.
+const quarantinePrefix = "quarantine/"
+
+// Report is the result of Verify.
+type Report struct {
+	Manifests []ManifestReport
+	Chunks    int      // number of chunks checked
+	Corrupt   []string // chunks whose contents don't match their names
+	Orphans   []string // chunks no manifest refers to
+
+	// Quarantined lists the corrupt chunks moved aside, if quarantining
+	// was asked for.
+	Quarantined []string
+}
+
+// ManifestReport describes what is wrong with one manifest.
+type ManifestReport struct {
+	Name string
+	// Err is set if the manifest couldn't be read at all.
+	Err error
+	// BadLines holds the lines that aren't chunk hashes.
+	BadLines []string
+	// Missing and Corrupt list the chunks the file needs that are absent
+	// or damaged.
+	Missing []string
+	Corrupt []string
+}
+
+// OK reports whether the file the manifest describes is intact.
+func (m *ManifestReport) OK() bool {
+	return m.Err == nil && len(m.BadLines) == 0 && len(m.Missing) == 0 && len(m.Corrupt) == 0
+}
+
+// OK reports whether Verify found nothing wrong. Orphan chunks are only
+// wasted space, so they don't count.
+func (r *Report) OK() bool {
+	for i := range r.Manifests {
+		if !r.Manifests[i].OK() {
+			return false
+		}
+	}
+	return len(r.Corrupt) == 0
+}
+
+// verifyWorkers is how many chunks Verify rehashes at once.
+const verifyWorkers = 8
+
+// Verify reads and rehashes every chunk in the repository, and checks every
+// manifest for malformed lines and for chunks that are missing or corrupt.
+// If quarantine is set, corrupt chunks are moved out of the chunk store, so
+// that a later fetch replaces them. Errors reading from the store, as
+// opposed to problems with what it holds, abort the check.
+func (c *repo) Verify(quarantine bool) (*Report, error) {
+	var unlock func()
+	var err error
+	if quarantine {
+		unlock, err = c.Lock(false) // it moves chunks, so it can't go unlocked
+	} else {
+		unlock, err = c.readLock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	cfg, err := c.Config()
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := c.store.ListChunks()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(hashes)
+	report := &Report{Chunks: len(hashes)}
+
+	corrupt, err := c.verifyChunks(cfg, hashes)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hashes {
+		if corrupt[h] {
+			report.Corrupt = append(report.Corrupt, h)
+		}
+	}
+
+	present := make(map[string]bool, len(hashes))
+	for _, h := range hashes {
+		present[h] = true
+	}
+	referenced := make(map[string]bool)
+
+	names, err := c.store.ListManifests("")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := ManifestReport{Name: name}
+		chunks, bad, err := c.loadManifestLenient(cfg, name)
+		if err != nil {
+			m.Err = err
+			report.Manifests = append(report.Manifests, m)
+			continue
+		}
+		m.BadLines = bad
+		seen := make(map[string]bool)
+		for _, h := range chunks {
+			referenced[h] = true
+			if seen[h] {
+				continue
+			}
+			seen[h] = true
+			switch {
+			case !present[h]:
+				m.Missing = append(m.Missing, h)
+			case corrupt[h]:
+				m.Corrupt = append(m.Corrupt, h)
+			}
+		}
+		report.Manifests = append(report.Manifests, m)
+	}
+
+	for _, h := range hashes {
+		if !referenced[h] {
+			report.Orphans = append(report.Orphans, h)
+		}
+	}
+
+	if quarantine {
+		for _, h := range report.Corrupt {
+			if err := c.quarantineChunk(h); err != nil {
+				return report, err
+			}
+			report.Quarantined = append(report.Quarantined, h)
+		}
+	}
+	return report, nil
+}
+
+// verifyChunks rehashes hashes in parallel and returns the corrupt ones.
+func (c *repo) verifyChunks(cfg *Config, hashes []string) (map[string]bool, error) {
+	var mu sync.Mutex
+	corrupt := make(map[string]bool)
+	var firstErr error
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < verifyWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for h := range work {
+				stored, err := c.store.GetChunk(h)
+				if os.IsNotExist(err) {
+					continue // deleted since it was listed
+				}
+				bad := false
+				if err == nil {
+					data, derr := cfg.decodeChunk(h, stored)
+					bad = derr != nil || cfg.sum(data) != h
+				}
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				if bad {
+					corrupt[h] = true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, h := range hashes {
+		work <- h
+	}
+	close(work)
+	wg.Wait()
+
+	return corrupt, firstErr
+}
+
+// loadManifestLenient reads a file's history, returning the valid chunk
+// hashes in every version of it and, separately, any lines that aren't
+// hashes. Only a version 1 manifest can be read in part like this.
+func (c *repo) loadManifestLenient(cfg *Config, name string) ([]string, []string, error) {
+	stored, err := c.store.GetManifest(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := cfg.decodeManifest(name, stored)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isManifestJSON(data) {
+		h, err := parseHistory(cfg, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		var hashes []string
+		for _, e := range h.Versions {
+			// A manifest that is missing or corrupt is reported as a
+			// chunk; its own chunks can't be checked.
+			hashes = append(hashes, e.ID)
+			if m, err := c.entryManifest(cfg, &e); err == nil {
+				hashes = append(hashes, m.Chunks...)
+			}
+		}
+		return distinct(hashes), nil, nil
+	}
+	var hashes, bad []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		switch {
+		case line == "":
+		case ValidHash(line):
+			hashes = append(hashes, line)
+		default:
+			bad = append(bad, line)
+		}
+	}
+	return hashes, bad, nil
+}
+
+func (c *repo) quarantineChunk(hash string) error {
+	stored, err := c.store.GetChunk(hash)
+	if err != nil {
+		return err
+	}
+	if err := c.store.PutMetadata(quarantinePrefix+hash, stored); err != nil {
+		return err
+	}
+	return c.store.DeleteChunk(hash)
+}
@@ -26,29 +26,41 @@ import ()
 const windowSize = 64
 const charOffset = 31
 
-const blobBits = 13
-const blobSize = 1 << blobBits // 8k
-const blobMask = blobSize - 1
-const splitMask = ((^0) & (blobSize - 1))
+// DefaultBits gives split points every 8k on average.
+const DefaultBits = 13
 
 type RollSum struct {
 	s1, s2 uint32
 	window [windowSize]uint8
 	wofs   int
+	mask   uint32
 }
 
 func New() *RollSum {
+	return NewWithBits(DefaultBits)
+}
+
+// NewWithBits returns a RollSum that splits every 1<<bits bytes on average.
+func NewWithBits(bits uint) *RollSum {
 	return &RollSum{
-		s1: windowSize * charOffset,
-		s2: windowSize * (windowSize - 1) * charOffset,
+		s1:   windowSize * charOffset,
+		s2:   windowSize * (windowSize - 1) * charOffset,
+		mask: 1<<bits - 1,
 	}
 }
 
+// Roll adds a byte to the window and reports whether the window now ends on
+// a split point.
 func (rs *RollSum) Roll(add byte) bool {
 	drop := rs.window[rs.wofs]
 	rs.s1 += uint32(add) - uint32(drop)
 	rs.s2 += rs.s1 - uint32(windowSize)*uint32(drop+charOffset)
 	rs.window[rs.wofs] = add
 	rs.wofs = (rs.wofs + 1) % windowSize
-	return (rs.s2 & blobMask) == splitMask
+	return rs.OnSplit()
+}
+
+// OnSplit reports whether the window currently ends on a split point.
+func (rs *RollSum) OnSplit() bool {
+	return (rs.s2 & rs.mask) == rs.mask
 }
@@ -0,0 +1,140 @@
+package s3store
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeS3 is an in-process stand-in for the parts of the S3 API the store
+// uses. It serves a single bucket with path-style requests, and pages
+// listings pageSize keys at a time.
+type fakeS3 struct {
+	mu       sync.Mutex
+	bucket   string
+	objects  map[string][]byte
+	modified map[string]time.Time
+	pageSize int
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: make(map[string][]byte), modified: make(map[string]time.Time), pageSize: 2}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == f.bucket {
+		f.list(w, r)
+		return
+	}
+	if !strings.HasPrefix(path, f.bucket+"/") {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(path, f.bucket+"/")
+	data, exists := f.objects[key]
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if !exists {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", f.modified[key].UTC().Format(http.TimeFormat))
+		var first, last int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last); err == nil && first < len(data) {
+			if last >= len(data) {
+				last = len(data) - 1
+			}
+			data = data[first : last+1]
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		w.Write(data)
+	case "PUT":
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			http.Error(w, "PreconditionFailed", http.StatusPreconditionFailed)
+			return
+		}
+		if m := r.Header.Get("If-Match"); m != "" && (!exists || m != etag(data)) {
+			http.Error(w, "PreconditionFailed", http.StatusPreconditionFailed)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = body
+		f.modified[key] = time.Now()
+		w.Header().Set("ETag", etag(body))
+	case "DELETE":
+		delete(f.objects, key)
+		delete(f.modified, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("list-type") != "2" {
+		http.Error(w, "only ListObjectsV2 is supported", http.StatusBadRequest)
+		return
+	}
+	prefix := q.Get("prefix")
+	pageSize := f.pageSize
+	if n, err := strconv.Atoi(q.Get("max-keys")); err == nil && n < pageSize {
+		pageSize = n
+	}
+
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) && k > q.Get("continuation-token") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key  string
+		Size int64
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	if len(keys) > pageSize {
+		keys = keys[:pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, k := range keys {
+		result.Contents = append(result.Contents, content{k, int64(len(f.objects[k]))})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header)
+	xml.NewEncoder(w).Encode(result)
+}
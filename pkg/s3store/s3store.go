@@ -0,0 +1,403 @@
+// Package s3store implements a repo.Store on top of an S3-compatible
+// object store.
+//
+// Objects use the same layout as a repository on disk, relative to an
+// optional key prefix within the bucket:
+//
+//	chunks/xx/<hash>
+//	manifests/<name>
+//	metadata/<name>
+//
+// Chunks are written with single PUTs, and only if they don't already
+// exist. Manifest writes are conditional on the manifest not having
+// changed since it was last looked at, so two writers racing to publish
+// the same name can't silently clobber each other.
+package s3store
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/burke/rabit/pkg/repo"
+)
+
+// ErrConflict is returned when a manifest changed underneath a write.
+var ErrConflict = errors.New("s3store: manifest was modified concurrently")
+
+// Config locates a bucket and the credentials to use with it.
+type Config struct {
+	Endpoint  string // e.g. https://s3.us-east-1.amazonaws.com
+	Region    string
+	Bucket    string
+	Prefix    string // optional, prepended to every key
+	AccessKey string
+	SecretKey string
+}
+
+type store struct {
+	cfg  Config
+	http *http.Client
+}
+
+// New returns a Store keeping objects in the bucket described by cfg. The
+// bucket must already exist. Requests use path-style addressing.
+func New(cfg Config) repo.Store {
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+	if cfg.Prefix != "" && !strings.HasSuffix(cfg.Prefix, "/") {
+		cfg.Prefix += "/"
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	return &store{cfg: cfg, http: http.DefaultClient}
+}
+
+func chunkKey(hash string) string {
+	return "chunks/" + hash[0:2] + "/" + hash
+}
+
+func manifestKey(name string) string {
+	return "manifests/" + name
+}
+
+func metadataKey(name string) string {
+	return "metadata/" + name
+}
+
+func (s *store) objectURL(key string) string {
+	return s.cfg.Endpoint + "/" + uriEncode(s.cfg.Bucket+"/"+s.cfg.Prefix+key, false)
+}
+
+func (s *store) do(method, u string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	payloadHash := emptyPayloadSHA
+	if body != nil {
+		payloadHash = sha256Hex(body)
+	}
+	signV4(req, s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.Region, payloadHash, time.Now())
+	return s.http.Do(req)
+}
+
+func statusError(method, key string, resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("s3store: %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (s *store) get(key string) ([]byte, error) {
+	resp, err := s.do("GET", s.objectURL(key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return ioutil.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	default:
+		return nil, statusError("GET", key, resp)
+	}
+}
+
+// head returns the size and headers, such as the ETag, of an object, or an
+// error satisfying os.IsNotExist.
+func (s *store) head(key string) (int64, http.Header, error) {
+	resp, err := s.do("HEAD", s.objectURL(key), nil, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, resp.Header, nil
+	case http.StatusNotFound:
+		return 0, nil, &os.PathError{Op: "head", Path: key, Err: os.ErrNotExist}
+	default:
+		return 0, nil, statusError("HEAD", key, resp)
+	}
+}
+
+func (s *store) has(key string) (bool, error) {
+	_, _, err := s.head(key)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// put writes an object. It reports false, with no error, if a condition in
+// header wasn't met.
+func (s *store) put(key string, data []byte, header http.Header) (bool, error) {
+	resp, err := s.do("PUT", s.objectURL(key), data, header)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return true, nil
+	case http.StatusPreconditionFailed:
+		return false, nil
+	default:
+		return false, statusError("PUT", key, resp)
+	}
+}
+
+// S3 deletes succeed whether or not the object existed, so we check first
+// to honour the Store contract.
+func (s *store) delete(key string) error {
+	if _, _, err := s.head(key); err != nil {
+		return err
+	}
+	resp, err := s.do("DELETE", s.objectURL(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return statusError("DELETE", key, resp)
+	}
+	return nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key  string
+		Size int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list returns the keys under prefix, relative to it, following
+// continuation tokens until the listing is complete.
+func (s *store) list(prefix string) ([]string, error) {
+	full := s.cfg.Prefix + prefix
+	var keys []string
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", full)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u := s.cfg.Endpoint + "/" + uriEncode(s.cfg.Bucket, false) + "?" + q.Encode()
+
+		resp, err := s.do("GET", u, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := statusError("LIST", full, resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, full))
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		if result.NextContinuationToken == "" {
+			return nil, fmt.Errorf("s3store: truncated listing without a continuation token")
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Init checks that the bucket is reachable with the configured credentials.
+func (s *store) Init() error {
+	q := url.Values{}
+	q.Set("list-type", "2")
+	q.Set("max-keys", "1")
+	resp, err := s.do("GET", s.cfg.Endpoint+"/"+uriEncode(s.cfg.Bucket, false)+"?"+q.Encode(), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError("LIST", s.cfg.Bucket, resp)
+	}
+	return nil
+}
+
+func (s *store) GetChunk(hash string) ([]byte, error) {
+	return s.get(chunkKey(hash))
+}
+
+// ChunkHeader fetches only the start of the chunk, with a range request.
+func (s *store) ChunkHeader(hash string, n int) ([]byte, error) {
+	key := chunkKey(hash)
+	resp, err := s.do("GET", s.objectURL(key), nil, http.Header{"Range": {fmt.Sprintf("bytes=0-%d", n-1)}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return ioutil.ReadAll(io.LimitReader(resp.Body, int64(n)))
+	case http.StatusNotFound:
+		return nil, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	default:
+		return nil, statusError("GET", key, resp)
+	}
+}
+
+// PutChunk doesn't overwrite: chunks are named by their contents, so an
+// existing object already holds the same bytes.
+func (s *store) PutChunk(hash string, data []byte) error {
+	_, err := s.put(chunkKey(hash), data, http.Header{"If-None-Match": {"*"}})
+	return err
+}
+
+func (s *store) HasChunk(hash string) (bool, error) {
+	return s.has(chunkKey(hash))
+}
+
+func (s *store) ChunkSize(hash string) (int64, error) {
+	size, _, err := s.head(chunkKey(hash))
+	return size, err
+}
+
+// ChunkTime returns the chunk's Last-Modified time. Chunks are never
+// overwritten, so this is when the chunk was first written.
+func (s *store) ChunkTime(hash string) (time.Time, error) {
+	key := chunkKey(hash)
+	_, header, err := s.head(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("s3store: HEAD %s: bad Last-Modified: %s", key, err)
+	}
+	return t, nil
+}
+
+func (s *store) DeleteChunk(hash string) error {
+	return s.delete(chunkKey(hash))
+}
+
+func (s *store) ListChunks() ([]string, error) {
+	keys, err := s.list("chunks/")
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if i := strings.LastIndex(k, "/"); i >= 0 {
+			k = k[i+1:]
+		}
+		hashes = append(hashes, k)
+	}
+	return hashes, nil
+}
+
+func (s *store) GetManifest(name string) ([]byte, error) {
+	return s.get(manifestKey(name))
+}
+
+// PutManifest only replaces the version of the manifest it saw just before
+// writing, and returns ErrConflict if someone else got there first.
+func (s *store) PutManifest(name string, data []byte) error {
+	key := manifestKey(name)
+	header := http.Header{}
+	_, current, err := s.head(key)
+	switch {
+	case err == nil:
+		header.Set("If-Match", current.Get("ETag"))
+	case os.IsNotExist(err):
+		header.Set("If-None-Match", "*")
+	default:
+		return err
+	}
+
+	ok, err := s.put(key, data, header)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (s *store) HasManifest(name string) (bool, error) {
+	return s.has(manifestKey(name))
+}
+
+func (s *store) DeleteManifest(name string) error {
+	return s.delete(manifestKey(name))
+}
+
+func (s *store) ListManifests(dir string) ([]string, error) {
+	if dir == "" {
+		return s.list("manifests/")
+	}
+	names, err := s.list(manifestKey(dir) + "/")
+	for i := range names {
+		names[i] = dir + "/" + names[i]
+	}
+	return names, err
+}
+
+func (s *store) GetMetadata(name string) ([]byte, error) {
+	return s.get(metadataKey(name))
+}
+
+func (s *store) PutMetadata(name string, data []byte) error {
+	_, err := s.put(metadataKey(name), data, nil)
+	return err
+}
+
+// ParseURL turns an s3://bucket/prefix URL into a Config, taking the
+// endpoint, region and credentials from the usual AWS environment
+// variables. AWS_ENDPOINT_URL selects an S3-compatible service other than
+// AWS itself.
+func ParseURL(s string) (Config, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return Config{}, err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return Config{}, fmt.Errorf("s3store: %q is not an s3://bucket/prefix URL", s)
+	}
+	cfg := Config{
+		Bucket:    u.Host,
+		Prefix:    strings.TrimPrefix(u.Path, "/"),
+		Region:    os.Getenv("AWS_REGION"),
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Endpoint:  os.Getenv("AWS_ENDPOINT_URL"),
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	return cfg, nil
+}
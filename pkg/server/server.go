@@ -0,0 +1,353 @@
+// Package server exposes a rabit repository over HTTP so that it can be
+// used as a remote by push, fetch and ls-remote. See package remote for a
+// description of the protocol.
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/burke/rabit/pkg/repo"
+	"github.com/burke/rabit/pkg/tuf"
+)
+
+// maxChunkSize bounds the size of an uploaded chunk or manifest. It is well
+// above anything the chunker produces.
+const maxChunkSize = 64 << 20
+
+// Server is an http.Handler serving a single repository.
+type Server struct {
+	repo  repo.Repo
+	token string
+}
+
+// New returns a Server for r. Uploads must present token as a bearer token;
+// if token is empty the server is read-only.
+func New(r repo.Repo, token string) *Server {
+	return &Server{repo: r, token: token}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/manifests":
+		s.only(w, r, "GET", s.listManifests)
+	case strings.HasPrefix(r.URL.Path, "/manifests/"):
+		name := strings.TrimPrefix(r.URL.Path, "/manifests/")
+		if !validName(name) {
+			http.Error(w, "invalid name", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			s.getManifest(w, r, name)
+		case "PUT":
+			s.authorized(w, r, func(w http.ResponseWriter, r *http.Request) {
+				s.putManifest(w, r, name)
+			})
+		default:
+			methodNotAllowed(w)
+		}
+	case strings.HasPrefix(r.URL.Path, "/metadata/"):
+		name := strings.TrimPrefix(r.URL.Path, "/metadata/")
+		if !validMetadata(name) {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			s.getMetadata(w, r, name)
+		case "PUT":
+			s.authorized(w, r, func(w http.ResponseWriter, r *http.Request) {
+				s.putMetadata(w, r, name)
+			})
+		default:
+			methodNotAllowed(w)
+		}
+	case r.URL.Path == "/naming":
+		s.only(w, r, "GET", s.chunkNaming)
+	case r.URL.Path == "/chunks/have":
+		s.only(w, r, "POST", s.haveChunks)
+	case strings.HasPrefix(r.URL.Path, "/chunks/"):
+		hash := strings.TrimPrefix(r.URL.Path, "/chunks/")
+		if !repo.ValidHash(hash) {
+			http.Error(w, "invalid hash", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case "GET", "HEAD":
+			s.getChunk(w, r, hash)
+		case "PUT":
+			s.authorized(w, r, func(w http.ResponseWriter, r *http.Request) {
+				s.putChunk(w, r, hash)
+			})
+		default:
+			methodNotAllowed(w)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) only(w http.ResponseWriter, r *http.Request, method string, h http.HandlerFunc) {
+	if r.Method != method {
+		methodNotAllowed(w)
+		return
+	}
+	h(w, r)
+}
+
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request, h http.HandlerFunc) {
+	if s.token == "" {
+		http.Error(w, "uploads are disabled", http.StatusForbidden)
+		return
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(s.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h(w, r)
+}
+
+func methodNotAllowed(w http.ResponseWriter) {
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+func serverError(w http.ResponseWriter, err error) {
+	if os.IsNotExist(err) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// sealed reports whether the repository is encrypted. An encrypted one is
+// served sealed, as stored, so that the server needs no key; see package
+// repo.
+func (s *Server) sealed() (bool, error) {
+	cfg, err := s.repo.StoredConfig()
+	if err != nil {
+		return false, err
+	}
+	return cfg.Encryption != nil, nil
+}
+
+func (s *Server) listManifests(w http.ResponseWriter, r *http.Request) {
+	names, err := s.repo.LsFiles("", true)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	for _, name := range names {
+		fmt.Fprintln(w, name)
+	}
+}
+
+func (s *Server) getManifest(w http.ResponseWriter, r *http.Request, name string) {
+	sealed, err := s.sealed()
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if sealed {
+		data, err := s.repo.ReadStoredManifest(name)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+		return
+	}
+	m, err := s.repo.LoadManifest(name)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, m.String())
+}
+
+// putManifest refuses manifests that refer to chunks the repository doesn't
+// have, so a name is never published before its data. WriteManifest does
+// the checking, under the repository lock, so that GC can't remove a chunk
+// between the check and the write. A sealed history can't be checked; the
+// client sends it after the chunks.
+func (s *Server) putManifest(w http.ResponseWriter, r *http.Request, name string) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxChunkSize))
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	sealed, err := s.sealed()
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if sealed {
+		if err := s.repo.WriteStoredManifest(name, data); err != nil {
+			serverError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	m, err := repo.ParseManifest(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.repo.WriteManifest(name, m); err != nil {
+		if _, ok := err.(*repo.MissingChunkError); ok {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		serverError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getChunk(w http.ResponseWriter, r *http.Request, hash string) {
+	sealed, err := s.sealed()
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	var data []byte
+	if sealed {
+		data, err = s.repo.ReadStoredChunk(hash)
+	} else {
+		data, err = s.repo.ReadChunk(hash)
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+func (s *Server) putChunk(w http.ResponseWriter, r *http.Request, hash string) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxChunkSize))
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	sealed, err := s.sealed()
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if sealed {
+		err = s.repo.WriteStoredChunk(hash, data)
+	} else {
+		err = s.repo.WriteChunk(hash, data)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) chunkNaming(w http.ResponseWriter, r *http.Request) {
+	cfg, err := s.repo.StoredConfig()
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, cfg.ChunkNaming())
+}
+
+// haveChunks looks every hash up before writing any of the response, so
+// that a failure part way through is reported as an error rather than as a
+// truncated list.
+func (s *Server) haveChunks(w http.ResponseWriter, r *http.Request) {
+	sealed, err := s.sealed()
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	chunkSize := s.repo.ChunkSize
+	if sealed {
+		chunkSize = s.repo.StoredChunkSize
+	}
+	var out bytes.Buffer
+	sc := bufio.NewScanner(io.LimitReader(r.Body, maxChunkSize))
+	for sc.Scan() {
+		hash := strings.TrimSpace(sc.Text())
+		if hash == "" {
+			continue
+		}
+		if !repo.ValidHash(hash) {
+			http.Error(w, "invalid hash", http.StatusBadRequest)
+			return
+		}
+		size, err := chunkSize(hash)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		fmt.Fprintf(&out, "%s %d\n", hash, size)
+	}
+	if err := sc.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(out.Bytes())
+}
+
+// The server doesn't check signatures on metadata: clients do that against
+// the root they trust, so a bad upload only breaks fetches, not security.
+func (s *Server) getMetadata(w http.ResponseWriter, r *http.Request, name string) {
+	data, err := s.repo.LoadMetadata(name)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (s *Server) putMetadata(w http.ResponseWriter, r *http.Request, name string) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxChunkSize))
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if err := s.repo.WriteMetadata(name, data); err != nil {
+		serverError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func validMetadata(name string) bool {
+	for _, role := range tuf.Roles {
+		if name == tuf.Filename(role) {
+			return true
+		}
+	}
+	return false
+}
+
+func validName(name string) bool {
+	return repo.ValidName(name) == nil
+}
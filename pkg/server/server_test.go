@@ -0,0 +1,346 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/burke/rabit/pkg/remote"
+	"github.com/burke/rabit/pkg/repo"
+	"github.com/burke/rabit/pkg/tuf"
+)
+
+const (
+	blob1Path = "../repo/testfiles/blob1"
+	blob2Path = "../repo/testfiles/blob2"
+	token     = "sekrit"
+)
+
+func newTestRepo(t *testing.T) (repo.Repo, func()) {
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	r := repo.New(dir)
+	if err := r.Init(nil); err != nil {
+		t.Fatal("init")
+	}
+	return r, func() { os.RemoveAll(dir) }
+}
+
+func addFile(t *testing.T, r repo.Repo, path, name string) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal("open", path)
+	}
+	defer f.Close()
+	if err := r.Add(f, name); err != nil {
+		t.Fatal("repo add", err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	local, cleanupLocal := newTestRepo(t)
+	defer cleanupLocal()
+	served, cleanupServed := newTestRepo(t)
+	defer cleanupServed()
+	other, cleanupOther := newTestRepo(t)
+	defer cleanupOther()
+
+	srv := httptest.NewServer(New(served, token))
+	defer srv.Close()
+
+	addFile(t, local, blob1Path, "blob1")
+	addFile(t, local, blob2Path, "blob2")
+
+	client := remote.New(srv.URL, token)
+	for _, name := range []string{"blob1", "blob2"} {
+		if err := remote.Push(local, client, name); err != nil {
+			t.Fatal("push", err)
+		}
+	}
+
+	names, err := remote.New(srv.URL, "").ListManifests()
+	if err != nil {
+		t.Fatal("ls-remote", err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("expected 2 names, got %v", names)
+	}
+
+	if err := remote.Fetch(other, remote.New(srv.URL, ""), "blob2"); err != nil {
+		t.Fatal("fetch", err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := other.CatFile("blob2", buf); err != nil {
+		t.Fatal("cat", err)
+	}
+	expected, _ := ioutil.ReadFile(blob2Path)
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Error("round-tripped file doesn't match")
+	}
+}
+
+func TestUploadsRequireToken(t *testing.T) {
+	local, cleanupLocal := newTestRepo(t)
+	defer cleanupLocal()
+	served, cleanupServed := newTestRepo(t)
+	defer cleanupServed()
+
+	addFile(t, local, blob1Path, "blob1")
+
+	for _, tok := range []string{"", "wrong"} {
+		srv := httptest.NewServer(New(served, token))
+		err := remote.Push(local, remote.New(srv.URL, tok), "blob1")
+		srv.Close()
+		if err == nil {
+			t.Errorf("push with token %q succeeded", tok)
+		}
+	}
+
+	srv := httptest.NewServer(New(served, ""))
+	defer srv.Close()
+	if err := remote.Push(local, remote.New(srv.URL, token), "blob1"); err == nil {
+		t.Error("push to read-only server succeeded")
+	}
+}
+
+func TestRejectsManifestWithMissingChunks(t *testing.T) {
+	served, cleanup := newTestRepo(t)
+	defer cleanup()
+
+	srv := httptest.NewServer(New(served, token))
+	defer srv.Close()
+
+	m := &repo.Manifest{Chunks: []string{"24662838814f422b3050a99575b29a62d8af9e0f"}}
+	if err := remote.New(srv.URL, token).PutManifest("blob1", m); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Fatal("manifest with missing chunk accepted:", err)
+	}
+	if names, _ := served.LsFiles("", true); len(names) != 0 {
+		t.Error("manifest written")
+	}
+}
+
+func TestRejectsBadChunksAndNames(t *testing.T) {
+	served, cleanup := newTestRepo(t)
+	defer cleanup()
+
+	srv := httptest.NewServer(New(served, token))
+	defer srv.Close()
+
+	client := remote.New(srv.URL, token)
+	if err := client.PutChunk("24662838814f422b3050a99575b29a62d8af9e0f", []byte("nope")); err == nil {
+		t.Error("chunk with wrong hash accepted")
+	}
+
+	for _, path := range []string{"/chunks/..%2F..%2Fetc", "/manifests/..", "/manifests/a%2F..%2F..%2Fb", "/manifests/%2Fetc%2Fpasswd", "/manifests/a%2F%2Fb"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET %s: expected 400, got %d", path, resp.StatusCode)
+		}
+	}
+
+	req, _ := http.NewRequest("HEAD", srv.URL+"/chunks/24662838814f422b3050a99575b29a62d8af9e0f", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD missing chunk: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestSignedFetch(t *testing.T) {
+	local, cleanupLocal := newTestRepo(t)
+	defer cleanupLocal()
+	served, cleanupServed := newTestRepo(t)
+	defer cleanupServed()
+	other, cleanupOther := newTestRepo(t)
+	defer cleanupOther()
+
+	keys, err := ioutil.TempDir("", "rabit-keys")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	defer os.RemoveAll(keys)
+
+	srv := httptest.NewServer(New(served, token))
+	defer srv.Close()
+
+	addFile(t, local, blob1Path, "blob1")
+	if err := tuf.GenKeys(local, keys, tuf.Roles); err != nil {
+		t.Fatal("keygen", err)
+	}
+	if err := tuf.SignTargets(local, keys); err != nil {
+		t.Fatal("sign", err)
+	}
+	root, _ := local.LoadMetadata("root.json")
+	if err := tuf.Trust(other, root); err != nil {
+		t.Fatal("trust", err)
+	}
+
+	// An unsigned name is refused, even though its chunks are all there.
+	addFile(t, local, blob2Path, "blob2")
+	client := remote.New(srv.URL, token)
+	if err := remote.Push(local, client, "blob1"); err != nil {
+		t.Fatal("push", err)
+	}
+	if err := remote.Push(local, client, "blob2"); err != nil {
+		t.Fatal("push", err)
+	}
+	if err := remote.Fetch(other, client, "blob2"); err == nil {
+		t.Fatal("fetched unsigned file")
+	}
+
+	if err := remote.Fetch(other, client, "blob1"); err != nil {
+		t.Fatal("fetch", err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := other.CatFile("blob1", buf); err != nil {
+		t.Fatal("cat", err)
+	}
+	expected, _ := ioutil.ReadFile(blob1Path)
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Error("fetched file doesn't match")
+	}
+}
+
+func TestEncryptedRemotes(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+	store := repo.NewMemStore()
+	encrypted := repo.NewWithKey(store, secret)
+	if err := encrypted.Init(nil); err != nil {
+		t.Fatal("init", err)
+	}
+	addFile(t, encrypted, blob1Path, "blob1")
+	stranger := repo.NewWithKey(repo.NewMemStore(), secret)
+	if err := stranger.Init(nil); err != nil {
+		t.Fatal("init", err)
+	}
+	plain, cleanup := newTestRepo(t)
+	defer cleanup()
+
+	// Another repository names chunks differently, even under the same
+	// passphrase.
+	for _, served := range []repo.Repo{plain, stranger} {
+		srv := httptest.NewServer(New(served, token))
+		err := remote.Push(encrypted, remote.New(srv.URL, token), "blob1")
+		srv.Close()
+		if err == nil || !strings.Contains(err.Error(), "names chunks") {
+			t.Errorf("pushed an encrypted repository to another: %v", err)
+		}
+	}
+
+	// A copy of the repository, served without the key, holds only what
+	// the pushes seal.
+	copyConfig := func() repo.Store {
+		s := repo.NewMemStore()
+		data, err := store.GetMetadata("config.json")
+		if err != nil {
+			t.Fatal("config", err)
+		}
+		if err := s.PutMetadata("config.json", data); err != nil {
+			t.Fatal("copy config", err)
+		}
+		return s
+	}
+	served := copyConfig()
+	srv := httptest.NewServer(New(repo.NewWithStore(served), token))
+	defer srv.Close()
+	if err := remote.Push(encrypted, remote.New(srv.URL, token), "blob1"); err != nil {
+		t.Fatal("push to a copy:", err)
+	}
+	expected, _ := ioutil.ReadFile(blob1Path)
+	chunks, _ := served.ListChunks()
+	for _, hash := range chunks {
+		data, _ := served.GetChunk(hash)
+		if bytes.Contains(expected, data) || bytes.Contains(data, expected[:64]) {
+			t.Errorf("chunk %s served in the clear", hash)
+		}
+	}
+	names, _ := served.ListManifests("")
+	for _, name := range names {
+		data, _ := served.GetManifest(name)
+		if bytes.Contains(data, []byte(chunks[0])) {
+			t.Errorf("history of %s served in the clear", name)
+		}
+	}
+
+	fetched := repo.NewWithKey(copyConfig(), secret)
+	c := remote.New(srv.URL, "")
+	if err := remote.Fetch(fetched, c, "blob1"); err != nil {
+		t.Fatal("fetch into another copy:", err)
+	}
+	var buf bytes.Buffer
+	if err := fetched.CatFile("blob1", &buf); err != nil || !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("fetched copy differs: %v", err)
+	}
+	if info, err := remote.Describe(c, fetched, "blob1"); err != nil || info.Size != int64(len(expected)) {
+		t.Errorf("describe: %+v, %v", info, err)
+	}
+
+	// Pushing again adds nothing; pushing a new version adds it to the
+	// remote history.
+	if err := remote.Push(encrypted, remote.New(srv.URL, token), "blob1"); err != nil {
+		t.Fatal("push again:", err)
+	}
+	addFile(t, encrypted, blob2Path, "blob1")
+	if err := remote.Push(encrypted, remote.New(srv.URL, token), "blob1"); err != nil {
+		t.Fatal("push a new version:", err)
+	}
+	if err := remote.Fetch(fetched, c, "blob1"); err != nil {
+		t.Fatal("fetch the new version:", err)
+	}
+	if versions, err := fetched.Log("blob1"); err != nil || len(versions) != 2 {
+		t.Errorf("fetched history: %v, %v", versions, err)
+	}
+
+	if err := remote.Fetch(plain, c, "blob1"); err == nil {
+		t.Error("fetched from an encrypted repository into a plain one")
+	}
+}
+
+// failingRepo fails to size one chunk.
+type failingRepo struct {
+	repo.Repo
+	bad string
+}
+
+func (r failingRepo) ChunkSize(hash string) (int64, error) {
+	if hash == r.bad {
+		return 0, errors.New("disk on fire")
+	}
+	return r.Repo.ChunkSize(hash)
+}
+
+func TestHaveChunksFailsWhole(t *testing.T) {
+	served, cleanup := newTestRepo(t)
+	defer cleanup()
+	addFile(t, served, blob1Path, "blob1")
+	m, _ := served.LoadManifest("blob1")
+
+	srv := httptest.NewServer(New(failingRepo{served, m.Chunks[1]}, token))
+	defer srv.Close()
+
+	body := strings.Join(m.Chunks, "\n")
+	resp, err := http.Post(srv.URL+"/chunks/have", "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || strings.Contains(string(data), m.Chunks[0]) {
+		t.Errorf("failed lookup answered %d: %q", resp.StatusCode, data)
+	}
+}
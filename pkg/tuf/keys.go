@@ -0,0 +1,102 @@
+package tuf
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const keyTypeEd25519 = "ed25519"
+
+// Key is an ed25519 key. Private is only set for keys loaded from a key
+// directory, and is never written into metadata.
+type Key struct {
+	Type    string `json:"keytype"`
+	Public  string `json:"public"`
+	Private string `json:"private,omitempty"`
+}
+
+// GenerateKey creates a new ed25519 signing key.
+func GenerateKey() (*Key, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{
+		Type:    keyTypeEd25519,
+		Public:  hex.EncodeToString(pub),
+		Private: hex.EncodeToString(priv),
+	}, nil
+}
+
+// ID is the hex SHA-256 of the public key.
+func (k *Key) ID() string {
+	sum := sha256.Sum256([]byte(k.Type + ":" + k.Public))
+	return hex.EncodeToString(sum[:])
+}
+
+// PublicKey returns k without its private half.
+func (k *Key) PublicKey() *Key {
+	return &Key{Type: k.Type, Public: k.Public}
+}
+
+func (k *Key) sign(msg []byte) (Signature, error) {
+	priv, err := hex.DecodeString(k.Private)
+	if err != nil || len(priv) != ed25519.PrivateKeySize {
+		return Signature{}, errors.New("tuf: malformed private key")
+	}
+	sig := ed25519.Sign(ed25519.PrivateKey(priv), msg)
+	return Signature{KeyID: k.ID(), Sig: hex.EncodeToString(sig)}, nil
+}
+
+func (k *Key) verify(msg []byte, sig string) bool {
+	if k.Type != keyTypeEd25519 {
+		return false
+	}
+	pub, err := hex.DecodeString(k.Public)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	s, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(pub), msg, s)
+}
+
+// LoadKeys reads the private keys for role from dir. A role without keys
+// yields an empty list.
+func LoadKeys(dir, role string) ([]*Key, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, Filename(role)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []*Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("tuf: %s keys: %s", role, err)
+	}
+	return keys, nil
+}
+
+// SaveKeys writes the private keys for role to dir, readable only by the
+// current user.
+func SaveKeys(dir, role string, keys []*Key) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, Filename(role)), data, 0600)
+}
@@ -0,0 +1,124 @@
+// Package tuf signs and verifies rabit manifests using a cut-down version of
+// The Update Framework's role hierarchy.
+//
+// Four roles each sign one metadata file:
+//
+//	root.json       the keys trusted for every role, and how many of them
+//	                must sign
+//	targets.json    the length and SHA-256 of every published manifest
+//	snapshot.json   the version, length and hash of targets.json
+//	timestamp.json  the version, length and hash of snapshot.json
+//
+// A client pins root.json out of band, then walks timestamp, snapshot and
+// targets in order, checking signatures, expiry and that no version ever
+// goes backwards, before trusting a manifest.
+package tuf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Role names.
+const (
+	RoleRoot      = "root"
+	RoleTargets   = "targets"
+	RoleSnapshot  = "snapshot"
+	RoleTimestamp = "timestamp"
+)
+
+// Roles lists every role, in the order their metadata is published.
+var Roles = []string{RoleRoot, RoleTargets, RoleSnapshot, RoleTimestamp}
+
+// Filename returns the name of the metadata file signed by role.
+func Filename(role string) string {
+	return role + ".json"
+}
+
+// Signed is the envelope every metadata file is stored in.
+type Signed struct {
+	Signed     json.RawMessage `json:"signed"`
+	Signatures []Signature     `json:"signatures"`
+}
+
+type Signature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// common holds the fields shared by every role's metadata.
+type common struct {
+	Type    string    `json:"_type"`
+	Version int       `json:"version"`
+	Expires time.Time `json:"expires"`
+}
+
+type RoleKeys struct {
+	KeyIDs    []string `json:"keyids"`
+	Threshold int      `json:"threshold"`
+}
+
+type Root struct {
+	Type    string               `json:"_type"`
+	Version int                  `json:"version"`
+	Expires time.Time            `json:"expires"`
+	Keys    map[string]*Key      `json:"keys"`
+	Roles   map[string]*RoleKeys `json:"roles"`
+}
+
+// FileMeta describes a file by its length and hashes.
+type FileMeta struct {
+	Length int64             `json:"length"`
+	Hashes map[string]string `json:"hashes"`
+}
+
+// SnapshotMeta additionally pins the version of a metadata file.
+type SnapshotMeta struct {
+	FileMeta
+	Version int `json:"version"`
+}
+
+type Targets struct {
+	Type    string               `json:"_type"`
+	Version int                  `json:"version"`
+	Expires time.Time            `json:"expires"`
+	Targets map[string]*FileMeta `json:"targets"`
+}
+
+type Snapshot struct {
+	Type    string                   `json:"_type"`
+	Version int                      `json:"version"`
+	Expires time.Time                `json:"expires"`
+	Meta    map[string]*SnapshotMeta `json:"meta"`
+}
+
+type Timestamp struct {
+	Type    string                   `json:"_type"`
+	Version int                      `json:"version"`
+	Expires time.Time                `json:"expires"`
+	Meta    map[string]*SnapshotMeta `json:"meta"`
+}
+
+// NewFileMeta describes data.
+func NewFileMeta(data []byte) FileMeta {
+	sum := sha256.Sum256(data)
+	return FileMeta{
+		Length: int64(len(data)),
+		Hashes: map[string]string{"sha256": hex.EncodeToString(sum[:])},
+	}
+}
+
+// Matches reports whether data has the length and hash m describes.
+func (m *FileMeta) Matches(data []byte) bool {
+	if int64(len(data)) != m.Length {
+		return false
+	}
+	expected, ok := m.Hashes["sha256"]
+	if !ok {
+		return false
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) == expected
+}
@@ -0,0 +1,218 @@
+package tuf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/burke/rabit/pkg/repo"
+)
+
+// Expiry is how long freshly signed metadata for each role stays valid.
+// Timestamps are short-lived so that a client can't be held on stale
+// metadata for long; sign needs to be re-run at least this often.
+var Expiry = map[string]time.Duration{
+	RoleRoot:      365 * 24 * time.Hour,
+	RoleTargets:   90 * 24 * time.Hour,
+	RoleSnapshot:  7 * 24 * time.Hour,
+	RoleTimestamp: 24 * time.Hour,
+}
+
+// ErrNoRootKey is returned when root.json would need re-signing but there
+// is no root key to do it with.
+var ErrNoRootKey = errors.New("tuf: no root key; run keygen for the root role first")
+
+func validRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// decode unpacks the payload of a metadata file without checking its
+// signatures. It is only used on metadata this repository wrote itself or
+// already verified.
+func decode(data []byte, v interface{}) error {
+	var env Signed
+	if err := json.Unmarshal(data, &env); err != nil {
+		return err
+	}
+	return json.Unmarshal(env.Signed, v)
+}
+
+func loadLocal(r repo.Repo, role string, v interface{}) (bool, error) {
+	data, err := r.LoadMetadata(Filename(role))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := decode(data, v); err != nil {
+		return false, fmt.Errorf("tuf: local %s: %s", Filename(role), err)
+	}
+	return true, nil
+}
+
+// GenKeys generates a new signing key for each of roles, saves the private
+// halves in keyDir, and re-signs root.json in r so that it trusts them.
+func GenKeys(r repo.Repo, keyDir string, roles []string) error {
+	root := &Root{
+		Type:  RoleRoot,
+		Keys:  make(map[string]*Key),
+		Roles: make(map[string]*RoleKeys),
+	}
+	if _, err := loadLocal(r, RoleRoot, root); err != nil {
+		return err
+	}
+
+	for _, role := range roles {
+		if !validRole(role) {
+			return fmt.Errorf("tuf: unknown role %q", role)
+		}
+		key, err := GenerateKey()
+		if err != nil {
+			return err
+		}
+		keys, err := LoadKeys(keyDir, role)
+		if err != nil {
+			return err
+		}
+		if err := SaveKeys(keyDir, role, append(keys, key)); err != nil {
+			return err
+		}
+
+		root.Keys[key.ID()] = key.PublicKey()
+		rk, ok := root.Roles[role]
+		if !ok {
+			rk = &RoleKeys{Threshold: 1}
+			root.Roles[role] = rk
+		}
+		rk.KeyIDs = append(rk.KeyIDs, key.ID())
+	}
+
+	rootKeys, err := LoadKeys(keyDir, RoleRoot)
+	if err != nil {
+		return err
+	}
+	if len(rootKeys) == 0 {
+		return ErrNoRootKey
+	}
+
+	root.Version++
+	root.Expires = time.Now().Add(Expiry[RoleRoot]).UTC()
+	data, err := Sign(root, rootKeys)
+	if err != nil {
+		return err
+	}
+	return r.WriteMetadata(Filename(RoleRoot), data)
+}
+
+func signingKeys(keyDir, role string) ([]*Key, error) {
+	keys, err := LoadKeys(keyDir, role)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("tuf: no %s key; run keygen for the %s role first", role, role)
+	}
+	return keys, nil
+}
+
+// SignTargets records the length and hash of every manifest in r in new
+// targets metadata, and signs fresh snapshot and timestamp metadata over
+// it. Each role's version is one more than the last one signed.
+func SignTargets(r repo.Repo, keyDir string) error {
+	var root Root
+	ok, err := loadLocal(r, RoleRoot, &root)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNoRootKey
+	}
+
+	names, err := r.LsFiles("", true)
+	if err != nil {
+		return err
+	}
+
+	var prev Targets
+	if _, err := loadLocal(r, RoleTargets, &prev); err != nil {
+		return err
+	}
+	targets := &Targets{
+		Type:    RoleTargets,
+		Version: prev.Version + 1,
+		Expires: time.Now().Add(Expiry[RoleTargets]).UTC(),
+		Targets: make(map[string]*FileMeta, len(names)),
+	}
+	for _, name := range names {
+		m, err := r.LoadManifest(name)
+		if err != nil {
+			return err
+		}
+		fm := NewFileMeta([]byte(m.String()))
+		targets.Targets[name] = &fm
+	}
+	targetsData, err := signRole(keyDir, RoleTargets, targets)
+	if err != nil {
+		return err
+	}
+
+	var prevSnapshot Snapshot
+	if _, err := loadLocal(r, RoleSnapshot, &prevSnapshot); err != nil {
+		return err
+	}
+	snapshot := &Snapshot{
+		Type:    RoleSnapshot,
+		Version: prevSnapshot.Version + 1,
+		Expires: time.Now().Add(Expiry[RoleSnapshot]).UTC(),
+		Meta: map[string]*SnapshotMeta{
+			Filename(RoleTargets): {NewFileMeta(targetsData), targets.Version},
+		},
+	}
+	snapshotData, err := signRole(keyDir, RoleSnapshot, snapshot)
+	if err != nil {
+		return err
+	}
+
+	var prevTimestamp Timestamp
+	if _, err := loadLocal(r, RoleTimestamp, &prevTimestamp); err != nil {
+		return err
+	}
+	timestamp := &Timestamp{
+		Type:    RoleTimestamp,
+		Version: prevTimestamp.Version + 1,
+		Expires: time.Now().Add(Expiry[RoleTimestamp]).UTC(),
+		Meta: map[string]*SnapshotMeta{
+			Filename(RoleSnapshot): {NewFileMeta(snapshotData), snapshot.Version},
+		},
+	}
+	timestampData, err := signRole(keyDir, RoleTimestamp, timestamp)
+	if err != nil {
+		return err
+	}
+
+	// Written bottom-up, so that a reader never sees a timestamp pointing at
+	// a snapshot that doesn't exist yet.
+	if err := r.WriteMetadata(Filename(RoleTargets), targetsData); err != nil {
+		return err
+	}
+	if err := r.WriteMetadata(Filename(RoleSnapshot), snapshotData); err != nil {
+		return err
+	}
+	return r.WriteMetadata(Filename(RoleTimestamp), timestampData)
+}
+
+func signRole(keyDir, role string, v interface{}) ([]byte, error) {
+	keys, err := signingKeys(keyDir, role)
+	if err != nil {
+		return nil, err
+	}
+	return Sign(v, keys)
+}
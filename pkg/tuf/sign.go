@@ -0,0 +1,108 @@
+package tuf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrExpired      = errors.New("tuf: metadata has expired")
+	ErrRollback     = errors.New("tuf: metadata version went backwards")
+	ErrNotSigned    = errors.New("tuf: not enough valid signatures")
+	ErrWrongType    = errors.New("tuf: metadata is for the wrong role")
+	ErrHashMismatch = errors.New("tuf: file does not match its recorded length and hash")
+)
+
+// Sign marshals v and wraps it in an envelope signed by every key in keys.
+// Signatures are made over the compact encoding of v, so the envelope can
+// be indented for readability.
+func Sign(v interface{}, keys []*Key) ([]byte, error) {
+	signed, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	env := Signed{Signed: signed}
+	for _, k := range keys {
+		sig, err := k.sign(signed)
+		if err != nil {
+			return nil, err
+		}
+		env.Signatures = append(env.Signatures, sig)
+	}
+	return json.MarshalIndent(env, "", "  ")
+}
+
+// Verify checks that data is metadata for role, signed by at least the
+// threshold of role's keys in root and not yet expired, and decodes it
+// into v.
+func Verify(data []byte, role string, root *Root, v interface{}) error {
+	var env Signed
+	if err := json.Unmarshal(data, &env); err != nil {
+		return fmt.Errorf("tuf: %s: %s", Filename(role), err)
+	}
+
+	var signed bytes.Buffer
+	if err := json.Compact(&signed, env.Signed); err != nil {
+		return fmt.Errorf("tuf: %s: %s", Filename(role), err)
+	}
+
+	rk, ok := root.Roles[role]
+	if !ok {
+		return fmt.Errorf("tuf: root has no %s role", role)
+	}
+	trusted := make(map[string]bool, len(rk.KeyIDs))
+	for _, id := range rk.KeyIDs {
+		trusted[id] = true
+	}
+
+	valid := make(map[string]bool)
+	for _, sig := range env.Signatures {
+		if !trusted[sig.KeyID] {
+			continue
+		}
+		key, ok := root.Keys[sig.KeyID]
+		if !ok || key.ID() != sig.KeyID {
+			continue
+		}
+		if key.verify(signed.Bytes(), sig.Sig) {
+			valid[sig.KeyID] = true
+		}
+	}
+	if rk.Threshold < 1 || len(valid) < rk.Threshold {
+		return ErrNotSigned
+	}
+
+	var c common
+	if err := json.Unmarshal(env.Signed, &c); err != nil {
+		return fmt.Errorf("tuf: %s: %s", Filename(role), err)
+	}
+	if c.Type != role {
+		return ErrWrongType
+	}
+	if time.Now().After(c.Expires) {
+		return ErrExpired
+	}
+
+	return json.Unmarshal(env.Signed, v)
+}
+
+// VerifyRoot checks that data is a root signed by its own root keys. It is
+// used for roots that arrive out of band and are about to be pinned.
+func VerifyRoot(data []byte) (*Root, error) {
+	var env Signed
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("tuf: root.json: %s", err)
+	}
+	var unverified Root
+	if err := json.Unmarshal(env.Signed, &unverified); err != nil {
+		return nil, fmt.Errorf("tuf: root.json: %s", err)
+	}
+	var root Root
+	if err := Verify(data, RoleRoot, &unverified, &root); err != nil {
+		return nil, err
+	}
+	return &root, nil
+}
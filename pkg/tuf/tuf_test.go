@@ -0,0 +1,163 @@
+package tuf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/burke/rabit/pkg/repo"
+)
+
+type testRepo struct {
+	repo.Repo
+	dir string
+}
+
+func (r *testRepo) keys() string {
+	return filepath.Join(r.dir, "keys")
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	dir, err := ioutil.TempDir("", "rabit-test")
+	if err != nil {
+		t.Fatal("tempdir")
+	}
+	r := repo.New(dir)
+	if err := r.Init(nil); err != nil {
+		t.Fatal("init")
+	}
+	return &testRepo{Repo: r, dir: dir}
+}
+
+// newPublisher returns a repository holding blob1, with keys for every role
+// and signed metadata.
+func newPublisher(t *testing.T) *testRepo {
+	r := newTestRepo(t)
+	f, err := os.Open("../repo/testfiles/blob1")
+	if err != nil {
+		t.Fatal("open blob1")
+	}
+	defer f.Close()
+	if err := r.Add(f, "blob1"); err != nil {
+		t.Fatal("add", err)
+	}
+	if err := GenKeys(r, r.keys(), Roles); err != nil {
+		t.Fatal("keygen", err)
+	}
+	if err := SignTargets(r, r.keys()); err != nil {
+		t.Fatal("sign", err)
+	}
+	return r
+}
+
+func trust(t *testing.T, consumer, publisher *testRepo) {
+	root, err := publisher.LoadMetadata(Filename(RoleRoot))
+	if err != nil {
+		t.Fatal("load root", err)
+	}
+	if err := Trust(consumer, root); err != nil {
+		t.Fatal("trust", err)
+	}
+}
+
+func manifestData(t *testing.T, r repo.Repo, name string) []byte {
+	m, err := r.LoadManifest(name)
+	if err != nil {
+		t.Fatal("load manifest", err)
+	}
+	return []byte(m.String())
+}
+
+func TestUpdateVerifiesTargets(t *testing.T) {
+	pub := newPublisher(t)
+	defer os.RemoveAll(pub.dir)
+	con := newTestRepo(t)
+	defer os.RemoveAll(con.dir)
+
+	if _, err := Update(con, pub.LoadMetadata); err != ErrNoRoot {
+		t.Fatalf("expected ErrNoRoot, got %v", err)
+	}
+
+	trust(t, con, pub)
+	targets, err := Update(con, pub.LoadMetadata)
+	if err != nil {
+		t.Fatal("update", err)
+	}
+
+	data := manifestData(t, pub, "blob1")
+	if err := targets.VerifyTarget("blob1", data); err != nil {
+		t.Error("verify blob1", err)
+	}
+	data[0] ^= 1
+	if err := targets.VerifyTarget("blob1", data); err != ErrHashMismatch {
+		t.Errorf("expected ErrHashMismatch for tampered manifest, got %v", err)
+	}
+	if err := targets.VerifyTarget("blob2", data); err == nil {
+		t.Error("verified a name that was never signed")
+	}
+}
+
+func TestUpdateRejectsUntrustedKeys(t *testing.T) {
+	pub := newPublisher(t)
+	defer os.RemoveAll(pub.dir)
+	impostor := newPublisher(t)
+	defer os.RemoveAll(impostor.dir)
+	con := newTestRepo(t)
+	defer os.RemoveAll(con.dir)
+
+	trust(t, con, pub)
+	if _, err := Update(con, impostor.LoadMetadata); err != ErrNotSigned {
+		t.Fatalf("expected ErrNotSigned, got %v", err)
+	}
+}
+
+func TestUpdateRejectsExpired(t *testing.T) {
+	pub := newPublisher(t)
+	defer os.RemoveAll(pub.dir)
+	con := newTestRepo(t)
+	defer os.RemoveAll(con.dir)
+	trust(t, con, pub)
+
+	saved := Expiry[RoleTimestamp]
+	Expiry[RoleTimestamp] = -time.Hour
+	err := SignTargets(pub, pub.keys())
+	Expiry[RoleTimestamp] = saved
+	if err != nil {
+		t.Fatal("sign", err)
+	}
+
+	if _, err := Update(con, pub.LoadMetadata); err != ErrExpired {
+		t.Fatalf("expected ErrExpired, got %v", err)
+	}
+}
+
+func TestUpdateRejectsRollback(t *testing.T) {
+	pub := newPublisher(t)
+	defer os.RemoveAll(pub.dir)
+	con := newTestRepo(t)
+	defer os.RemoveAll(con.dir)
+	trust(t, con, pub)
+
+	old := make(map[string][]byte)
+	for _, role := range Roles {
+		data, err := pub.LoadMetadata(Filename(role))
+		if err != nil {
+			t.Fatal("load", err)
+		}
+		old[Filename(role)] = data
+	}
+
+	if err := SignTargets(pub, pub.keys()); err != nil {
+		t.Fatal("sign", err)
+	}
+	if _, err := Update(con, pub.LoadMetadata); err != nil {
+		t.Fatal("update", err)
+	}
+
+	replay := func(name string) ([]byte, error) { return old[name], nil }
+	if _, err := Update(con, replay); err != ErrRollback {
+		t.Fatalf("expected ErrRollback, got %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package tuf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/burke/rabit/pkg/repo"
+)
+
+// ErrNoRoot is returned by Update when the local repository has no pinned
+// root.json, and so can't verify anything.
+var ErrNoRoot = errors.New("tuf: no trusted root.json in the local repository")
+
+// Trust pins data as the root.json of local, after checking that it is
+// signed by its own root keys.
+func Trust(local repo.Repo, data []byte) error {
+	if _, err := VerifyRoot(data); err != nil {
+		return err
+	}
+	return local.WriteMetadata(Filename(RoleRoot), data)
+}
+
+// Update downloads timestamp, snapshot and targets metadata with get and
+// verifies each one against the root pinned in local: signatures must meet
+// the role's threshold, nothing may have expired, each file must match the
+// length, hash and version recorded by the role above it, and no version
+// may be lower than the one last seen. Verified metadata is saved to local
+// so later updates can detect rollback.
+func Update(local repo.Repo, get func(name string) ([]byte, error)) (*Targets, error) {
+	rootData, err := local.LoadMetadata(Filename(RoleRoot))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoRoot
+		}
+		return nil, err
+	}
+	root, err := VerifyRoot(rootData)
+	if err != nil {
+		return nil, err
+	}
+
+	timestampData, err := get(Filename(RoleTimestamp))
+	if err != nil {
+		return nil, err
+	}
+	var timestamp Timestamp
+	if err := Verify(timestampData, RoleTimestamp, root, &timestamp); err != nil {
+		return nil, err
+	}
+	var oldTimestamp Timestamp
+	if _, err := loadLocal(local, RoleTimestamp, &oldTimestamp); err != nil {
+		return nil, err
+	}
+	if timestamp.Version < oldTimestamp.Version {
+		return nil, ErrRollback
+	}
+
+	snapshotData, err := getPinned(get, RoleSnapshot, timestamp.Meta)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot Snapshot
+	if err := Verify(snapshotData, RoleSnapshot, root, &snapshot); err != nil {
+		return nil, err
+	}
+	var oldSnapshot Snapshot
+	if _, err := loadLocal(local, RoleSnapshot, &oldSnapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Version != timestamp.Meta[Filename(RoleSnapshot)].Version || snapshot.Version < oldSnapshot.Version {
+		return nil, ErrRollback
+	}
+
+	targetsData, err := getPinned(get, RoleTargets, snapshot.Meta)
+	if err != nil {
+		return nil, err
+	}
+	var targets Targets
+	if err := Verify(targetsData, RoleTargets, root, &targets); err != nil {
+		return nil, err
+	}
+	var oldTargets Targets
+	if _, err := loadLocal(local, RoleTargets, &oldTargets); err != nil {
+		return nil, err
+	}
+	if targets.Version != snapshot.Meta[Filename(RoleTargets)].Version || targets.Version < oldTargets.Version {
+		return nil, ErrRollback
+	}
+
+	if err := local.WriteMetadata(Filename(RoleTargets), targetsData); err != nil {
+		return nil, err
+	}
+	if err := local.WriteMetadata(Filename(RoleSnapshot), snapshotData); err != nil {
+		return nil, err
+	}
+	if err := local.WriteMetadata(Filename(RoleTimestamp), timestampData); err != nil {
+		return nil, err
+	}
+
+	return &targets, nil
+}
+
+// getPinned downloads the metadata for role and checks it against the
+// length and hash meta records for it.
+func getPinned(get func(string) ([]byte, error), role string, meta map[string]*SnapshotMeta) ([]byte, error) {
+	m, ok := meta[Filename(role)]
+	if !ok {
+		return nil, fmt.Errorf("tuf: no entry for %s", Filename(role))
+	}
+	data, err := get(Filename(role))
+	if err != nil {
+		return nil, err
+	}
+	if !m.Matches(data) {
+		return nil, ErrHashMismatch
+	}
+	return data, nil
+}
+
+// VerifyTarget checks that data is the manifest t records for name.
+func (t *Targets) VerifyTarget(name string, data []byte) error {
+	m, ok := t.Targets[name]
+	if !ok {
+		return fmt.Errorf("tuf: %s is not a signed target", name)
+	}
+	if !m.Matches(data) {
+		return ErrHashMismatch
+	}
+	return nil
+}